@@ -0,0 +1,224 @@
+package gostalk
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// rights a user can be granted on tubes. Admin implies the others.
+const (
+	RIGHT_PUT     = "put"     // put jobs into the tube
+	RIGHT_RESERVE = "reserve" // reserve and peek jobs of the tube
+	RIGHT_ADMIN   = "admin"   // delete jobs of others, kick and pause the tube
+)
+
+// how often HashPassword iterates, high enough to make guessing slow.
+const passwordIterations = 100000
+
+const passwordScheme = "pbkdf2-sha256"
+
+// an account as read from the auth file, like:
+//
+//	alice:
+//	  password: pbkdf2-sha256$100000$c2FsdA$...
+//	  acl:
+//	    - tubes: mail.*
+//	      rights: [put, reserve]
+type account struct {
+	Password string  `yaml:"password"`
+	ACL      []grant `yaml:"acl"`
+}
+
+// rights on the tubes whose name matches a pattern, where * stands for any
+// run of characters.
+type grant struct {
+	Tubes  string   `yaml:"tubes"`
+	Rights []string `yaml:"rights"`
+}
+
+// reads the users in the auth file at path.
+func readUsers(path string) (map[string]*account, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string]*account{}
+	err = yaml.Unmarshal(content, &users)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, user := range users {
+		if user == nil || !strings.HasPrefix(user.Password, passwordScheme+"$") {
+			return nil, fmt.Errorf("gostalk: user %s has no %s password", name, passwordScheme)
+		}
+		for _, grant := range user.ACL {
+			for _, right := range grant.Rights {
+				if right != RIGHT_PUT && right != RIGHT_RESERVE && right != RIGHT_ADMIN {
+					return nil, fmt.Errorf("gostalk: user %s has unknown right %q", name, right)
+				}
+			}
+		}
+	}
+	return users, nil
+}
+
+// the user name signs in as with password, nil if there's no such user or
+// the password is wrong.
+func (server *Server) authenticate(name, password string) *account {
+	user, found := server.users[name]
+	if !found {
+		// turned down as slowly as a wrong password, so the time it takes
+		// doesn't tell which users exist.
+		checkPassword(unknownUserHash, password)
+		return nil
+	}
+
+	ok, err := checkPassword(user.Password, password)
+	if err != nil {
+		pf("checkPassword of %s: %v", name, err)
+	}
+	if !ok {
+		return nil
+	}
+	return user
+}
+
+// answers whether the user was granted right, or admin, on the tube.
+func (user *account) may(right, tube string) bool {
+	if user == nil {
+		return false
+	}
+	for _, grant := range user.ACL {
+		if !matchTubes(grant.Tubes, tube) {
+			continue
+		}
+		for _, granted := range grant.Rights {
+			if granted == right || granted == RIGHT_ADMIN {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// answers whether the user may administrate every tube, as draining affects
+// them all.
+func (user *account) mayAdministrate() bool {
+	if user == nil {
+		return false
+	}
+	for _, grant := range user.ACL {
+		if grant.Tubes != "*" {
+			continue
+		}
+		for _, granted := range grant.Rights {
+			if granted == RIGHT_ADMIN {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matches name against pattern, where * stands for any run of characters.
+// Tube names may contain all of path.Match's separators, so it won't do.
+func matchTubes(pattern, name string) bool {
+	chunks := strings.Split(pattern, "*")
+	if len(chunks) == 1 {
+		return pattern == name
+	}
+
+	if !strings.HasPrefix(name, chunks[0]) {
+		return false
+	}
+	name = name[len(chunks[0]):]
+
+	last := chunks[len(chunks)-1]
+	for _, chunk := range chunks[1 : len(chunks)-1] {
+		index := strings.Index(name, chunk)
+		if index < 0 {
+			return false
+		}
+		name = name[index+len(chunk):]
+	}
+	return len(name) >= len(last) && strings.HasSuffix(name, last)
+}
+
+// HashPassword returns password hashed for the auth file.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := pbkdf2([]byte(password), salt, passwordIterations)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+var errBadHash = errors.New("gostalk: malformed password hash")
+
+// checked against the passwords of users that don't exist, no password
+// matches it.
+var unknownUserHash = fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIterations,
+	base64.RawStdEncoding.EncodeToString(make([]byte, 16)),
+	base64.RawStdEncoding.EncodeToString(make([]byte, sha256.Size)))
+
+// answers whether password hashes to hash, as returned by HashPassword.
+func checkPassword(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return false, errBadHash
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false, errBadHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, errBadHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) != sha256.Size {
+		return false, errBadHash
+	}
+
+	actual := pbkdf2([]byte(password), salt, iterations)
+	return subtle.ConstantTimeCompare(actual, key) == 1, nil
+}
+
+// PBKDF2 with HMAC-SHA256 as in RFC 8018, deriving a single block.
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	binary.Write(mac, binary.BigEndian, uint32(1))
+	u := mac.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for n := 1; n < iterations; n += 1 {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for i := range key {
+			key[i] ^= u[i]
+		}
+	}
+	return key
+}
@@ -0,0 +1,208 @@
+package gostalk
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "github.com/manveru/gobdd"
+)
+
+// writes an auth file with the given YAML and answers its path.
+func writeAuthFile(content string) string {
+	file, err := ioutil.TempFile("", "gostalk-auth")
+	Expect(err, ToBeNil)
+	_, err = file.WriteString(content)
+	Expect(err, ToBeNil)
+	file.Close()
+	return file.Name()
+}
+
+func init() {
+	defer PrintSpecReport()
+
+	Describe("password hashes", func() {
+		hash, err := HashPassword("secret")
+
+		It("derive keys as in RFC 7914", func() {
+			key := pbkdf2([]byte("passwd"), []byte("salt"), 1)
+			Expect(hex.EncodeToString(key), ToEqual, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc")
+		})
+
+		It("accept the password they were made from", func() {
+			Expect(err, ToBeNil)
+			ok, err := checkPassword(hash, "secret")
+			Expect(err, ToBeNil)
+			Expect(ok, ToEqual, true)
+		})
+
+		It("reject other passwords", func() {
+			ok, err := checkPassword(hash, "Secret")
+			Expect(err, ToBeNil)
+			Expect(ok, ToEqual, false)
+		})
+
+		It("are salted", func() {
+			other, _ := HashPassword("secret")
+			Expect(other == hash, ToEqual, false)
+		})
+
+		It("fail when malformed", func() {
+			_, err := checkPassword("pbkdf2-sha256$many$salt$key", "secret")
+			Expect(err, ToEqual, errBadHash)
+			_, err = checkPassword("secret", "secret")
+			Expect(err, ToEqual, errBadHash)
+		})
+
+		It("have a stand-in for unknown users that takes as long to check", func() {
+			ok, err := checkPassword(unknownUserHash, "secret")
+			Expect(err, ToBeNil)
+			Expect(ok, ToEqual, false)
+		})
+	})
+
+	Describe("matchTubes", func() {
+		It("matches names exactly without a *", func() {
+			Expect(matchTubes("mail", "mail"), ToEqual, true)
+			Expect(matchTubes("mail", "mail.out"), ToEqual, false)
+		})
+
+		It("matches any run of characters with a *", func() {
+			Expect(matchTubes("*", "anything/at+all"), ToEqual, true)
+			Expect(matchTubes("mail.*", "mail.out"), ToEqual, true)
+			Expect(matchTubes("mail.*", "mail."), ToEqual, true)
+			Expect(matchTubes("mail.*", "mail"), ToEqual, false)
+			Expect(matchTubes("*.out", "mail.out"), ToEqual, true)
+			Expect(matchTubes("a*b*c", "abc"), ToEqual, true)
+			Expect(matchTubes("a*b*c", "axxbyyc"), ToEqual, true)
+			Expect(matchTubes("a*b*c", "axxcyyb"), ToEqual, false)
+			Expect(matchTubes("ab*ba", "aba"), ToEqual, false)
+		})
+	})
+
+	Describe("readUsers", func() {
+		It("rejects users without a hashed password", func() {
+			path := writeAuthFile("alice: {password: secret}\n")
+			defer os.Remove(path)
+			_, err := readUsers(path)
+			Expect(err == nil, ToEqual, false)
+		})
+
+		It("rejects unknown rights", func() {
+			hash, _ := HashPassword("secret")
+			path := writeAuthFile(fmt.Sprintf("alice: {password: %q, acl: [{tubes: '*', rights: [delete]}]}\n", hash))
+			defer os.Remove(path)
+			_, err := readUsers(path)
+			Expect(err == nil, ToEqual, false)
+		})
+	})
+
+	Describe("auth", func() {
+		aliceHash, _ := HashPassword("wonderland")
+		rootHash, _ := HashPassword("toor")
+		path := writeAuthFile(fmt.Sprintf(`
+alice:
+  password: %q
+  acl:
+    - tubes: mail.*
+      rights: [put, reserve]
+    - tubes: logs
+      rights: [put]
+root:
+  password: %q
+  acl:
+    - tubes: "*"
+      rights: [admin]
+`, aliceHash, rootHash))
+		defer os.Remove(path)
+
+		config := DefaultConfig()
+		config.AuthFile = path
+		server, addr := startServer(config)
+
+		alice := dialStats(addr)
+		defer alice.conn.Close()
+		root := dialStats(addr)
+		defer root.conn.Close()
+
+		It("is required before other commands", func() {
+			Expect(alice.do("list-tubes"), ToEqual, "UNAUTHORIZED")
+			Expect(alice.do("put 0 0 60 5\r\nhello"), ToEqual, "UNAUTHORIZED")
+			Expect(alice.do("use mail.out"), ToEqual, "UNAUTHORIZED")
+		})
+
+		It("fails for unknown users and wrong passwords", func() {
+			Expect(alice.do("auth mallory wonderland"), ToEqual, "UNAUTHORIZED")
+			Expect(alice.do("auth alice toor"), ToEqual, "UNAUTHORIZED")
+			Expect(alice.do("auth alice"), ToEqual, "BAD_FORMAT")
+			Expect(alice.do("list-tube-used"), ToEqual, "UNAUTHORIZED")
+		})
+
+		It("takes as long to turn down unknown users as wrong passwords", func() {
+			started := time.Now()
+			Expect(server.authenticate("alice", "toor") == nil, ToEqual, true)
+			wrong := time.Since(started)
+
+			started = time.Now()
+			Expect(server.authenticate("mallory", "toor") == nil, ToEqual, true)
+			unknown := time.Since(started)
+			Expect(unknown > wrong/4, ToEqual, true)
+		})
+
+		It("lets users in with their password", func() {
+			Expect(alice.do("auth alice wonderland"), ToEqual, "AUTHENTICATED")
+			Expect(alice.do("list-tube-used"), ToEqual, "USING default")
+			Expect(root.do("auth root toor"), ToEqual, "AUTHENTICATED")
+		})
+
+		It("limits put to the tubes granted", func() {
+			Expect(alice.do("put 0 0 60 5\r\nhello"), ToEqual, "UNAUTHORIZED")
+			alice.do("use mail.out")
+			Expect(alice.do("put 0 0 60 5\r\nhello"), ToEqual, "INSERTED 0")
+			alice.do("use logs")
+			Expect(alice.do("put 0 0 60 5\r\nhello"), ToEqual, "INSERTED 1")
+		})
+
+		It("limits peeking to the tubes granted reserve", func() {
+			Expect(alice.do("peek-ready"), ToEqual, "UNAUTHORIZED")
+			Expect(alice.do("peek 1"), ToEqual, "UNAUTHORIZED")
+			alice.do("use mail.out")
+			Expect(alice.do("peek 0"), ToEqual, "FOUND 0 5")
+			Expect(readResponseWithoutBody(alice.reader), ToEqual, "hello")
+		})
+
+		It("limits reserve to the tubes granted", func() {
+			alice.do("watch mail.out")
+			Expect(alice.do("reserve-with-timeout 0"), ToEqual, "UNAUTHORIZED")
+			alice.do("ignore default")
+			job := alice.reserve("reserve-with-timeout 1")
+			Expect(job.id, ToEqual, jobId(0))
+
+			alice.do("watch logs")
+			Expect(alice.do("reserve"), ToEqual, "UNAUTHORIZED")
+			alice.do("ignore logs")
+		})
+
+		It("lets users delete the jobs they reserved", func() {
+			Expect(alice.do("delete 0"), ToEqual, "DELETED")
+		})
+
+		It("limits deleting other jobs, kick and pause to admins", func() {
+			Expect(alice.do("delete 1"), ToEqual, "UNAUTHORIZED")
+			Expect(alice.do("kick 1"), ToEqual, "UNAUTHORIZED")
+			Expect(alice.do("pause-tube mail.out 1"), ToEqual, "UNAUTHORIZED")
+			Expect(alice.do("drain"), ToEqual, "UNAUTHORIZED")
+
+			Expect(root.do("delete 1"), ToEqual, "DELETED")
+			Expect(root.do("kick 1"), ToEqual, "KICKED 0")
+			Expect(root.do("pause-tube mail.out 0"), ToEqual, "PAUSED")
+		})
+
+		It("counts auth commands in stats", func() {
+			stats := root.stats("stats")
+			Expect(stats["cmd-auth"], ToEqual, 5)
+		})
+	})
+}
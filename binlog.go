@@ -0,0 +1,590 @@
+package gostalk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	binlogPrefix       = "binlog."
+	binlogHeaderSize   = 8
+	binlogDeletedState = "deleted"
+)
+
+// a binlogRecord is the state of a job at the time it was written.
+// Only the first record of a job carries its tube and body, later ones just
+// update the other fields. Replaying all records in order restores every job that
+// hasn't been deleted.
+type binlogRecord struct {
+	Id          jobId         `json:"id"`
+	Tube        string        `json:"tube,omitempty"`
+	State       string        `json:"state"`
+	Priority    uint32        `json:"pri"`
+	TimeToRun   time.Duration `json:"ttr"`
+	CreatedAt   time.Time     `json:"created"`
+	DelayEndsAt time.Time     `json:"delay-ends"`
+	Reserves    int           `json:"reserves"`
+	Releases    int           `json:"releases"`
+	Timeouts    int           `json:"timeouts"`
+	Buries      int           `json:"buries"`
+	Kicks       int           `json:"kicks"`
+	Body        []byte        `json:"body,omitempty"`
+
+	file int64 // index of the binlog file the body was read from
+}
+
+// The binlog is an append-only log of job mutations, split into files named
+// binlog.1, binlog.2, ... inside dir. A new file is started once the current
+// one grows beyond maxSize.
+//
+// It keeps the latest record of every live job in memory, grouped by the file
+// holding its body. Each write moves a few of the jobs in the oldest file over
+// to the current one, and the oldest file is removed once no job is left in it.
+//
+// All methods are safe to call on a nil *binlog, in which case nothing is
+// written.
+type binlog struct {
+	dir           string
+	maxSize       int64
+	fsyncInterval time.Duration
+	stats         *serverStats
+
+	lock     sync.Mutex
+	file     *os.File
+	index    int64
+	oldest   int64
+	size     int64
+	lastSync time.Time
+	dirty    bool // written since lastSync
+	closed   chan bool
+	jobs     map[jobId]*binlogRecord
+	files    map[int64]map[jobId]*binlogRecord
+}
+
+// opens the binlog in dir, creating it if necessary, and returns the records
+// of all jobs that are still alive.
+//
+// A record that was only partially written when the server went down ends
+// the replay of its file, the rest of that file is discarded.
+//
+// fsyncInterval is the most time that may pass between a write and syncing it
+// to disk. Zero syncs after every write, a negative interval never syncs and
+// leaves it to the operating system. Writes are synced on close unless the
+// interval is negative.
+func openBinlog(dir string, maxSize int64, fsyncInterval time.Duration, stats *serverStats) (*binlog, []*binlogRecord, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	indices, err := binlogIndices(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	binlog := &binlog{
+		dir:           dir,
+		maxSize:       maxSize,
+		fsyncInterval: fsyncInterval,
+		stats:         stats,
+		lastSync:      time.Now(),
+		closed:        make(chan bool),
+		jobs:          map[jobId]*binlogRecord{},
+		files:         map[int64]map[jobId]*binlogRecord{},
+	}
+	order := []jobId{}
+
+	for _, index := range indices {
+		good, err := binlog.replay(index, &order)
+		if err != nil {
+			return nil, nil, err
+		}
+		binlog.index, binlog.size = index, good
+	}
+
+	if binlog.index == 0 {
+		binlog.index = 1
+	}
+	binlog.oldest = binlog.index
+	if len(indices) > 0 {
+		binlog.oldest = indices[0]
+	}
+
+	err = binlog.openFile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// drop whatever is left of a torn record at the end.
+	err = binlog.file.Truncate(binlog.size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if fsyncInterval > 0 {
+		go binlog.runSync()
+	}
+
+	atomic.StoreInt64(&stats.BinlogMaxSize, maxSize)
+	atomic.StoreInt64(&stats.BinlogCurrentIndex, binlog.index)
+	atomic.StoreInt64(&stats.BinlogOldestIndex, binlog.oldest)
+
+	alive := make([]*binlogRecord, 0, len(binlog.jobs))
+	for _, id := range order {
+		if record, found := binlog.jobs[id]; found {
+			binlog.track(record)
+			alive = append(alive, record)
+		}
+	}
+
+	return binlog, alive, nil
+}
+
+// returns the indices of all binlog files in dir, oldest first.
+func binlogIndices(dir string) ([]int64, error) {
+	names, err := filepath.Glob(filepath.Join(dir, binlogPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+
+	indices := make([]int64, 0, len(names))
+	for _, name := range names {
+		index, err := strconv.ParseInt(strings.TrimPrefix(filepath.Base(name), binlogPrefix), 10, 64)
+		if err == nil && index > 0 {
+			indices = append(indices, index)
+		}
+	}
+
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+	return indices, nil
+}
+
+func (binlog *binlog) path(index int64) string {
+	return filepath.Join(binlog.dir, fmt.Sprintf("%s%d", binlogPrefix, index))
+}
+
+// reads all complete records from the file with the given index and returns
+// the offset just past the last one.
+func (binlog *binlog) replay(index int64, order *[]jobId) (good int64, err error) {
+	file, err := os.Open(binlog.path(index))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, binlogHeaderSize)
+
+	for {
+		_, err = io.ReadFull(reader, header)
+		if err != nil {
+			break
+		}
+
+		size := int64(binary.LittleEndian.Uint32(header[0:4]))
+		if good+binlogHeaderSize+size > info.Size() {
+			break
+		}
+
+		payload := make([]byte, size)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			break
+		}
+
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+			pf("binlog %d: checksum mismatch at offset %d", index, good)
+			break
+		}
+
+		record := &binlogRecord{}
+		err = json.Unmarshal(payload, record)
+		if err != nil {
+			pf("binlog %d: %v at offset %d", index, err, good)
+			break
+		}
+
+		good += int64(binlogHeaderSize + len(payload))
+		binlog.apply(index, record, order)
+	}
+
+	return good, nil
+}
+
+func (binlog *binlog) apply(index int64, record *binlogRecord, order *[]jobId) {
+	if record.State == binlogDeletedState {
+		delete(binlog.jobs, record.Id)
+		return
+	}
+
+	previous, found := binlog.jobs[record.Id]
+	if record.Tube != "" {
+		record.file = index
+		if !found {
+			*order = append(*order, record.Id)
+		}
+	} else if found {
+		record.inherit(previous)
+	} else {
+		// an update for a job whose body is gone, nothing to restore.
+		return
+	}
+
+	binlog.jobs[record.Id] = record
+}
+
+// takes over the parts of a job that are only written once.
+func (record *binlogRecord) inherit(previous *binlogRecord) {
+	record.Tube = previous.Tube
+	record.Body = previous.Body
+	record.file = previous.file
+}
+
+func (binlog *binlog) track(record *binlogRecord) {
+	binlog.jobs[record.Id] = record
+
+	live, found := binlog.files[record.file]
+	if !found {
+		live = map[jobId]*binlogRecord{}
+		binlog.files[record.file] = live
+	}
+	live[record.Id] = record
+}
+
+func (binlog *binlog) untrack(record *binlogRecord) {
+	delete(binlog.jobs, record.Id)
+	delete(binlog.files[record.file], record.Id)
+}
+
+func (binlog *binlog) openFile() (err error) {
+	binlog.file, err = os.OpenFile(binlog.path(binlog.index), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+
+	_, err = binlog.file.Seek(binlog.size, io.SeekStart)
+	return
+}
+
+// starts a new binlog file once the current one is full.
+func (binlog *binlog) rotate() (err error) {
+	if binlog.size < binlog.maxSize {
+		return
+	}
+
+	if binlog.fsyncInterval >= 0 {
+		err = binlog.syncFile()
+		if err != nil {
+			return
+		}
+	}
+
+	err = binlog.file.Close()
+	if err != nil {
+		return
+	}
+
+	binlog.index += 1
+	binlog.size = 0
+	atomic.StoreInt64(&binlog.stats.BinlogCurrentIndex, binlog.index)
+	return binlog.openFile()
+}
+
+// syncs after a write unless the last sync is more recent than
+// fsyncInterval, in which case runSync takes care of it.
+func (binlog *binlog) sync() (err error) {
+	switch {
+	case binlog.fsyncInterval < 0:
+		return
+	case binlog.fsyncInterval > 0 && time.Since(binlog.lastSync) < binlog.fsyncInterval:
+		binlog.dirty = true
+		return
+	}
+
+	return binlog.syncFile()
+}
+
+func (binlog *binlog) syncFile() (err error) {
+	err = binlog.file.Sync()
+	binlog.lastSync = time.Now()
+	binlog.dirty = false
+	return
+}
+
+// syncs writes left over by sync every fsyncInterval, so none waits longer
+// than that even when no write follows. Runs until the binlog is closed.
+func (binlog *binlog) runSync() {
+	ticker := time.NewTicker(binlog.fsyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-binlog.closed:
+			return
+		}
+
+		binlog.lock.Lock()
+		if binlog.dirty {
+			err := binlog.syncFile()
+			if err != nil {
+				pf("binlog.runSync : %v", err)
+			}
+		}
+		binlog.lock.Unlock()
+	}
+}
+
+// prefixes payload with its size and checksum, as records are written.
+func binlogFrame(payload []byte) []byte {
+	frame := make([]byte, binlogHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[binlogHeaderSize:], payload)
+	return frame
+}
+
+// appends a record to the current file. Must be called with the lock held.
+func (binlog *binlog) write(record *binlogRecord) (err error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	err = binlog.rotate()
+	if err != nil {
+		return
+	}
+
+	n, err := binlog.file.Write(binlogFrame(payload))
+	binlog.size += int64(n)
+	if err != nil {
+		return
+	}
+
+	atomic.AddInt64(&binlog.stats.BinlogRecordsWritten, 1)
+	return binlog.sync()
+}
+
+// the number of jobs moved out of the oldest file on every write.
+const binlogMigrationsPerWrite = 2
+
+// moves a few jobs out of the oldest file and removes every old file that
+// holds no jobs anymore. Must be called with the lock held.
+func (binlog *binlog) compact() {
+	migrated := 0
+
+	for binlog.oldest < binlog.index {
+		live := binlog.files[binlog.oldest]
+
+		if len(live) == 0 {
+			err := os.Remove(binlog.path(binlog.oldest))
+			if err != nil && !os.IsNotExist(err) {
+				pf("binlog.compact : %v", err)
+				return
+			}
+
+			delete(binlog.files, binlog.oldest)
+			binlog.oldest += 1
+			atomic.StoreInt64(&binlog.stats.BinlogOldestIndex, binlog.oldest)
+			continue
+		}
+
+		if migrated >= binlogMigrationsPerWrite {
+			return
+		}
+
+		for _, record := range live {
+			err := binlog.write(record)
+			if err != nil {
+				pf("binlog.compact : %v", err)
+				return
+			}
+
+			binlog.untrack(record)
+			record.file = binlog.index
+			binlog.track(record)
+			atomic.AddInt64(&binlog.stats.BinlogRecordsMigrated, 1)
+			migrated += 1
+			break
+		}
+	}
+}
+
+func (binlog *binlog) close() error {
+	if binlog == nil {
+		return nil
+	}
+
+	close(binlog.closed)
+
+	binlog.lock.Lock()
+	defer binlog.lock.Unlock()
+
+	var err error
+	if binlog.fsyncInterval >= 0 {
+		err = binlog.syncFile()
+	}
+	if closeErr := binlog.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// the current state of a job, without its tube and body.
+func recordOf(job *job) *binlogRecord {
+	return &binlogRecord{
+		Id:          job.id,
+		State:       job.state,
+		Priority:    job.priority,
+		TimeToRun:   job.timeToReserve,
+		CreatedAt:   job.createdAt,
+		DelayEndsAt: job.delayEndsAt,
+		Reserves:    job.reserveCount,
+		Releases:    job.releaseCount,
+		Timeouts:    job.timeoutCount,
+		Buries:      job.buryCount,
+		Kicks:       job.kickCount,
+	}
+}
+
+// returns the index of the file holding the body of a job, 0 if it's not in
+// the binlog.
+func (binlog *binlog) fileOf(id jobId) int64 {
+	if binlog == nil {
+		return 0
+	}
+
+	binlog.lock.Lock()
+	defer binlog.lock.Unlock()
+
+	if record, found := binlog.jobs[id]; found {
+		return record.file
+	}
+	return 0
+}
+
+// writes a newly created job, including its body.
+func (binlog *binlog) putJob(job *job, tube *tube) (err error) {
+	if binlog == nil {
+		return
+	}
+
+	record := recordOf(job)
+	record.Tube = tube.name
+	record.Body = job.body
+
+	binlog.lock.Lock()
+	defer binlog.lock.Unlock()
+
+	err = binlog.write(record)
+	if err != nil {
+		pf("binlog.putJob(%d) : %v", job.id, err)
+		return
+	}
+
+	record.file = binlog.index
+	binlog.track(record)
+	binlog.compact()
+	return
+}
+
+// writes the current state of a job that is already in the binlog.
+func (binlog *binlog) updateJob(job *job) (err error) {
+	if binlog == nil {
+		return
+	}
+
+	record := recordOf(job)
+
+	binlog.lock.Lock()
+	defer binlog.lock.Unlock()
+
+	previous, found := binlog.jobs[job.id]
+	if !found {
+		return
+	}
+
+	err = binlog.write(record)
+	if err != nil {
+		pf("binlog.updateJob(%d) : %v", job.id, err)
+		return
+	}
+
+	record.inherit(previous)
+	binlog.untrack(previous)
+	binlog.track(record)
+	binlog.compact()
+	return
+}
+
+func (binlog *binlog) deleteJob(job *job) {
+	if binlog == nil {
+		return
+	}
+
+	binlog.lock.Lock()
+	defer binlog.lock.Unlock()
+
+	previous, found := binlog.jobs[job.id]
+	if !found {
+		return
+	}
+
+	err := binlog.write(&binlogRecord{Id: job.id, State: binlogDeletedState})
+	if err != nil {
+		pf("binlog.deleteJob(%d) : %v", job.id, err)
+		return
+	}
+
+	binlog.untrack(previous)
+	binlog.compact()
+}
+
+// sets the fields of a job that change over its life to those of the record.
+func (record *binlogRecord) copyTo(job *job) {
+	job.priority = record.Priority
+	job.timeToReserve = record.TimeToRun
+	job.delayEndsAt = record.DelayEndsAt
+	job.reserveCount = record.Reserves
+	job.releaseCount = record.Releases
+	job.timeoutCount = record.Timeouts
+	job.buryCount = record.Buries
+	job.kickCount = record.Kicks
+}
+
+// turns a replayed record back into a job.
+func (record *binlogRecord) job() *job {
+	j := &job{
+		id:        record.Id,
+		createdAt: record.CreatedAt,
+		body:      record.Body,
+	}
+	record.copyTo(j)
+
+	switch record.State {
+	case jobBuriedState:
+		j.state = jobBuriedState
+	case jobDelayedState, jobWillHaveDelayedState:
+		j.state = jobWillHaveDelayedState
+	}
+
+	return j
+}
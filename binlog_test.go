@@ -0,0 +1,360 @@
+package gostalk
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/manveru/gobdd"
+)
+
+// copies the binlog files in dir to a new directory, as if the server had
+// been killed right now.
+func snapshotBinlog(dir string) string {
+	snapshot, err := ioutil.TempDir("", "gostalk-binlog-snapshot")
+	Expect(err, ToBeNil)
+
+	names, err := filepath.Glob(filepath.Join(dir, binlogPrefix+"*"))
+	Expect(err, ToBeNil)
+
+	for _, name := range names {
+		content, err := ioutil.ReadFile(name)
+		Expect(err, ToBeNil)
+		err = ioutil.WriteFile(filepath.Join(snapshot, filepath.Base(name)), content, 0600)
+		Expect(err, ToBeNil)
+	}
+
+	return snapshot
+}
+
+func restartFrom(dir string) *Server {
+	config := DefaultConfig()
+	config.BinlogDir = dir
+
+	server, err := New(config)
+	Expect(err, ToBeNil)
+	time.Sleep(10 * time.Millisecond) // let the tubes take their jobs
+	return server
+}
+
+func init() {
+	defer PrintSpecReport()
+
+	Describe("binlog", func() {
+		dir, err := ioutil.TempDir("", "gostalk-binlog")
+		Expect(err, ToBeNil)
+		defer os.RemoveAll(dir)
+
+		config := DefaultConfig()
+		config.BinlogDir = dir
+		_, addr := startServer(config)
+
+		conn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+		Expect(err, ToBeNil)
+		reader := bufio.NewReader(conn)
+
+		for _, command := range []string{
+			"use binlog-tube", "watch binlog-tube", "ignore default",
+			"put 1 0 60 1\r\na", "put 2 0 60 1\r\nb", "put 3 100 60 1\r\nc",
+			"reserve", "bury 0", "delete 1",
+		} {
+			sendCommand(conn, command)
+			if command == "reserve" {
+				readReserveResponse(reader)
+			} else {
+				readResponseWithoutBody(reader)
+			}
+		}
+
+		It("reports its files in stats", func() {
+			var stats map[string]interface{}
+			sendCommand(conn, "stats")
+			readResponseWithBody(reader, &stats)
+			Expect(stats["binlog-current-index"], ToEqual, 1)
+			Expect(stats["binlog-oldest-index"], ToEqual, 1)
+			Expect(stats["binlog-max-size"], ToEqual, 10<<20)
+			Expect(stats["binlog-records-written"], ToEqual, 5)
+
+			sendCommand(conn, "stats-job 0")
+			readResponseWithBody(reader, &stats)
+			Expect(stats["file"], ToEqual, 1)
+		})
+
+		It("restores jobs after a restart", func() {
+			snapshot := snapshotBinlog(dir)
+			defer os.RemoveAll(snapshot)
+			server := restartFrom(snapshot)
+			defer server.Shutdown(context.Background())
+
+			buried, found := server.findJob(0)
+			Expect(found, ToEqual, true)
+			buried = buried.snapshot()
+			Expect(buried.state, ToEqual, jobBuriedState)
+			Expect(buried.tube.name, ToEqual, "binlog-tube")
+			Expect(string(buried.body), ToEqual, "a")
+			Expect(buried.reserveCount, ToEqual, 1)
+			Expect(buried.buryCount, ToEqual, 1)
+			Expect(server.binlog.fileOf(0), ToEqual, int64(1))
+
+			_, found = server.findJob(1)
+			Expect(found, ToEqual, false)
+
+			delayed, found := server.findJob(2)
+			Expect(found, ToEqual, true)
+			delayed = delayed.snapshot()
+			Expect(delayed.state, ToEqual, jobDelayedState)
+			Expect(string(delayed.body), ToEqual, "c")
+
+			Expect(<-server.getJobId, ToEqual, jobId(3))
+		})
+
+		It("recovers when killed partway through writing a record", func() {
+			snapshot := snapshotBinlog(dir)
+			defer os.RemoveAll(snapshot)
+			path := filepath.Join(snapshot, binlogPrefix+"1")
+			content, err := ioutil.ReadFile(path)
+			Expect(err, ToBeNil)
+
+			for cut := 0; cut <= len(content); cut += 1 {
+				err = ioutil.WriteFile(path, content[:cut], 0600)
+				Expect(err, ToBeNil)
+
+				binlog, records, err := openBinlog(snapshot, 10<<20, 0, &serverStats{})
+				Expect(err, ToBeNil)
+				Expect(binlog.size <= int64(cut), ToEqual, true)
+				for _, record := range records {
+					Expect(record.Id <= 2, ToEqual, true)
+					Expect(string(record.Body), ToEqual, string("abc"[record.Id]))
+				}
+				if cut == len(content) {
+					Expect(len(records), ToEqual, 2)
+				}
+				binlog.close()
+			}
+		})
+
+		It("keeps writing after the torn record", func() {
+			snapshot := snapshotBinlog(dir)
+			defer os.RemoveAll(snapshot)
+			path := filepath.Join(snapshot, binlogPrefix+"1")
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+			Expect(err, ToBeNil)
+			_, err = file.Write([]byte{42, 0, 0, 0, 1, 2})
+			Expect(err, ToBeNil)
+			file.Close()
+
+			binlog, records, err := openBinlog(snapshot, 10<<20, 0, &serverStats{})
+			Expect(err, ToBeNil)
+			Expect(len(records), ToEqual, 2)
+			err = binlog.putJob(newJob(3, 0, 0, 1, []byte("d")), &tube{name: "binlog-tube"})
+			Expect(err, ToBeNil)
+			binlog.close()
+
+			binlog, records, err = openBinlog(snapshot, 10<<20, 0, &serverStats{})
+			Expect(err, ToBeNil)
+			Expect(len(records), ToEqual, 3)
+			Expect(string(records[2].Body), ToEqual, "d")
+			binlog.close()
+		})
+
+		It("recovers when killed while producers are writing", func() {
+			producer, err := net.DialTimeout("tcp", addr, 1*time.Second)
+			Expect(err, ToBeNil)
+			defer producer.Close()
+			producerReader := bufio.NewReader(producer)
+
+			sendCommand(producer, "use crash-tube")
+			readResponseWithoutBody(producerReader)
+
+			// jobs the producer was told were inserted.
+			var acknowledged int64
+			done := make(chan bool)
+			go func() {
+				for n := 0; n < 200; n += 1 {
+					body := fmt.Sprintf("job-%03d", n)
+					sendCommand(producer, fmt.Sprintf("put 0 0 60 %d\r\n%s", len(body), body))
+					if strings.HasPrefix(readResponseWithoutBody(producerReader), "INSERTED") {
+						atomic.AddInt64(&acknowledged, 1)
+					}
+				}
+				done <- true
+			}()
+
+			for atomic.LoadInt64(&acknowledged) < 50 {
+				time.Sleep(1 * time.Millisecond)
+			}
+			before := int(atomic.LoadInt64(&acknowledged))
+			snapshot := snapshotBinlog(dir)
+			defer os.RemoveAll(snapshot)
+			<-done
+
+			// the jobs recovered from snapshot, which have to be the first
+			// ones put and complete.
+			recovered := func() int {
+				binlog, records, err := openBinlog(snapshot, 10<<20, 0, &serverStats{})
+				Expect(err, ToBeNil)
+				binlog.close()
+
+				n := 0
+				for _, record := range records {
+					if record.Tube == "crash-tube" {
+						Expect(string(record.Body), ToEqual, fmt.Sprintf("job-%03d", n))
+						n += 1
+					}
+				}
+				return n
+			}
+
+			n := recovered()
+			Expect(n >= before, ToEqual, true)
+			Expect(n <= 200, ToEqual, true)
+
+			// a kill in the middle of writing the last put leaves part of it.
+			indices, err := binlogIndices(snapshot)
+			Expect(err, ToBeNil)
+			last := filepath.Join(snapshot, fmt.Sprintf("%s%d", binlogPrefix, indices[len(indices)-1]))
+			info, err := os.Stat(last)
+			Expect(err, ToBeNil)
+			Expect(os.Truncate(last, info.Size()-3), ToBeNil)
+			Expect(recovered(), ToEqual, n-1)
+		})
+	})
+
+	Describe("binlog failing to write", func() {
+		dir, err := ioutil.TempDir("", "gostalk-binlog-failing")
+		Expect(err, ToBeNil)
+		defer os.RemoveAll(dir)
+
+		config := DefaultConfig()
+		config.BinlogDir = dir
+		server, addr := startServer(config)
+		defer server.Shutdown(context.Background())
+		worker := dialStats(addr)
+		defer worker.conn.Close()
+
+		It("buries released jobs it can't queue durably", func() {
+			worker.do("put 0 0 60 4\r\nlost")
+			id := worker.reserve("reserve").id
+
+			server.binlog.lock.Lock()
+			server.binlog.file.Close()
+			server.binlog.lock.Unlock()
+
+			Expect(worker.do(fmt.Sprintf("release %d 0 0", id)), ToEqual, "BURIED")
+			stats := worker.stats(fmt.Sprintf("stats-job %d", id))
+			Expect(stats["state"], ToEqual, jobBuriedState)
+			Expect(stats["buries"], ToEqual, 1)
+			Expect(stats["releases"], ToEqual, 1)
+		})
+	})
+
+	Describe("binlog syncing", func() {
+		dir, err := ioutil.TempDir("", "gostalk-binlog-sync")
+		Expect(err, ToBeNil)
+		defer os.RemoveAll(dir)
+
+		tube := &tube{name: "sync-tube"}
+		dirty := func(binlog *binlog) bool {
+			binlog.lock.Lock()
+			defer binlog.lock.Unlock()
+			return binlog.dirty
+		}
+
+		It("syncs every write without an interval", func() {
+			binlog, _, err := openBinlog(dir, 10<<20, 0, &serverStats{})
+			Expect(err, ToBeNil)
+			defer binlog.close()
+
+			Expect(binlog.putJob(newJob(0, 0, 0, 1, []byte("now")), tube), ToBeNil)
+			Expect(dirty(binlog), ToEqual, false)
+		})
+
+		It("syncs the last write once the interval passed", func() {
+			binlog, _, err := openBinlog(dir, 10<<20, 50*time.Millisecond, &serverStats{})
+			Expect(err, ToBeNil)
+			defer binlog.close()
+
+			Expect(binlog.putJob(newJob(1, 0, 0, 1, []byte("soon")), tube), ToBeNil)
+			Expect(dirty(binlog), ToEqual, true)
+			time.Sleep(120 * time.Millisecond)
+			Expect(dirty(binlog), ToEqual, false)
+		})
+
+		It("syncs on close", func() {
+			binlog, _, err := openBinlog(dir, 10<<20, time.Hour, &serverStats{})
+			Expect(err, ToBeNil)
+
+			Expect(binlog.putJob(newJob(2, 0, 0, 1, []byte("later")), tube), ToBeNil)
+			Expect(dirty(binlog), ToEqual, true)
+			Expect(binlog.close(), ToBeNil)
+			Expect(binlog.dirty, ToEqual, false)
+		})
+	})
+
+	Describe("binlog compaction", func() {
+		dir, err := ioutil.TempDir("", "gostalk-binlog-compaction")
+		Expect(err, ToBeNil)
+		defer os.RemoveAll(dir)
+
+		stats := &serverStats{}
+		binlog, _, err := openBinlog(dir, 1024, -1, stats)
+		Expect(err, ToBeNil)
+
+		tube := &tube{name: "compaction-tube"}
+		jobs := []*job{}
+		for n := 0; n < 100; n += 1 {
+			job := newJob(jobId(n), 0, 0, 1, []byte(fmt.Sprintf("job-%03d", n)))
+			Expect(binlog.putJob(job, tube), ToBeNil)
+			jobs = append(jobs, job)
+		}
+
+		It("starts a new file once the current one is full", func() {
+			Expect(stats.BinlogCurrentIndex > 1, ToEqual, true)
+			Expect(stats.BinlogMaxSize, ToEqual, int64(1024))
+		})
+
+		It("removes old files once their jobs are deleted or migrated", func() {
+			for _, job := range jobs {
+				if job.id%10 != 0 {
+					binlog.deleteJob(job)
+				}
+			}
+
+			// keep the survivors busy so they get migrated.
+			for n := 0; n < 100; n += 1 {
+				job := jobs[(n%10)*10]
+				job.releaseCount += 1
+				binlog.updateJob(job)
+			}
+
+			indices, err := binlogIndices(dir)
+			Expect(err, ToBeNil)
+			Expect(indices[0], ToEqual, stats.BinlogOldestIndex)
+			Expect(stats.BinlogOldestIndex > 1, ToEqual, true)
+			Expect(stats.BinlogRecordsMigrated > 0, ToEqual, true)
+			Expect(len(indices) < int(stats.BinlogCurrentIndex), ToEqual, true)
+		})
+
+		It("restores only the live jobs from the remaining files", func() {
+			binlog.close()
+
+			binlog, records, err := openBinlog(dir, 1024, 0, &serverStats{})
+			Expect(err, ToBeNil)
+			defer binlog.close()
+
+			Expect(len(records), ToEqual, 10)
+			for _, record := range records {
+				Expect(int(record.Id)%10, ToEqual, 0)
+				Expect(string(record.Body), ToEqual, fmt.Sprintf("job-%03d", record.Id))
+				Expect(record.Releases, ToEqual, 10)
+			}
+		})
+	})
+}
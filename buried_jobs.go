@@ -15,6 +15,7 @@ func (jobs *buriedJobs) putJob(job *job) {
 func (jobs *buriedJobs) getJob() (job *job) {
 	job = (*jobs)[0]
 	*jobs = (*jobs)[1:len(*jobs)]
+	job.jobHolder = nil
 	return
 }
 
@@ -30,6 +31,7 @@ func (jobs *buriedJobs) deleteJob(job *job) {
 	for i, j := range *jobs {
 		if j.id == job.id {
 			*jobs = append((*jobs)[0:i], (*jobs)[i+1:]...)
+			job.jobHolder = nil
 			return
 		}
 	}
@@ -39,11 +41,11 @@ func (jobs *buriedJobs) touchJob(job *job) {
 	// nothing to do
 }
 
-func (jobs *buriedJobs) kickJobs(bound int) (actual int) {
+func (jobs *buriedJobs) kickJobs(bound int) (kicked []*job) {
 	for bound > 0 && len(*jobs) > 0 {
 		job := jobs.getJob()
-		job.tube.put(job)
-		actual += 1
+		job.tube.ready.putJob(job)
+		kicked = append(kicked, job)
 		bound -= 1
 	}
 
@@ -51,5 +53,10 @@ func (jobs *buriedJobs) kickJobs(bound int) (actual int) {
 }
 
 func (jobs *buriedJobs) peekJob(request *jobPeekRequest) {
+	if len(*jobs) == 0 {
+		request.success <- nil
+		return
+	}
+
 	request.success <- (*jobs)[0]
 }
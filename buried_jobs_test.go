@@ -0,0 +1,37 @@
+package gostalk
+
+import (
+	. "github.com/manveru/gobdd"
+)
+
+func init() {
+	defer PrintSpecReport()
+
+	Describe("buriedJobs", func() {
+		jobs := newBuriedJobs()
+
+		It("stores jobs in the order they were buried", func() {
+			a := newJob(1, 0, 0, 0, []byte("a"))
+			b := newJob(2, 0, 0, 0, []byte("b"))
+			jobs.putJob(a)
+			jobs.putJob(b)
+			Expect(jobs.Len(), ToEqual, 2)
+			Expect(jobs.getJob(), ToDeepEqual, a)
+			Expect(jobs.getJob(), ToDeepEqual, b)
+		})
+
+		It("lets go of the jobs it removes", func() {
+			a := newJob(1, 0, 0, 0, []byte("a"))
+			b := newJob(2, 0, 0, 0, []byte("b"))
+			c := newJob(3, 0, 0, 0, []byte("c"))
+			jobs.putJob(a)
+			jobs.putJob(b)
+			jobs.putJob(c)
+			jobs.deleteJob(b)
+			Expect(jobs.Len(), ToEqual, 2)
+			Expect(b.jobHolder == nil, ToEqual, true)
+			Expect(jobs.getJob().jobHolder == nil, ToEqual, true)
+			Expect(jobs.getJob(), ToDeepEqual, c)
+		})
+	})
+}
@@ -2,30 +2,58 @@ package gostalk
 
 import (
 	"bufio"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// a reserve by a client holding a job that runs out within this margin is
+// answered with DEADLINE_SOON.
+const safetyMargin = 1 * time.Second
+
+// how long answers held back for pipelining may wait for a reserve before
+// they're written anyway.
+const flushDelay = 1 * time.Millisecond
+
 type conn interface {
 	Close() error
 	Read([]byte) (int, error)
 	Write([]byte) (int, error)
 }
 
+// what a client needs to know about a job it reserved, copied by the tube
+// goroutine so the client doesn't have to read the job itself.
+type reservation struct {
+	job      *job
+	priority uint32
+	endsAt   time.Time
+}
+
 type client struct {
-	server       *server
+	server       *Server
 	conn         conn
-	reader       reader
+	reader       *bufio.Reader
+	writer       *bufio.Writer
 	usedTube     *tube
 	watchedTubes map[string]*tube
 	isProducer   bool // has issued at least one "put" command
 	isWorker     bool // has issued at least one "reserve" or "reserve-with-timeout" command
+
+	reservedJobs map[jobId]reservation
+	reservedLock sync.Mutex
+
+	user *account // set by a successful "auth" command
 }
 
-func newClient(server *server, conn conn) *client {
+func newClient(server *Server, conn conn) *client {
 	c := &client{
 		server:       server,
 		conn:         conn,
 		reader:       bufio.NewReader(conn),
+		writer:       bufio.NewWriter(conn),
 		watchedTubes: map[string]*tube{},
+		reservedJobs: map[jobId]reservation{},
 	}
 
 	c.useTube("default")
@@ -33,21 +61,210 @@ func newClient(server *server, conn conn) *client {
 	return c
 }
 
+// answers whether the client may issue commands, which it may once
+// authenticated or if the server doesn't require it.
+func (client *client) authenticated() bool {
+	return client.server.users == nil || client.user != nil
+}
+
+// answers whether the client was granted right on the tube.
+func (client *client) may(right, tube string) bool {
+	return client.server.users == nil || client.user.may(right, tube)
+}
+
+// answers whether the client may reserve jobs from every tube it watches.
+func (client *client) mayReserve() bool {
+	for name := range client.watchedTubes {
+		if !client.may(RIGHT_RESERVE, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// answers whether the client may administrate the whole server.
+func (client *client) mayAdministrate() bool {
+	return client.server.users == nil || client.user.mayAdministrate()
+}
+
 func (client *client) useTube(name string) {
-	client.usedTube = client.server.findOrCreateTube(name)
+	used := client.usedTube
+	client.usedTube = client.server.useTube(name)
+
+	if used != nil {
+		client.server.unuseTube(used)
+	}
 }
 
 func (client *client) watchTube(name string) {
-	client.watchedTubes[name] = client.server.findOrCreateTube(name)
+	if _, found := client.watchedTubes[name]; !found {
+		client.watchedTubes[name] = client.server.watchTube(name)
+	}
 }
 
 func (client *client) ignoreTube(name string) (ignored bool, totalTubes int) {
 	totalTubes = len(client.watchedTubes)
 
 	if totalTubes > 1 {
-		delete(client.watchedTubes, name)
-		return true, totalTubes - 1
+		if tube, found := client.watchedTubes[name]; found {
+			delete(client.watchedTubes, name)
+			client.server.unwatchTube(tube)
+			totalTubes -= 1
+		}
+		return true, totalTubes
 	}
 
 	return false, totalTubes
 }
+
+// stops using and watching tubes, used once the connection is gone.
+func (client *client) leaveTubes() {
+	client.server.unuseTube(client.usedTube)
+
+	for name, tube := range client.watchedTubes {
+		delete(client.watchedTubes, name)
+		client.server.unwatchTube(tube)
+	}
+}
+
+// counts the client among the producers from its first put on.
+func (client *client) becomeProducer() {
+	if !client.isProducer {
+		client.isProducer = true
+		atomic.AddInt64(&client.server.stats.CurrentProducers, 1)
+	}
+}
+
+// counts the client among the workers from its first reserve on.
+func (client *client) becomeWorker() {
+	if !client.isWorker {
+		client.isWorker = true
+		atomic.AddInt64(&client.server.stats.CurrentWorkers, 1)
+	}
+}
+
+// counts the client as waiting for a job in the server and every watched
+// tube, or as done waiting with a delta of -1.
+func (client *client) addWaiting(delta int64) {
+	atomic.AddInt64(&client.server.stats.CurrentWaiting, delta)
+	for _, tube := range client.watchedTubes {
+		atomic.AddInt64(&tube.waiting, delta)
+	}
+}
+
+// records a job reserved by this client, or the new deadline of a touched
+// one.
+func (client *client) addReservedJob(job *job) {
+	client.reservedLock.Lock()
+	defer client.reservedLock.Unlock()
+	client.reservedJobs[job.id] = reservation{job, job.priority, job.reserveEndsAt}
+}
+
+// returns the priority of a job reserved by this client, and whether it still
+// holds it.
+func (client *client) reservedPriority(job *job) (uint32, bool) {
+	client.reservedLock.Lock()
+	defer client.reservedLock.Unlock()
+	reservation, found := client.reservedJobs[job.id]
+	return reservation.priority, found
+}
+
+func (client *client) removeReservedJob(job *job) {
+	client.reservedLock.Lock()
+	defer client.reservedLock.Unlock()
+	delete(client.reservedJobs, job.id)
+}
+
+// puts every job reserved by this client back into the ready queue of its
+// tube, used once the connection is gone.
+func (client *client) releaseAll() {
+	client.reservedLock.Lock()
+	reservations := make([]reservation, 0, len(client.reservedJobs))
+	for _, reservation := range client.reservedJobs {
+		reservations = append(reservations, reservation)
+	}
+	client.reservedLock.Unlock()
+
+	for _, reservation := range reservations {
+		reservation.job.release(client, reservation.priority, 0)
+	}
+}
+
+// returns a channel that receives once the first job reserved by this client
+// enters the safety margin, or nil if the client holds no jobs. soon reports
+// whether one is inside it already, the channel is nil then too.
+func (client *client) deadlineSoon() (deadline <-chan time.Time, soon bool) {
+	client.reservedLock.Lock()
+	defer client.reservedLock.Unlock()
+
+	if len(client.reservedJobs) == 0 {
+		return nil, false
+	}
+
+	var first time.Time
+	for _, reservation := range client.reservedJobs {
+		if first.IsZero() || reservation.endsAt.Before(first) {
+			first = reservation.endsAt
+		}
+	}
+
+	left := first.Add(-safetyMargin).Sub(time.Now())
+	if left <= 0 {
+		return nil, true
+	}
+	return time.After(left), false
+}
+
+// answers whether one of the watched tubes has a job to hand out right away.
+func (client *client) hasReadyJob() bool {
+	for _, tube := range client.watchedTubes {
+		stats := tube.statistics()
+		if stats.CurrentJobsReady > 0 && stats.Pause == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// writes a response carrying the body of job, format being MSG_RESERVED or
+// MSG_PEEK_FOUND. The body goes out as is instead of being formatted into the
+// response, so nothing is left for processCommand to write. A leader hands
+// the job out only once its reservation, or its put for peeks, is committed,
+// followers know nothing but committed jobs.
+func (client *client) writeJob(format string, job *job) string {
+	if cluster := client.server.cluster; cluster != nil && cluster.refusal() == "" {
+		if response := cluster.acknowledge(format); response != format {
+			return response
+		}
+	}
+
+	fmt.Fprintf(client.writer, format, job.id, len(job.body))
+	client.writer.Write(job.body)
+	client.writer.WriteString("\r\n")
+	return ""
+}
+
+// writes buffered answers once no more commands are waiting to be read, so
+// pipelined commands are answered with as few writes as possible.
+func (client *client) flushIfDrained() error {
+	if client.reader.Buffered() > 0 {
+		return nil
+	}
+	return client.writer.Flush()
+}
+
+// called before waiting for a job. Answers the client is owed are written now
+// if it has nothing else queued, or shortly if the wait drags on. Returns the
+// channel to flush on.
+func (client *client) flushSoon() <-chan time.Time {
+	if client.writer.Buffered() == 0 {
+		return nil
+	}
+
+	if client.reader.Buffered() == 0 {
+		client.writer.Flush()
+		return nil
+	}
+
+	return time.After(flushDelay)
+}
@@ -0,0 +1,1103 @@
+package gostalk
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// A cluster is a group of servers that agree on their jobs through Raft. The
+// elected leader takes the commands that change jobs and appends what they
+// did to its log, as the mutations replicas are sent. Once most of the nodes
+// have an entry it is committed: the leader answers the command, and the
+// followers apply it to their own jobs. Followers serve what doesn't change
+// jobs and answer the rest with NOT_LEADER and the address of the leader.
+//
+// A node's jobs may hold changes the cluster never committed once it stops
+// leading. Such a node is stale: it takes entries but applies none until the
+// leader sent it a snapshot of its jobs, as it does for nodes too far behind
+// its log. Nodes
+// that aren't stale don't vote for stale ones, which lead only when most of
+// the cluster is stale, like after restarting all of it.
+//
+// Nodes call each other over their client port: they authenticate like
+// replicas and send "raft", which is answered with RAFT and followed by one
+// line of JSON per call and answer. The term, vote and log of a node are
+// kept in its binlog directory. A restarted node holding jobs joins as stale,
+// its jobs may be ahead of what was committed.
+
+// roles of a node.
+const (
+	raftFollower  = "follower"
+	raftCandidate = "candidate"
+	raftLeader    = "leader"
+)
+
+// a follower that hears nothing from a leader for this long, plus up to as
+// much again at random, stands for election. A leader that hears from too few
+// followers for as long steps down.
+const raftElectionTimeout = 300 * time.Millisecond
+
+// how often a leader sends entries or heartbeats to each follower.
+const raftHeartbeat = 50 * time.Millisecond
+
+// how long a node waits for another to answer a call.
+const raftCallTimeout = 250 * time.Millisecond
+
+// how long a command waits for the cluster to commit what it changed, and
+// for a snapshot to be committed and sent.
+const raftCommitTimeout = 5 * time.Second
+
+// the most entries sent or applied at once.
+const raftBatch = 256
+
+// entries kept once applied, older ones are dropped. Followers that fall
+// further behind get a snapshot.
+const raftMaxLog = 4096
+
+// an entry of the log, one without a mutation starts the term of a leader.
+type raftEntry struct {
+	Term     uint64    `json:"term"`
+	Mutation *mutation `json:"mutation,omitempty"`
+}
+
+type voteArgs struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last-index"`
+	LastTerm  uint64 `json:"last-term"`
+	Stale     bool   `json:"stale"`
+}
+
+type voteReply struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type appendArgs struct {
+	Term      uint64      `json:"term"`
+	Leader    string      `json:"leader"`
+	PrevIndex uint64      `json:"prev-index"`
+	PrevTerm  uint64      `json:"prev-term"`
+	Entries   []raftEntry `json:"entries"`
+	Commit    uint64      `json:"commit"`
+}
+
+type appendReply struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	Stale   bool   `json:"stale"`
+	// the last index of the follower, so the leader finds where their logs
+	// part quickly.
+	LastIndex uint64 `json:"last-index"`
+}
+
+type snapshotArgs struct {
+	Term      uint64      `json:"term"`
+	Leader    string      `json:"leader"`
+	LastIndex uint64      `json:"last-index"`
+	LastTerm  uint64      `json:"last-term"`
+	Mutations []*mutation `json:"mutations"`
+}
+
+type snapshotReply struct {
+	Term uint64 `json:"term"`
+}
+
+// raftTransport carries the calls of a node to the others.
+type raftTransport interface {
+	// calls method on peer with args, decoding its answer into reply.
+	call(peer, method string, args, reply interface{}) error
+	close()
+}
+
+type raftNode struct {
+	server    *Server
+	id        string
+	peers     []string
+	transport raftTransport
+	disk      *raftLog
+
+	// held while the cluster changes the jobs of the server, before lock.
+	applyLock sync.Mutex
+
+	lock     sync.Mutex
+	role     string
+	term     uint64
+	votedFor string
+	leader   string
+	deadline time.Time // of the election
+
+	log         []raftEntry // the entries after baseIndex
+	baseIndex   uint64
+	baseTerm    uint64
+	commitIndex uint64
+	applied     uint64 // the last entry the jobs of the server reflect
+	stale       bool
+
+	// while leading: the entry starting the term, whether the entries before
+	// it are applied so the node takes commands, and how far the peers are.
+	termStart   uint64
+	writable    bool
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	heardFrom   map[string]time.Time
+	needsResync map[string]bool
+
+	// closed and replaced whenever the role or commitIndex changes.
+	changed chan bool
+	// receive once there are entries to apply or send.
+	pendingApply chan bool
+	pendingSend  map[string]chan bool
+}
+
+func newRaftNode(server *Server, transport raftTransport) (*raftNode, error) {
+	disk, state, err := openRaftLog(server.config.BinlogDir)
+	if err != nil {
+		return nil, err
+	}
+
+	node := &raftNode{
+		server:    server,
+		id:        server.config.ClusterAddr,
+		transport: transport,
+		disk:      disk,
+		role:      raftFollower,
+		term:      state.term,
+		votedFor:  state.votedFor,
+		log:       state.log,
+		baseIndex: state.baseIndex,
+		baseTerm:  state.baseTerm,
+		// the entries after the base are applied again once committed, the
+		// jobs end up as they left them.
+		commitIndex:  state.baseIndex,
+		applied:      state.baseIndex,
+		stale:        server.jobs.Len() > 0,
+		nextIndex:    map[string]uint64{},
+		matchIndex:   map[string]uint64{},
+		heardFrom:    map[string]time.Time{},
+		needsResync:  map[string]bool{},
+		changed:      make(chan bool),
+		pendingApply: make(chan bool, 1),
+		pendingSend:  map[string]chan bool{},
+	}
+
+	for _, peer := range server.config.ClusterPeers {
+		if peer != node.id {
+			node.peers = append(node.peers, peer)
+			node.pendingSend[peer] = make(chan bool, 1)
+		}
+	}
+	node.resetElection()
+
+	return node, nil
+}
+
+// runs the node until the server shuts down.
+func (node *raftNode) start() {
+	node.server.conns.Add(1)
+	go func() {
+		defer node.server.conns.Done()
+
+		var routines sync.WaitGroup
+		run := func(f func()) {
+			routines.Add(1)
+			go func() {
+				defer routines.Done()
+				f()
+			}()
+		}
+
+		run(node.runElections)
+		run(node.runApplier)
+		for _, peer := range node.peers {
+			peer := peer
+			run(func() { node.runReplication(peer) })
+		}
+
+		routines.Wait()
+		node.transport.close()
+
+		node.lock.Lock()
+		defer node.lock.Unlock()
+		node.disk.close()
+	}()
+}
+
+func poke(pending chan bool) {
+	select {
+	case pending <- true:
+	default: // already pending
+	}
+}
+
+func (node *raftNode) lastIndex() uint64 {
+	return node.baseIndex + uint64(len(node.log))
+}
+
+// the term of the entry at index, 0 if it was dropped.
+func (node *raftNode) termAt(index uint64) uint64 {
+	switch {
+	case index == node.baseIndex:
+		return node.baseTerm
+	case index < node.baseIndex || index > node.lastIndex():
+		return 0
+	}
+	return node.log[index-node.baseIndex-1].Term
+}
+
+// a copy of the entries from index from to index to.
+func (node *raftNode) entries(from, to uint64) []raftEntry {
+	if to < from {
+		return nil
+	}
+	return append([]raftEntry(nil), node.log[from-node.baseIndex-1:to-node.baseIndex]...)
+}
+
+// saves the term and vote, reporting false if they may be lost.
+func (node *raftNode) saveVote() bool {
+	err := node.disk.saveVote(node.term, node.votedFor)
+	if err != nil {
+		pf("raft: %v", err)
+	}
+	return err == nil
+}
+
+// appends entry to the log of the leader, which steps down if it can't save
+// it.
+func (node *raftNode) appendEntry(entry raftEntry) bool {
+	node.log = append(node.log, entry)
+	err := node.disk.saveEntries(node.lastIndex(), node.log[len(node.log)-1:])
+	if err != nil {
+		pf("raft: %v", err)
+		node.becomeFollower(node.term, "")
+		node.resetElection()
+		return false
+	}
+	return true
+}
+
+// writes the state of the node anew once the log lost entries at its start.
+func (node *raftNode) saveLog() {
+	err := node.disk.rewrite(&raftState{
+		term:      node.term,
+		votedFor:  node.votedFor,
+		baseIndex: node.baseIndex,
+		baseTerm:  node.baseTerm,
+		log:       node.log,
+	})
+	if err != nil {
+		pf("raft: %v", err)
+	}
+}
+
+func (node *raftNode) notify() {
+	close(node.changed)
+	node.changed = make(chan bool)
+}
+
+func (node *raftNode) majority(votes int) bool {
+	return votes*2 > len(node.peers)+1
+}
+
+func (node *raftNode) resetElection() {
+	timeout := raftElectionTimeout + time.Duration(rand.Int63n(int64(raftElectionTimeout)))
+	if node.stale {
+		// leaves the lead to nodes whose jobs are up to date, if there are any.
+		timeout *= 4
+	}
+	node.deadline = time.Now().Add(timeout)
+}
+
+// Must be called with lock held, as all that change the role.
+func (node *raftNode) becomeFollower(term uint64, leader string) {
+	if node.role == raftLeader && node.writable && node.lastIndex() > node.commitIndex {
+		node.stale = true
+	}
+	if term > node.term {
+		node.term = term
+		node.votedFor = ""
+		node.saveVote()
+	}
+
+	if node.role != raftFollower || node.leader != leader {
+		node.role = raftFollower
+		node.leader = leader
+		node.writable = false
+		node.notify()
+	}
+}
+
+func (node *raftNode) becomeLeader() {
+	node.role = raftLeader
+	node.leader = node.id
+	node.writable = false
+	node.termStart = node.lastIndex() + 1
+	if !node.appendEntry(raftEntry{Term: node.term}) {
+		return
+	}
+
+	// the jobs of a stale leader are what the cluster has from now on.
+	resync := node.stale
+	node.stale = false
+
+	for _, peer := range node.peers {
+		node.nextIndex[peer] = node.termStart
+		node.matchIndex[peer] = 0
+		node.heardFrom[peer] = time.Now()
+		node.needsResync[peer] = resync
+		poke(node.pendingSend[peer])
+	}
+
+	node.notify()
+	node.advanceCommit()
+	poke(node.pendingApply)
+}
+
+// commits the last entry of this term most nodes have.
+func (node *raftNode) advanceCommit() {
+	for index := node.lastIndex(); index > node.commitIndex && node.termAt(index) == node.term; index -= 1 {
+		votes := 1
+		for _, peer := range node.peers {
+			if node.matchIndex[peer] >= index {
+				votes += 1
+			}
+		}
+
+		if node.majority(votes) {
+			node.commitIndex = index
+			node.notify()
+			poke(node.pendingApply)
+			return
+		}
+	}
+}
+
+// appends a mutation the leader made to its log.
+func (node *raftNode) propose(m *mutation) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	// followers change their jobs on their own when reservations and delays
+	// run out, until the leader tells them what it made of it.
+	if node.role != raftLeader || !node.writable {
+		// anything else comes from a command let in before the node stepped
+		// down, its jobs differ from the leader's now.
+		if m.Op != mutationTimeout {
+			node.stale = true
+		}
+		return
+	}
+
+	if !node.appendEntry(raftEntry{Term: node.term, Mutation: m}) {
+		return
+	}
+	for _, peer := range node.peers {
+		poke(node.pendingSend[peer])
+	}
+	node.advanceCommit()
+}
+
+// waits until the entry at index of term is committed, reports false if the
+// node stops leading or it takes too long.
+func (node *raftNode) awaitCommit(index, term uint64) bool {
+	timeout := time.After(raftCommitTimeout)
+	for {
+		node.lock.Lock()
+		if node.role != raftLeader || node.term != term {
+			node.lock.Unlock()
+			return false
+		}
+		if node.commitIndex >= index {
+			node.lock.Unlock()
+			return true
+		}
+		changed := node.changed
+		node.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return false
+		case <-node.server.quit:
+			return false
+		}
+	}
+}
+
+// waits until everything proposed so far is committed, and answers response
+// then. Answers NOT_LEADER instead if the node stopped leading meanwhile.
+func (node *raftNode) acknowledge(response string) string {
+	node.lock.Lock()
+	index, term := node.lastIndex(), node.term
+	node.lock.Unlock()
+
+	if node.awaitCommit(index, term) {
+		return response
+	}
+	if refusal := node.refusal(); refusal != "" {
+		return refusal
+	}
+	return MSG_INTERNAL_ERROR
+}
+
+// the answer to commands that change jobs, empty if the node takes them.
+func (node *raftNode) refusal() string {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	switch {
+	case node.role == raftLeader && node.writable:
+		return ""
+	case node.leader != "" && node.leader != node.id:
+		return fmt.Sprintf(MSG_NOT_LEADER_AT, node.leader)
+	}
+	return MSG_NOT_LEADER
+}
+
+// the role, leader and term for stats.
+func (node *raftNode) status() (role, leader string, term uint64) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	return node.role, node.leader, node.term
+}
+
+// stands for election when no leader was heard of for too long, and steps
+// down as leader when most followers weren't.
+func (node *raftNode) runElections() {
+	ticker := time.NewTicker(raftHeartbeat / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-node.server.quit:
+			return
+		}
+
+		node.lock.Lock()
+		if node.role == raftLeader {
+			heard := 1
+			for _, peer := range node.peers {
+				if time.Since(node.heardFrom[peer]) < raftElectionTimeout {
+					heard += 1
+				}
+			}
+			if !node.majority(heard) {
+				node.becomeFollower(node.term, "")
+				node.resetElection()
+			}
+		} else if time.Now().After(node.deadline) {
+			node.campaign()
+		}
+		node.lock.Unlock()
+	}
+}
+
+// starts an election and asks the peers for their votes.
+func (node *raftNode) campaign() {
+	node.term += 1
+	node.role = raftCandidate
+	node.leader = ""
+	node.votedFor = node.id
+	node.writable = false
+	node.resetElection()
+	node.notify()
+	if !node.saveVote() {
+		return
+	}
+
+	args := &voteArgs{
+		Term:      node.term,
+		Candidate: node.id,
+		LastIndex: node.lastIndex(),
+		LastTerm:  node.termAt(node.lastIndex()),
+		Stale:     node.stale,
+	}
+
+	votes := 1
+	if node.majority(votes) {
+		node.becomeLeader()
+		return
+	}
+
+	for _, peer := range node.peers {
+		go func(peer string) {
+			reply := &voteReply{}
+			if node.transport.call(peer, "vote", args, reply) != nil {
+				return
+			}
+
+			node.lock.Lock()
+			defer node.lock.Unlock()
+
+			if reply.Term > node.term {
+				node.becomeFollower(reply.Term, "")
+				return
+			}
+			if node.role != raftCandidate || node.term != args.Term || !reply.Granted {
+				return
+			}
+			votes += 1
+			if node.majority(votes) {
+				node.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// sends entries, heartbeats or snapshots to peer while leading.
+func (node *raftNode) runReplication(peer string) {
+	for {
+		select {
+		case <-time.After(raftHeartbeat):
+		case <-node.pendingSend[peer]:
+		case <-node.server.quit:
+			return
+		}
+
+		node.lock.Lock()
+		if node.role != raftLeader {
+			node.lock.Unlock()
+			continue
+		}
+		if node.needsResync[peer] || node.nextIndex[peer] <= node.baseIndex {
+			node.lock.Unlock()
+			if node.sendSnapshot(peer) {
+				continue
+			}
+			// entries still go out meanwhile, as far as the log has them.
+			node.lock.Lock()
+			if node.role != raftLeader || node.nextIndex[peer] <= node.baseIndex {
+				node.lock.Unlock()
+				continue
+			}
+		}
+
+		next := node.nextIndex[peer]
+		last := node.lastIndex()
+		if last >= next+raftBatch {
+			last = next + raftBatch - 1
+		}
+		args := &appendArgs{
+			Term:      node.term,
+			Leader:    node.id,
+			PrevIndex: next - 1,
+			PrevTerm:  node.termAt(next - 1),
+			Entries:   node.entries(next, last),
+			Commit:    node.commitIndex,
+		}
+		node.lock.Unlock()
+
+		reply := &appendReply{}
+		if node.transport.call(peer, "append", args, reply) != nil {
+			continue
+		}
+
+		node.lock.Lock()
+		switch {
+		case reply.Term > node.term:
+			node.becomeFollower(reply.Term, "")
+			node.resetElection()
+		case node.role != raftLeader || node.term != args.Term:
+		case reply.Success:
+			node.heardFrom[peer] = time.Now()
+			match := args.PrevIndex + uint64(len(args.Entries))
+			if match > node.matchIndex[peer] {
+				node.matchIndex[peer] = match
+			}
+			node.nextIndex[peer] = node.matchIndex[peer] + 1
+			// the entries of a stale follower count towards commits, which
+			// the snapshot it waits for needs.
+			node.needsResync[peer] = node.needsResync[peer] || reply.Stale
+			node.advanceCommit()
+			if node.nextIndex[peer] <= node.lastIndex() || reply.Stale {
+				poke(node.pendingSend[peer])
+			}
+		case reply.Stale:
+			node.heardFrom[peer] = time.Now()
+			node.needsResync[peer] = true
+			poke(node.pendingSend[peer])
+		default:
+			node.heardFrom[peer] = time.Now()
+			next := args.PrevIndex
+			if reply.LastIndex+1 < next {
+				next = reply.LastIndex + 1
+			}
+			if next < 1 {
+				next = 1
+			}
+			node.nextIndex[peer] = next
+			poke(node.pendingSend[peer])
+		}
+		node.lock.Unlock()
+	}
+}
+
+// sends peer the jobs of the server once everything they reflect is
+// committed, and the entries after them from then on. Reports false if what
+// they reflect isn't committed yet, which may take the entries of peer.
+func (node *raftNode) sendSnapshot(peer string) bool {
+	node.lock.Lock()
+	if node.role != raftLeader || !node.writable || node.commitIndex < node.lastIndex() {
+		node.lock.Unlock()
+		return false
+	}
+	term := node.term
+	// entries after this one are sent after the snapshot, changes they made
+	// during it are applied twice, which does no harm.
+	index := node.lastIndex()
+	args := &snapshotArgs{
+		Term:      term,
+		Leader:    node.id,
+		LastIndex: index,
+		LastTerm:  node.termAt(index),
+	}
+	node.lock.Unlock()
+
+	args.Mutations = node.server.snapshot()
+
+	node.lock.Lock()
+	committed := node.role == raftLeader && node.term == term && node.commitIndex >= node.lastIndex()
+	node.lock.Unlock()
+	if !committed {
+		return false
+	}
+
+	reply := &snapshotReply{}
+	if node.transport.call(peer, "snapshot", args, reply) != nil {
+		return true
+	}
+
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if reply.Term > node.term {
+		node.becomeFollower(reply.Term, "")
+		node.resetElection()
+		return true
+	}
+	if node.role != raftLeader || node.term != term {
+		return true
+	}
+	node.heardFrom[peer] = time.Now()
+	node.needsResync[peer] = false
+	if index > node.matchIndex[peer] {
+		node.matchIndex[peer] = index
+	}
+	node.nextIndex[peer] = node.matchIndex[peer] + 1
+	node.advanceCommit()
+	poke(node.pendingSend[peer])
+	return true
+}
+
+// applies committed entries to the jobs of the server until the server shuts
+// down.
+func (node *raftNode) runApplier() {
+	for {
+		select {
+		case <-node.pendingApply:
+			node.applyCommitted()
+		case <-node.server.quit:
+			return
+		}
+	}
+}
+
+func (node *raftNode) applyCommitted() {
+	node.applyLock.Lock()
+	defer node.applyLock.Unlock()
+
+	for {
+		node.lock.Lock()
+		if node.stale {
+			node.lock.Unlock()
+			return
+		}
+
+		if node.applied >= node.commitIndex {
+			starting := node.role == raftLeader && !node.writable && node.applied >= node.termStart
+			term := node.term
+			node.lock.Unlock()
+			if starting {
+				node.startLeading(term)
+			}
+			return
+		}
+
+		from, to := node.applied+1, node.commitIndex
+		if to >= from+raftBatch {
+			to = from + raftBatch - 1
+		}
+		entries := node.entries(from, to)
+		// the entries of the leader itself changed its jobs already.
+		var own uint64
+		if node.role == raftLeader {
+			own = node.termStart
+		}
+		term := node.term
+		node.lock.Unlock()
+
+		for n, entry := range entries {
+			switch {
+			case entry.Mutation == nil:
+			case own > 0 && from+uint64(n) >= own && entry.Term == term:
+				node.server.noteJobId(entry.Mutation)
+			default:
+				node.server.apply(entry.Mutation)
+			}
+		}
+
+		node.lock.Lock()
+		node.applied = to
+		node.compact()
+		node.lock.Unlock()
+	}
+}
+
+// lets the leader take commands once it applied the entries of the terms
+// before its own. Must be called with applyLock held.
+func (node *raftNode) startLeading(term uint64) {
+	// job ids carry on after those of the last leader.
+	node.server.setJobId <- node.server.nextJobId
+
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if node.role == raftLeader && node.term == term {
+		node.writable = true
+		node.notify()
+	}
+}
+
+// drops applied entries once the log grows too long.
+func (node *raftNode) compact() {
+	if len(node.log) <= raftMaxLog || node.applied <= node.baseIndex {
+		return
+	}
+
+	dropped := node.applied - node.baseIndex
+	node.baseTerm = node.termAt(node.applied)
+	node.baseIndex = node.applied
+	node.log = append([]raftEntry(nil), node.log[dropped:]...)
+	node.saveLog()
+}
+
+// answers a call of another node.
+func (node *raftNode) handle(method string, args json.RawMessage) (interface{}, error) {
+	switch method {
+	case "vote":
+		request := &voteArgs{}
+		if err := json.Unmarshal(args, request); err != nil {
+			return nil, err
+		}
+		return node.vote(request), nil
+	case "append":
+		request := &appendArgs{}
+		if err := json.Unmarshal(args, request); err != nil {
+			return nil, err
+		}
+		return node.appendEntries(request), nil
+	case "snapshot":
+		request := &snapshotArgs{}
+		if err := json.Unmarshal(args, request); err != nil {
+			return nil, err
+		}
+		return node.installSnapshot(request), nil
+	}
+	return nil, fmt.Errorf("gostalk: unknown raft call %q", method)
+}
+
+func (node *raftNode) vote(args *voteArgs) *voteReply {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if args.Term > node.term {
+		node.becomeFollower(args.Term, "")
+	}
+	reply := &voteReply{Term: node.term}
+	if args.Term < node.term {
+		return reply
+	}
+
+	lastIndex := node.lastIndex()
+	lastTerm := node.termAt(lastIndex)
+	upToDate := args.LastTerm > lastTerm || (args.LastTerm == lastTerm && args.LastIndex >= lastIndex)
+	// a stale leader makes its jobs those of the cluster, so nodes whose jobs
+	// are up to date leave the lead to one like them.
+	if args.Stale && !node.stale {
+		upToDate = false
+	}
+	if upToDate && (node.votedFor == "" || node.votedFor == args.Candidate) {
+		node.votedFor = args.Candidate
+		if node.saveVote() {
+			node.resetElection()
+			reply.Granted = true
+		}
+	}
+	return reply
+}
+
+func (node *raftNode) appendEntries(args *appendArgs) *appendReply {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	reply := &appendReply{Term: node.term}
+	if args.Term < node.term {
+		return reply
+	}
+	node.becomeFollower(args.Term, args.Leader)
+	node.resetElection()
+	reply.Term = node.term
+	reply.LastIndex = node.lastIndex()
+	reply.Stale = node.stale
+
+	// entries up to baseIndex are committed, so they match the leader's.
+	if args.PrevIndex < node.baseIndex {
+		skipped := node.baseIndex - args.PrevIndex
+		if skipped > uint64(len(args.Entries)) {
+			skipped = uint64(len(args.Entries))
+		}
+		args.Entries = args.Entries[skipped:]
+		args.PrevIndex += skipped
+		args.PrevTerm = node.termAt(args.PrevIndex)
+	}
+	if args.PrevIndex > node.lastIndex() || node.termAt(args.PrevIndex) != args.PrevTerm {
+		if args.PrevIndex <= node.lastIndex() {
+			reply.LastIndex = args.PrevIndex - 1
+		}
+		return reply
+	}
+
+	var from uint64 // the first entry that is new
+	for n, entry := range args.Entries {
+		index := args.PrevIndex + 1 + uint64(n)
+		if index <= node.lastIndex() {
+			if node.termAt(index) == entry.Term {
+				continue
+			}
+			// only entries that aren't committed yet differ from the leader's.
+			node.log = node.log[:index-node.baseIndex-1]
+		}
+		if from == 0 {
+			from = index
+		}
+		node.log = append(node.log, entry)
+	}
+	if from > 0 {
+		err := node.disk.saveEntries(from, node.log[from-node.baseIndex-1:])
+		if err != nil {
+			pf("raft: %v", err)
+			node.log = node.log[:from-node.baseIndex-1]
+			reply.LastIndex = node.lastIndex()
+			return reply
+		}
+	}
+
+	last := args.PrevIndex + uint64(len(args.Entries))
+	if args.Commit > node.commitIndex && node.commitIndex < last {
+		node.commitIndex = args.Commit
+		if node.commitIndex > last {
+			node.commitIndex = last
+		}
+		node.notify()
+		poke(node.pendingApply)
+	}
+
+	reply.Success = true
+	reply.LastIndex = node.lastIndex()
+	return reply
+}
+
+// replaces the jobs of the server and the log with the snapshot of the
+// leader.
+func (node *raftNode) installSnapshot(args *snapshotArgs) *snapshotReply {
+	node.lock.Lock()
+	if args.Term < node.term {
+		defer node.lock.Unlock()
+		return &snapshotReply{Term: node.term}
+	}
+	node.becomeFollower(args.Term, args.Leader)
+	node.resetElection()
+	node.lock.Unlock()
+
+	node.applyLock.Lock()
+	defer node.applyLock.Unlock()
+
+	node.server.installSnapshot(args.Mutations)
+
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	// entries after the snapshot are kept, the leader counted them.
+	var kept []raftEntry
+	if args.LastIndex >= node.baseIndex && args.LastIndex < node.lastIndex() && node.termAt(args.LastIndex) == args.LastTerm {
+		kept = append(kept, node.log[args.LastIndex-node.baseIndex:]...)
+	}
+	node.log = kept
+	node.baseIndex = args.LastIndex
+	node.baseTerm = args.LastTerm
+	if node.commitIndex < args.LastIndex {
+		node.commitIndex = args.LastIndex
+	}
+	node.applied = args.LastIndex
+	node.stale = false
+	node.saveLog()
+	node.resetElection()
+	node.notify()
+	poke(node.pendingApply)
+	return &snapshotReply{Term: node.term}
+}
+
+// serves the calls of another node on the connection of client until it
+// hangs up.
+func (node *raftNode) serve(client *client) error {
+	_, err := client.writer.WriteString(MSG_RAFT)
+	if err == nil {
+		err = client.writer.Flush()
+	}
+
+	decoder := json.NewDecoder(client.reader)
+	encoder := json.NewEncoder(client.writer)
+	for err == nil {
+		request := &raftRequest{}
+		err = decoder.Decode(request)
+		if err != nil {
+			break
+		}
+
+		response := &raftResponse{}
+		reply, callErr := node.handle(request.Method, request.Args)
+		if callErr != nil {
+			response.Error = callErr.Error()
+		} else {
+			response.Reply, err = json.Marshal(reply)
+		}
+
+		if err == nil {
+			err = encoder.Encode(response)
+		}
+		if err == nil {
+			err = client.writer.Flush()
+		}
+	}
+	return err
+}
+
+type raftRequest struct {
+	Method string          `json:"method"`
+	Args   json.RawMessage `json:"args"`
+}
+
+type raftResponse struct {
+	Error string          `json:"error,omitempty"`
+	Reply json.RawMessage `json:"reply,omitempty"`
+}
+
+// calls the other nodes over their client port, keeping a connection to each.
+type tcpTransport struct {
+	server *Server
+	lock   sync.Mutex
+	conns  map[string]*raftConn
+}
+
+type raftConn struct {
+	sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newTCPTransport(server *Server) *tcpTransport {
+	return &tcpTransport{server: server, conns: map[string]*raftConn{}}
+}
+
+func (transport *tcpTransport) call(peer, method string, args, reply interface{}) error {
+	transport.lock.Lock()
+	conn, found := transport.conns[peer]
+	if !found {
+		conn = &raftConn{}
+		transport.conns[peer] = conn
+	}
+	transport.lock.Unlock()
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	// snapshots take longer than the rest.
+	timeout := raftCallTimeout
+	if method == "snapshot" {
+		timeout = raftCommitTimeout
+	}
+
+	err := conn.call(transport.server, peer, method, args, reply, timeout)
+	if err != nil && conn.conn != nil {
+		conn.conn.Close()
+		conn.conn = nil
+	}
+	return err
+}
+
+func (conn *raftConn) call(server *Server, peer, method string, args, reply interface{}, timeout time.Duration) error {
+	if conn.conn == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		raw, err := server.dialNode(ctx, peer)
+		if err != nil {
+			return err
+		}
+
+		conn.conn, conn.reader = raw, bufio.NewReader(raw)
+		conn.conn.SetDeadline(time.Now().Add(timeout))
+		err = server.login(conn.conn, conn.reader, "raft", MSG_RAFT)
+		if err != nil {
+			return err
+		}
+	}
+	conn.conn.SetDeadline(time.Now().Add(timeout))
+
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(&raftRequest{Method: method, Args: encoded})
+	if err != nil {
+		return err
+	}
+	_, err = conn.conn.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	line, err = conn.reader.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	response := &raftResponse{}
+	err = json.Unmarshal(line, response)
+	if err != nil {
+		return err
+	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+	return json.Unmarshal(response.Reply, reply)
+}
+
+func (transport *tcpTransport) close() {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+
+	for _, conn := range transport.conns {
+		conn.Lock()
+		if conn.conn != nil {
+			conn.conn.Close()
+		}
+		conn.Unlock()
+	}
+}
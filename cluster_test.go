@@ -0,0 +1,540 @@
+package gostalk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/manveru/gobdd"
+)
+
+var errUnreachable = errors.New("gostalk: node unreachable")
+
+// nodes of a cluster calling each other in memory, over links that can be
+// cut to simulate partitions.
+type memoryNetwork struct {
+	lock  sync.Mutex
+	nodes map[string]*raftNode
+	cut   map[[2]string]bool
+}
+
+type memoryLink struct {
+	network *memoryNetwork
+	from    string
+}
+
+func newMemoryNetwork() *memoryNetwork {
+	return &memoryNetwork{nodes: map[string]*raftNode{}, cut: map[[2]string]bool{}}
+}
+
+// cuts the links between nodes of different groups.
+func (network *memoryNetwork) partition(groups ...[]string) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	for i, group := range groups {
+		for j, other := range groups {
+			if i == j {
+				continue
+			}
+			for _, from := range group {
+				for _, to := range other {
+					network.cut[[2]string{from, to}] = true
+				}
+			}
+		}
+	}
+}
+
+func (network *memoryNetwork) heal() {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	network.cut = map[[2]string]bool{}
+}
+
+func (link *memoryLink) reachable(peer string) *raftNode {
+	link.network.lock.Lock()
+	defer link.network.lock.Unlock()
+
+	if link.network.cut[[2]string{link.from, peer}] {
+		return nil
+	}
+	return link.network.nodes[peer]
+}
+
+// calls peer with args and reply encoded as between servers, so nodes share
+// nothing.
+func (link *memoryLink) call(peer, method string, args, reply interface{}) error {
+	node := link.reachable(peer)
+	if node == nil {
+		return errUnreachable
+	}
+
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	answer, err := node.handle(method, encoded)
+	if err != nil {
+		return err
+	}
+
+	// the answer is lost if the link was cut meanwhile.
+	if link.reachable(peer) == nil {
+		return errUnreachable
+	}
+	encoded, err = json.Marshal(answer)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, reply)
+}
+
+func (link *memoryLink) close() {}
+
+type clusterNode struct {
+	id     string
+	dir    string
+	server *Server
+	conn   *statsConn
+}
+
+// starts the node id of the cluster of ids, keeping its binlog in dir.
+func startNode(network *memoryNetwork, id string, ids []string, dir string) *clusterNode {
+	config := DefaultConfig()
+	config.ClusterAddr = id
+	config.ClusterPeers = ids
+	config.BinlogDir = dir
+
+	server, err := newServer(config, &memoryLink{network: network, from: id})
+	Expect(err, ToBeNil)
+	network.lock.Lock()
+	network.nodes[id] = server.cluster
+	network.lock.Unlock()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err, ToBeNil)
+	go server.Serve(listener)
+
+	return &clusterNode{id: id, dir: dir, server: server, conn: dialStats(listener.Addr().String())}
+}
+
+// starts a server for every id, connected through network.
+func startCluster(network *memoryNetwork, ids []string) []*clusterNode {
+	nodes := []*clusterNode{}
+	for _, id := range ids {
+		dir, err := ioutil.TempDir("", "gostalk-cluster")
+		Expect(err, ToBeNil)
+		nodes = append(nodes, startNode(network, id, ids, dir))
+	}
+	return nodes
+}
+
+func stopNode(node *clusterNode) {
+	node.conn.conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	node.server.Shutdown(ctx)
+	cancel()
+}
+
+func stopCluster(nodes []*clusterNode) {
+	for _, node := range nodes {
+		stopNode(node)
+		os.RemoveAll(node.dir)
+	}
+}
+
+// polls until condition holds, for a few seconds at most.
+func eventually(condition func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if condition() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return condition()
+}
+
+// waits until exactly one of nodes takes commands and answers it.
+func awaitLeader(nodes []*clusterNode) (leader *clusterNode) {
+	eventually(func() bool {
+		leader = nil
+		for _, node := range nodes {
+			if node.server.writeRefusal() != "" {
+				continue
+			}
+			if leader != nil {
+				leader = nil
+				return false
+			}
+			leader = node
+		}
+		return leader != nil
+	})
+	return
+}
+
+// the body of job id as node has it, or its answer if it doesn't.
+func peekBody(node *clusterNode, id int) string {
+	response := node.conn.do(fmt.Sprintf("peek %d", id))
+	if !strings.HasPrefix(response, "FOUND") {
+		return response
+	}
+	return readResponseWithoutBody(node.conn.reader)
+}
+
+func init() {
+	defer PrintSpecReport()
+
+	Describe("cluster", func() {
+		network := newMemoryNetwork()
+		nodes := startCluster(network, []string{"node-1", "node-2", "node-3"})
+		defer stopCluster(nodes)
+
+		var leader *clusterNode
+		followers := func(leader *clusterNode) (others []*clusterNode) {
+			for _, node := range nodes {
+				if node != leader {
+					others = append(others, node)
+				}
+			}
+			return
+		}
+
+		It("elects a single leader", func() {
+			leader = awaitLeader(nodes)
+			Expect(leader == nil, ToEqual, false)
+			stats := leader.conn.stats("stats")
+			Expect(stats["cluster-role"], ToEqual, "leader")
+			Expect(stats["cluster-leader"], ToEqual, leader.id)
+		})
+
+		It("points followers' clients to the leader", func() {
+			for _, follower := range followers(leader) {
+				Expect(follower.conn.do("put 0 0 60 5\r\nhello"), ToEqual, "NOT_LEADER "+leader.id)
+				Expect(follower.conn.do("reserve-with-timeout 0"), ToEqual, "NOT_LEADER "+leader.id)
+				Expect(follower.conn.stats("stats")["cluster-role"], ToEqual, "follower")
+			}
+		})
+
+		It("replicates puts, reservations and deletes", func() {
+			Expect(leader.conn.do("put 0 0 60 5\r\nfirst"), ToEqual, "INSERTED 0")
+			Expect(leader.conn.do("put 1 0 1 6\r\nsecond"), ToEqual, "INSERTED 1")
+			Expect(leader.conn.do("put 2 0 60 5\r\nthird"), ToEqual, "INSERTED 2")
+			Expect(leader.conn.reserve("reserve").id, ToEqual, jobId(0))
+			Expect(leader.conn.do("delete 0"), ToEqual, "DELETED")
+			Expect(leader.conn.reserve("reserve").id, ToEqual, jobId(1))
+
+			for _, follower := range followers(leader) {
+				Expect(eventually(func() bool {
+					stats := follower.conn.stats("stats")
+					return stats["current-jobs-reserved"] == 1 && stats["current-jobs-ready"] == 1
+				}), ToEqual, true)
+				Expect(peekBody(follower, 0), ToEqual, "NOT_FOUND")
+				Expect(peekBody(follower, 2), ToEqual, "third")
+			}
+		})
+
+		It("replicates reservations running out", func() {
+			time.Sleep(1 * time.Second)
+			for _, node := range nodes {
+				Expect(eventually(func() bool {
+					return node.conn.stats("stats-job 1")["timeouts"] == 1
+				}), ToEqual, true)
+				Expect(node.conn.stats("stats")["current-jobs-ready"], ToEqual, 2)
+			}
+		})
+
+		var old *clusterNode
+		It("elects a new leader when the leader is cut off", func() {
+			old = leader
+			others := followers(old)
+			network.partition([]string{old.id}, []string{others[0].id, others[1].id})
+
+			// the old leader can't commit anymore, and stops taking commands.
+			response := old.conn.do("reserve-with-timeout 1")
+			Expect(strings.HasPrefix(response, "NOT_LEADER"), ToEqual, true)
+			response = old.conn.do("put 0 0 60 4\r\nlost")
+			Expect(strings.HasPrefix(response, "NOT_LEADER"), ToEqual, true)
+
+			leader = awaitLeader(others)
+			Expect(leader == nil, ToEqual, false)
+			Expect(leader.conn.do("put 2 0 60 4\r\nkept"), ToEqual, "INSERTED 3")
+			Expect(leader.conn.do("delete 1"), ToEqual, "DELETED")
+		})
+
+		It("brings the old leader back in line once the partition heals", func() {
+			network.heal()
+			leader = awaitLeader(nodes)
+			Expect(leader == nil, ToEqual, false)
+
+			Expect(eventually(func() bool { return peekBody(old, 3) == "kept" }), ToEqual, true)
+			for _, node := range nodes {
+				Expect(eventually(func() bool {
+					stats := node.conn.stats("stats")
+					return stats["current-jobs-ready"] == 2 && stats["current-jobs-reserved"] == 0
+				}), ToEqual, true)
+			}
+		})
+
+		It("counts on the new leader for job ids", func() {
+			Expect(leader.conn.do("put 0 0 60 5\r\nfifth"), ToEqual, "INSERTED 4")
+			for _, node := range nodes {
+				Expect(eventually(func() bool { return peekBody(node, 4) == "fifth" }), ToEqual, true)
+			}
+		})
+	})
+
+	Describe("cluster of five", func() {
+		network := newMemoryNetwork()
+		ids := []string{"node-1", "node-2", "node-3", "node-4", "node-5"}
+		nodes := startCluster(network, ids)
+		defer stopCluster(nodes)
+
+		It("takes jobs on the side of a partition holding most nodes", func() {
+			network.partition(ids[:2], ids[2:])
+			Expect(awaitLeader(nodes[:2]) == nil, ToEqual, true)
+
+			leader := awaitLeader(nodes[2:])
+			Expect(leader == nil, ToEqual, false)
+			Expect(leader.conn.do("put 0 0 60 5\r\nhello"), ToEqual, "INSERTED 0")
+
+			network.heal()
+			for _, node := range nodes {
+				Expect(eventually(func() bool { return peekBody(node, 0) == "hello" }), ToEqual, true)
+			}
+		})
+	})
+
+	Describe("cluster after restarting a node", func() {
+		network := newMemoryNetwork()
+		ids := []string{"node-1", "node-2", "node-3"}
+		nodes := startCluster(network, ids)
+		defer func() { stopCluster(nodes) }()
+
+		leader := awaitLeader(nodes)
+		Expect(leader == nil, ToEqual, false)
+		Expect(leader.conn.do("put 0 0 60 6\r\nbefore"), ToEqual, "INSERTED 0")
+		for _, node := range nodes {
+			Expect(eventually(func() bool { return peekBody(node, 0) == "before" }), ToEqual, true)
+		}
+
+		restarted := 0
+		if nodes[restarted] == leader {
+			restarted = 1
+		}
+		node := nodes[restarted].server.cluster
+		node.lock.Lock()
+		term, votedFor, lastIndex := node.term, node.votedFor, node.lastIndex()
+		node.lock.Unlock()
+
+		network.lock.Lock()
+		delete(network.nodes, nodes[restarted].id)
+		network.lock.Unlock()
+		stopNode(nodes[restarted])
+		nodes[restarted] = startNode(network, nodes[restarted].id, ids, nodes[restarted].dir)
+		node = nodes[restarted].server.cluster
+
+		It("keeps its term, vote and log", func() {
+			node.lock.Lock()
+			defer node.lock.Unlock()
+			Expect(node.term >= term, ToEqual, true)
+			Expect(node.lastIndex() >= lastIndex, ToEqual, true)
+			if node.term == term {
+				Expect(node.votedFor, ToEqual, votedFor)
+			}
+		})
+
+		It("doesn't vote twice in a term", func() {
+			node.lock.Lock()
+			term, votedFor := node.term, node.votedFor
+			node.lock.Unlock()
+
+			reply := node.vote(&voteArgs{Term: term, Candidate: "node-4", LastIndex: lastIndex + 100, LastTerm: term})
+			Expect(reply.Granted, ToEqual, votedFor == "")
+		})
+
+		It("catches up with the cluster", func() {
+			leader = awaitLeader(nodes)
+			Expect(leader == nil, ToEqual, false)
+			Expect(leader.conn.do("put 0 0 60 5\r\nafter"), ToEqual, "INSERTED 1")
+			for _, node := range nodes {
+				Expect(eventually(func() bool { return peekBody(node, 1) == "after" }), ToEqual, true)
+				Expect(peekBody(node, 0), ToEqual, "before")
+			}
+		})
+
+		It("doesn't vote for candidates missing entries it has", func() {
+			// raises the term of the cluster, which goes on to elect a new leader.
+			reply := node.vote(&voteArgs{Term: term + 100, Candidate: "node-4"})
+			Expect(reply.Granted, ToEqual, false)
+		})
+	})
+
+	Describe("cluster with a stale node", func() {
+		network := newMemoryNetwork()
+		ids := []string{"node-1", "node-2", "node-3"}
+		nodes := startCluster(network, ids)
+		defer func() { stopCluster(nodes) }()
+
+		leader := awaitLeader(nodes)
+		Expect(leader == nil, ToEqual, false)
+		Expect(leader.conn.do("put 0 0 60 6\r\nbefore"), ToEqual, "INSERTED 0")
+		for _, node := range nodes {
+			Expect(eventually(func() bool { return peekBody(node, 0) == "before" }), ToEqual, true)
+		}
+
+		// restarted while cut off, it holds jobs the leader never vouched for.
+		var stale, other *clusterNode
+		for _, node := range nodes {
+			switch {
+			case node == leader:
+			case stale == nil:
+				stale = node
+			default:
+				other = node
+			}
+		}
+		network.partition([]string{stale.id}, []string{leader.id, other.id})
+		network.lock.Lock()
+		delete(network.nodes, stale.id)
+		network.lock.Unlock()
+		stopNode(stale)
+		for n, node := range nodes {
+			if node == stale {
+				stale = startNode(network, stale.id, ids, stale.dir)
+				nodes[n] = stale
+			}
+		}
+
+		It("doesn't win the votes of nodes that aren't stale", func() {
+			network.heal()
+			network.partition([]string{leader.id}, []string{stale.id, other.id})
+
+			node := stale.server.cluster
+			node.lock.Lock()
+			Expect(node.stale, ToEqual, true)
+			node.campaign()
+			node.lock.Unlock()
+
+			Expect(awaitLeader([]*clusterNode{stale, other}), ToEqual, other)
+		})
+
+		It("takes the jobs of the leader", func() {
+			Expect(other.conn.do("put 0 0 60 5\r\nafter"), ToEqual, "INSERTED 1")
+			Expect(eventually(func() bool { return peekBody(stale, 1) == "after" }), ToEqual, true)
+			Expect(peekBody(stale, 0), ToEqual, "before")
+		})
+	})
+
+	Describe("cluster over TCP", func() {
+		listeners := []net.Listener{}
+		addrs := []string{}
+		for n := 0; n < 3; n += 1 {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err, ToBeNil)
+			listeners = append(listeners, listener)
+			addrs = append(addrs, listener.Addr().String())
+		}
+
+		nodes := []*clusterNode{}
+		for n, listener := range listeners {
+			dir, err := ioutil.TempDir("", "gostalk-cluster")
+			Expect(err, ToBeNil)
+			config := DefaultConfig()
+			config.ClusterAddr = addrs[n]
+			config.ClusterPeers = addrs
+			config.BinlogDir = dir
+			server, err := New(config)
+			Expect(err, ToBeNil)
+			go server.Serve(listener)
+			nodes = append(nodes, &clusterNode{id: addrs[n], dir: dir, server: server, conn: dialStats(addrs[n])})
+		}
+		defer stopCluster(nodes)
+
+		It("replicates jobs between its nodes", func() {
+			leader := awaitLeader(nodes)
+			Expect(leader == nil, ToEqual, false)
+			Expect(leader.conn.do("put 0 0 60 5\r\nhello"), ToEqual, "INSERTED 0")
+			for _, node := range nodes {
+				Expect(eventually(func() bool { return peekBody(node, 0) == "hello" }), ToEqual, true)
+			}
+			// the leader calls the others over their client ports. Candidates
+			// and calls that timed out open more connections.
+			for _, node := range nodes {
+				if node != leader {
+					Expect(node.conn.stats("stats")["cmd-raft"].(int) >= 1, ToEqual, true)
+				}
+			}
+		})
+	})
+
+	Describe("cluster over TLS", func() {
+		dir, err := ioutil.TempDir("", "gostalk-tls")
+		Expect(err, ToBeNil)
+		defer os.RemoveAll(dir)
+		ca, caKey := writeCertificate(dir, "ca", nil, nil)
+		writeCertificate(dir, "node", ca, caKey)
+
+		// the nodes call each other on TLS listeners, the tests use plain
+		// ones.
+		listeners := []net.Listener{}
+		addrs := []string{}
+		for n := 0; n < 3; n += 1 {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err, ToBeNil)
+			listeners = append(listeners, listener)
+			addrs = append(addrs, "tls://"+listener.Addr().String())
+		}
+
+		nodes := []*clusterNode{}
+		for n, listener := range listeners {
+			binlogDir, err := ioutil.TempDir("", "gostalk-cluster")
+			Expect(err, ToBeNil)
+			config := DefaultConfig()
+			config.TLSCert = filepath.Join(dir, "node.pem")
+			config.TLSKey = filepath.Join(dir, "node-key.pem")
+			config.TLSClientCA = filepath.Join(dir, "ca.pem")
+			config.ReplicaCA = filepath.Join(dir, "ca.pem")
+			config.ReplicaCert = config.TLSCert
+			config.ReplicaKey = config.TLSKey
+			config.ClusterAddr = addrs[n]
+			config.ClusterPeers = addrs
+			config.BinlogDir = binlogDir
+			server, err := New(config)
+			Expect(err, ToBeNil)
+			plain, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err, ToBeNil)
+			go server.serve(plain)
+			go server.Serve(listener)
+			nodes = append(nodes, &clusterNode{id: addrs[n], dir: binlogDir, server: server, conn: dialStats(plain.Addr().String())})
+		}
+		defer stopCluster(nodes)
+
+		It("replicates jobs between its nodes", func() {
+			leader := awaitLeader(nodes)
+			Expect(leader == nil, ToEqual, false)
+			Expect(leader.conn.do("put 0 0 60 5\r\nhello"), ToEqual, "INSERTED 0")
+			for _, node := range nodes {
+				Expect(eventually(func() bool { return peekBody(node, 0) == "hello" }), ToEqual, true)
+			}
+		})
+
+		It("names the leader by its tls:// address", func() {
+			leader := awaitLeader(nodes)
+			for _, node := range nodes {
+				if node != leader {
+					Expect(node.conn.do("put 0 0 60 5\r\nhello"), ToEqual, "NOT_LEADER "+leader.id)
+				}
+			}
+		})
+	})
+}
@@ -3,6 +3,7 @@ package gostalk
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"strconv"
 	"sync/atomic"
 	"time"
@@ -10,8 +11,16 @@ import (
 
 type args []string
 
+// returns the argument at idx, a missing argument is a BAD_FORMAT.
+func (args args) get(idx int) string {
+	if idx >= len(args) {
+		panic(MSG_BAD_FORMAT)
+	}
+	return args[idx]
+}
+
 func (args args) getInt(idx int) (output int64) {
-	output, err := strconv.ParseInt(args[idx], 10, 64)
+	output, err := strconv.ParseInt(args.get(idx), 10, 64)
 	if err != nil {
 		pf("args.getInt(%#v) : %v", args[idx], err)
 		panic(MSG_BAD_FORMAT)
@@ -20,25 +29,35 @@ func (args args) getInt(idx int) (output int64) {
 }
 
 func (args args) getUint(idx int) (output uint64) {
-	output, err := strconv.ParseUint(args[idx], 10, 64)
+	output, err := strconv.ParseUint(args.get(idx), 10, 64)
 	if err != nil {
-		pf("args.getInt(%#v) : %v", args[idx], err)
+		pf("args.getUint(%#v) : %v", args[idx], err)
 		panic(MSG_BAD_FORMAT)
 	}
 	return
 }
 
+// a priority from 0 to 2**32-1, anything beyond is a BAD_FORMAT.
+func (args args) getPriority(idx int) uint32 {
+	output, err := strconv.ParseUint(args.get(idx), 10, 32)
+	if err != nil {
+		pf("args.getPriority(%#v) : %v", args[idx], err)
+		panic(MSG_BAD_FORMAT)
+	}
+	return uint32(output)
+}
+
 func (args args) getJobId(idx int) jobId {
-	output, err := strconv.ParseUint(args[idx], 10, 64)
+	output, err := strconv.ParseUint(args.get(idx), 10, 64)
 	if err != nil {
-		pf("args.getInt(%#v) : %v", args[idx], err)
+		pf("args.getJobId(%#v) : %v", args[idx], err)
 		panic(MSG_BAD_FORMAT)
 	}
 	return jobId(output)
 }
 
 func (args args) getName(idx int) string {
-	name := args[idx]
+	name := args.get(idx)
 	if !NAME_CHARS.MatchString(name) {
 		panic(MSG_BAD_FORMAT)
 	}
@@ -48,8 +67,10 @@ func (args args) getName(idx int) string {
 
 var (
 	commands = map[string]func(*client, args) string{
+		"auth":                 cmdAuth,
 		"bury":                 cmdBury,
 		"delete":               cmdDelete,
+		"drain":                cmdDrain,
 		"ignore":               cmdIgnore,
 		"kick":                 cmdKick,
 		"list-tubes":           cmdListTubes,
@@ -60,8 +81,12 @@ var (
 		"peek-delayed":         cmdPeekDelayed,
 		"peek":                 cmdPeek,
 		"peek-ready":           cmdPeekReady,
+		"promote":              cmdPromote,
 		"put":                  cmdPut,
 		"quit":                 cmdQuit,
+		"raft":                 cmdRaft,
+		"release":              cmdRelease,
+		"replicate":            cmdReplicate,
 		"reserve":              cmdReserve,
 		"reserve-with-timeout": cmdReserveWithTimeout,
 		"stats-job":            cmdStatsJob,
@@ -71,14 +96,43 @@ var (
 		"use":                  cmdUse,
 		"watch":                cmdWatch,
 	}
+
+	// commands a replica refuses, as they would change its jobs.
+	writeCommands = map[string]bool{
+		"bury":                 true,
+		"delete":               true,
+		"kick":                 true,
+		"pause-tube":           true,
+		"release":              true,
+		"replicate":            true,
+		"reserve":              true,
+		"reserve-with-timeout": true,
+		"touch":                true,
+	}
 )
 
+// logs the client in as a user of the auth file. Passwords can't contain
+// whitespace, as arguments are separated by it.
+func cmdAuth(client *client, args args) (response string) {
+	atomic.AddInt64(&client.server.stats.CmdAuth, 1)
+
+	name := args.get(0)
+	password := args.get(1)
+
+	user := client.server.authenticate(name, password)
+	if user == nil {
+		return MSG_UNAUTHORIZED
+	}
+
+	client.user = user
+	return MSG_AUTHENTICATED
+}
+
 func cmdBury(client *client, args args) (response string) {
 	atomic.AddInt64(&client.server.stats.CmdBury, 1)
 
-	job, found := client.server.jobs[args.getJobId(0)]
-	if found && job.state == jobReservedState && job.client == client {
-		job.bury()
+	job, found := client.server.findJob(args.getJobId(0))
+	if found && job.buryBy(client) {
 		return MSG_BURIED
 	}
 
@@ -88,25 +142,35 @@ func cmdBury(client *client, args args) (response string) {
 func cmdDelete(client *client, args args) (response string) {
 	atomic.AddInt64(&client.server.stats.CmdDelete, 1)
 
-	job, found := client.server.jobs[args.getJobId(0)]
+	job, found := client.server.findJob(args.getJobId(0))
 	if !found {
 		return MSG_NOT_FOUND
 	}
 
-	switch job.state {
-	case jobReservedState:
-		if job.client == client {
-			job.deleteFrom(client.server)
-			return MSG_DELETED
-		}
-	case jobBuriedState, jobDelayedState, jobReadyState:
-		job.deleteFrom(client.server)
+	// jobs reserved by others or not at all take admin rights.
+	_, reserved := client.reservedPriority(job)
+	if !reserved && !client.may(RIGHT_ADMIN, job.tube.name) {
+		return MSG_UNAUTHORIZED
+	}
+
+	if job.deleteBy(client) {
 		return MSG_DELETED
 	}
 
 	return MSG_NOT_FOUND
 }
 
+func cmdDrain(client *client, args args) (response string) {
+	atomic.AddInt64(&client.server.stats.CmdDrain, 1)
+
+	if !client.mayAdministrate() {
+		return MSG_UNAUTHORIZED
+	}
+
+	client.server.drain()
+	return MSG_DRAINING
+}
+
 func cmdIgnore(client *client, args args) (response string) {
 	atomic.AddInt64(&client.server.stats.CmdIgnore, 1)
 
@@ -123,26 +187,18 @@ func cmdKick(client *client, args args) (response string) {
 	atomic.AddInt64(&client.server.stats.CmdKick, 1)
 	bound := args.getUint(0)
 
-	jobKick := &jobKickRequest{
-		bound:   int(bound),
-		success: make(chan int),
+	if !client.may(RIGHT_ADMIN, client.usedTube.name) {
+		return MSG_UNAUTHORIZED
 	}
 
-	client.usedTube.jobKick <- jobKick
-	actual := <-jobKick.success
-
+	actual := client.usedTube.kickUpTo(int(bound))
 	return fmt.Sprintf("KICKED %d\r\n", actual)
 }
 
 func cmdListTubes(client *client, args args) (response string) {
 	atomic.AddInt64(&client.server.stats.CmdListTubes, 1)
 
-	list := make([]string, 0)
-	for key := range client.server.tubes {
-		list = append(list, key)
-	}
-
-	yaml, err := toYaml(list)
+	yaml, err := toYaml(client.server.tubeNames())
 	if err != nil {
 		p(err)
 		return MSG_INTERNAL_ERROR
@@ -175,25 +231,32 @@ func cmdListTubeUsed(client *client, args args) (response string) {
 func cmdPauseTube(client *client, args args) (response string) {
 	atomic.AddInt64(&client.server.stats.CmdPauseTube, 1)
 
-	tube, found := client.server.findTube(args.getName(0))
+	name := args.getName(0)
+	delay := args.getInt(1)
+
+	if !client.may(RIGHT_ADMIN, name) {
+		return MSG_UNAUTHORIZED
+	}
+
+	tube, found := client.server.findTube(name)
 	if !found {
 		return MSG_NOT_FOUND
 	}
 
-	delay := args.getInt(1)
-	tube.tubePause <- time.Duration(delay) * time.Second
-	return MSG_PAUSED
+	if tube.pauseFor(time.Duration(delay) * time.Second) {
+		return MSG_PAUSED
+	}
+	return MSG_NOT_FOUND
 }
 
 func peekByState(client *client, state string) string {
-	request := &jobPeekRequest{
-		state:   state,
-		success: make(chan *job),
+	if !client.may(RIGHT_RESERVE, client.usedTube.name) {
+		return MSG_UNAUTHORIZED
 	}
-	client.usedTube.jobPeek <- request
-	job := <-request.success
+
+	job := client.usedTube.peekFirst(state)
 	if job != nil {
-		return fmt.Sprintf(MSG_PEEK_FOUND, job.id, len(job.body), job.body)
+		return client.writeJob(MSG_PEEK_FOUND, job)
 	}
 	return MSG_NOT_FOUND
 }
@@ -202,8 +265,11 @@ func cmdPeek(client *client, args args) (response string) {
 	atomic.AddInt64(&client.server.stats.CmdPeek, 1)
 	job, found := client.server.findJob(args.getJobId(0))
 
+	if found && !client.may(RIGHT_RESERVE, job.tube.name) {
+		return MSG_UNAUTHORIZED
+	}
 	if found {
-		return fmt.Sprintf(MSG_PEEK_FOUND, job.id, len(job.body), job.body)
+		return client.writeJob(MSG_PEEK_FOUND, job)
 	}
 	return MSG_NOT_FOUND
 }
@@ -226,69 +292,122 @@ func cmdPeekReady(client *client, args args) (response string) {
 func cmdPut(client *client, args args) (response string) {
 	atomic.AddInt64(&client.server.stats.CmdPut, 1)
 
-	priority := uint32(args.getInt(0))
-	if priority < 0 {
-		priority = 0
-	} else if priority > 4294967295 {
-		priority = 4294967295
-	}
+	priority := args.getPriority(0)
 	delay := args.getInt(1)
 	ttr := args.getInt(2)
-	if ttr < 1 {
-		ttr = 1
-	}
 	bodySize := args.getInt(3)
 
-	if bodySize > JOB_DATA_SIZE_LIMIT {
+	if bodySize < 0 {
+		return MSG_BAD_FORMAT
+	}
+
+	if bodySize > int64(client.server.config.MaxJobSize) {
+		// skip the body and its CRLF so the next command is read right.
+		_, err := io.CopyN(ioutil.Discard, client.reader, bodySize+2)
+		if err != nil {
+			pf("io.CopyN : %#v", err)
+		}
 		return MSG_JOB_TOO_BIG
 	}
 
+	// the client hung up before sending the whole job if reading fails, so
+	// there is nobody left to answer.
 	body := make([]byte, bodySize)
 	_, err := io.ReadFull(client.reader, body)
 	if err != nil {
 		pf("io.ReadFull : %#v", err)
-		return MSG_INTERNAL_ERROR
+		return ""
 	}
 	rn := make([]byte, 2)
-	_, err = io.ReadAtLeast(client.reader, rn, 2)
+	_, err = io.ReadFull(client.reader, rn)
 	if err != nil {
-		if err.Error() == "ErrUnexpextedEOF" {
-			return MSG_EXPECTED_CRLF
-		} else {
-			pf("io.ReadAtLeast : %#v", err)
-			return MSG_INTERNAL_ERROR
-		}
+		pf("io.ReadFull : %#v", err)
+		return ""
 	}
 
 	if rn[0] != '\r' || rn[1] != '\n' {
 		return MSG_EXPECTED_CRLF
 	}
 
-	tube := client.usedTube
+	if !client.may(RIGHT_PUT, client.usedTube.name) {
+		return MSG_UNAUTHORIZED
+	}
 
-	id := <-client.server.getJobId
-	job := newJob(id, priority, delay, ttr, body)
+	// the body is read first so the connection stays in sync.
+	job, response := client.server.put(client.usedTube, priority, delay, ttr, body)
+	if job == nil {
+		return response
+	}
 
-	tube.jobSupply <- job
-	client.server.jobs[job.id] = job
-	client.isProducer = true
-	return fmt.Sprintf("INSERTED %d\r\n", job.id)
+	client.becomeProducer()
+	return fmt.Sprintf(MSG_INSERTED, job.id)
+}
+
+// turns a replica into a primary. Promoting a primary does nothing.
+func cmdPromote(client *client, args args) (response string) {
+	atomic.AddInt64(&client.server.stats.CmdPromote, 1)
+
+	if !client.mayAdministrate() {
+		return MSG_UNAUTHORIZED
+	}
+
+	client.server.promote()
+	return MSG_PROMOTED
 }
 
 func cmdQuit(client *client, args args) (response string) {
 	atomic.AddInt64(&client.server.stats.CmdQuit, 1)
+	// answers to commands pipelined before quit may still be buffered.
+	client.writer.Flush()
+	client.conn.Close()
+	return ""
+}
+
+// turns the connection into one carrying the calls of another node of the
+// cluster. The connection is closed once the node hangs up.
+func cmdRaft(client *client, args args) (response string) {
+	atomic.AddInt64(&client.server.stats.CmdRaft, 1)
+
+	if !client.mayAdministrate() {
+		return MSG_UNAUTHORIZED
+	}
+	if client.server.cluster == nil {
+		return MSG_UNKNOWN_COMMAND
+	}
+
+	err := client.server.cluster.serve(client)
+	if err != nil {
+		pf("raft: %v", err)
+	}
 	client.conn.Close()
 	return ""
 }
 
-func reserveCommon(c *client, args args) *jobReserveRequest {
+func cmdRelease(client *client, args args) (response string) {
+	atomic.AddInt64(&client.server.stats.CmdRelease, 1)
+
+	id := args.getJobId(0)
+	priority := args.getPriority(1)
+	delay := args.getInt(2)
+
+	job, found := client.server.findJob(id)
+	if !found {
+		return MSG_NOT_FOUND
+	}
+
+	return job.release(client, priority, delay)
+}
+
+// asks every one of tubes for a job reserved by owner, the first tube to hand
+// one out wins.
+func reserveCommon(owner *client, tubes map[string]*tube) *jobReserveRequest {
 	request := &jobReserveRequest{
-		client:  c,
+		client:  owner,
 		success: make(chan *job),
 		cancel:  make(chan bool, 1),
 	}
 
-	for _, watchedTube := range c.watchedTubes {
+	for _, watchedTube := range tubes {
 		go func(t *tube, r *jobReserveRequest) {
 			select {
 			case t.jobDemand <- r:
@@ -301,14 +420,32 @@ func reserveCommon(c *client, args args) *jobReserveRequest {
 	return request
 }
 
+// turns the connection into a stream of the jobs of the server and their
+// changes, for a replica. The connection is closed once the stream ends.
+func cmdReplicate(client *client, args args) (response string) {
+	atomic.AddInt64(&client.server.stats.CmdReplicate, 1)
+
+	if !client.mayAdministrate() {
+		return MSG_UNAUTHORIZED
+	}
+
+	err := client.server.replicateTo(client)
+	if err != nil {
+		pf("replicate: %v", err)
+	}
+	client.conn.Close()
+	return ""
+}
+
 func cmdReserve(client *client, args args) (response string) {
 	atomic.AddInt64(&client.server.stats.CmdReserve, 1)
 
-	client.isWorker = true
-	request := reserveCommon(client, args)
-	job := <-request.success
-	request.cancel <- true
-	return fmt.Sprintf(MSG_RESERVED, job.id, len(job.body), job.body)
+	if !client.mayReserve() {
+		return MSG_UNAUTHORIZED
+	}
+
+	client.becomeWorker()
+	return waitForJob(client, nil)
 }
 
 func cmdReserveWithTimeout(client *client, args args) (response string) {
@@ -319,19 +456,47 @@ func cmdReserveWithTimeout(client *client, args args) (response string) {
 		seconds = 0
 	}
 
-	client.isWorker = true
-	request := reserveCommon(client, args)
-
-	select {
-	case job := <-request.success:
-		response = fmt.Sprintf(MSG_RESERVED, job.id, len(job.body), job.body)
-		request.cancel <- true
-	case <-time.After(time.Duration(seconds) * time.Second):
-		response = MSG_TIMED_OUT
-		request.cancel <- true
+	if !client.mayReserve() {
+		return MSG_UNAUTHORIZED
 	}
 
-	return response
+	client.becomeWorker()
+	return waitForJob(client, time.After(time.Duration(seconds)*time.Second))
+}
+
+// waits until one of the watched tubes hands out a job, a job reserved by the
+// client runs out, or timeout fires.
+func waitForJob(client *client, timeout <-chan time.Time) (response string) {
+	// taken first, so the job about to be reserved doesn't count. A job held
+	// inside the safety margin already is answered with DEADLINE_SOON right
+	// away, unless a job is ready, as beanstalkd does.
+	deadline, soon := client.deadlineSoon()
+	if soon && !client.hasReadyJob() {
+		return MSG_DEADLINE_SOON
+	}
+	flush := client.flushSoon()
+
+	client.addWaiting(1)
+	defer client.addWaiting(-1)
+
+	request := reserveCommon(client, client.watchedTubes)
+	defer func() { request.cancel <- true }()
+
+	for {
+		select {
+		case job := <-request.success:
+			return client.writeJob(MSG_RESERVED, job)
+		case <-deadline:
+			return MSG_DEADLINE_SOON
+		case <-timeout:
+			return MSG_TIMED_OUT
+		case <-client.server.quit:
+			return ""
+		case <-flush:
+			client.writer.Flush()
+			flush = nil
+		}
+	}
 }
 
 func cmdStats(client *client, args args) (response string) {
@@ -352,25 +517,15 @@ func cmdStatsJob(client *client, args args) (response string) {
 	atomic.AddInt64(&client.server.stats.CmdStatsJob, 1)
 
 	job, found := client.server.findJob(args.getJobId(0))
+	if found {
+		job = job.snapshot()
+	}
 
-	if !found {
+	if job == nil {
 		return MSG_NOT_FOUND
 	}
 
-	stats := &map[string]interface{}{
-		"id":        job.id,
-		"tube":      job.tube.name,
-		"state":     job.state,
-		"pri":       job.priority,
-		"age":       time.Since(job.createdAt),
-		"time-left": job.timeLeft().Seconds(),
-		"file":      0, // TODO
-		"reserves":  job.reserveCount,
-		"releases":  job.releaseCount,
-		"timeouts":  job.timeoutCount,
-		"buries":    job.buryCount,
-		"kicks":     job.kickCount,
-	}
+	stats := client.server.jobStatistics(job)
 
 	yaml, err := toYaml(stats)
 	if err != nil {
@@ -403,13 +558,11 @@ func cmdTouch(client *client, args args) (response string) {
 	atomic.AddInt64(&client.server.stats.CmdTouch, 1)
 
 	job, found := client.server.findJob(args.getJobId(0))
-
-	if !found {
-		return MSG_NOT_FOUND
+	if found && job.touchBy(client) {
+		return MSG_TOUCHED
 	}
 
-	job.touch()
-	return MSG_TOUCHED
+	return MSG_NOT_FOUND
 }
 
 func cmdUse(client *client, args args) (response string) {
@@ -417,7 +570,7 @@ func cmdUse(client *client, args args) (response string) {
 
 	name := args.getName(0)
 
-	client.usedTube = client.server.findOrCreateTube(name)
+	client.useTube(name)
 	return fmt.Sprintf("USING %s\r\n", name)
 }
 
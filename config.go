@@ -0,0 +1,175 @@
+package gostalk
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds everything a server can be tuned with. The zero value is not
+// useful, start from DefaultConfig instead.
+type Config struct {
+	// host and port to listen on, or an address like those in Listen.
+	Addr string `yaml:"addr"`
+	// more addresses to listen on, all served by the same server. Each is
+	// tcp://host:port, tls://host:port or unix:///path/to/socket.
+	Listen []string `yaml:"listen"`
+	// permissions of the unix sockets listened on, like 0660. Zero leaves
+	// them to the umask.
+	SocketMode os.FileMode `yaml:"socket-mode"`
+	// PEM files with the certificate and key to serve TLS with. Addr is
+	// served with TLS if they are given, unless it starts with tcp://.
+	TLSCert string `yaml:"tls-cert"`
+	TLSKey  string `yaml:"tls-key"`
+	// PEM file with the CAs that have to have signed the certificates clients
+	// present. Clients aren't asked for certificates if this is empty.
+	TLSClientCA string `yaml:"tls-client-ca"`
+	// YAML file with the users that may connect and their rights on tubes,
+	// anybody may do anything if it's empty. HTTP requests sign in as them
+	// with HTTP Basic.
+	AuthFile string `yaml:"auth-file"`
+	// address of the primary to replicate, a host and port or an address
+	// like those in Listen. It is dialed with TLS if it starts with tls://.
+	// A replica only serves commands that don't change jobs until promoted.
+	ReplicaOf string `yaml:"replica-of"`
+	// address the other nodes of a cluster reach this one at, like ReplicaOf.
+	// Setting it makes the server a node of the cluster of ClusterPeers, which
+	// elect a leader to take the commands that change jobs. The others answer
+	// those with NOT_LEADER and the address of the leader. HTTP requests that
+	// change jobs are refused by followers too. The leader answers commands
+	// and HTTP requests once the cluster committed what they changed. A node
+	// keeps its log in BinlogDir, which it needs.
+	ClusterAddr string `yaml:"cluster-addr"`
+	// cluster-addr of the other nodes of the cluster.
+	ClusterPeers []string `yaml:"cluster-peers"`
+	// user and password to authenticate with at the primary or the other
+	// nodes of the cluster, which need to grant admin rights on all tubes.
+	ReplicaUser     string `yaml:"replica-user"`
+	ReplicaPassword string `yaml:"replica-password"`
+	// PEM file with the CAs that signed the certificates of the primary or the
+	// other nodes when they are dialed with tls://, the system's CAs if it's
+	// empty.
+	ReplicaCA string `yaml:"replica-ca"`
+	// PEM files with the certificate and key to present to them, for those
+	// that ask for client certificates.
+	ReplicaCert string `yaml:"replica-cert"`
+	ReplicaKey  string `yaml:"replica-key"`
+	// host and port to serve the dashboard, Prometheus metrics and the JSON
+	// gateway on, empty to not serve HTTP at all.
+	HTTPAddr string `yaml:"http-addr"`
+	// largest job body in bytes that put accepts.
+	MaxJobSize int `yaml:"max-job-size"`
+	// bytes the bodies of all jobs plus their bookkeeping may take, put
+	// answers OUT_OF_MEMORY beyond that. Zero is unlimited.
+	MaxMemory int64 `yaml:"max-memory"`
+	// the same budget for the jobs of every single tube.
+	MaxTubeMemory int64 `yaml:"max-tube-memory"`
+	// directory the binlog is written to. Jobs are only kept in memory if this
+	// is empty.
+	BinlogDir string `yaml:"binlog-dir"`
+	// size in bytes at which the binlog starts writing to a new file.
+	BinlogMaxSize int64 `yaml:"binlog-max-size"`
+	// the most time that may pass between writing to the binlog and syncing
+	// it to disk. Zero syncs after every write, a negative interval never
+	// syncs.
+	BinlogFsyncInterval time.Duration `yaml:"binlog-fsync-interval"`
+	// user Start switches to once the server is listening, empty to stay as
+	// is.
+	User string `yaml:"user"`
+	// log connections and errors.
+	Verbose bool `yaml:"verbose"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Addr:          "127.0.0.1:40400",
+		MaxJobSize:    (1 << 16) - 1,
+		BinlogMaxSize: 10 << 20,
+	}
+}
+
+// reads a YAML config file on top of the defaults, so the file only has to
+// mention what it changes.
+func ReadConfigFile(path string) (Config, error) {
+	config := DefaultConfig()
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	err = yaml.Unmarshal(content, &config)
+	return config, err
+}
+
+// loads the certificates named in the config, returns nil if it doesn't ask
+// for TLS.
+func (config Config) tlsConfig() (*tls.Config, error) {
+	if config.TLSCert == "" && config.TLSKey == "" {
+		if config.TLSClientCA != "" {
+			return nil, errors.New("gostalk: tls-client-ca needs tls-cert and tls-key")
+		}
+		return nil, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if config.TLSClientCA != "" {
+		content, err := ioutil.ReadFile(config.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("gostalk: no certificates in %s", config.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// loads the certificates to dial the primary or the other nodes of a cluster
+// with over tls://.
+func (config Config) dialTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.ReplicaCert != "" || config.ReplicaKey != "" {
+		certificate, err := tls.LoadX509KeyPair(config.ReplicaCert, config.ReplicaKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	if config.ReplicaCA != "" {
+		content, err := ioutil.ReadFile(config.ReplicaCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("gostalk: no certificates in %s", config.ReplicaCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,230 @@
+package gostalk
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/manveru/gobdd"
+)
+
+// writes name.pem and name-key.pem to dir, holding a certificate for
+// 127.0.0.1 signed by parent, or by itself if parent is nil.
+func writeCertificate(dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err, ToBeNil)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	Expect(err, ToBeNil)
+	certificate, err := x509.ParseCertificate(der)
+	Expect(err, ToBeNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err, ToBeNil)
+
+	err = ioutil.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	Expect(err, ToBeNil)
+	err = ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	Expect(err, ToBeNil)
+	return certificate, key
+}
+
+// loads the certificate written by writeCertificate for clients to present.
+func loadCertificate(dir, name string) tls.Certificate {
+	certificate, err := tls.LoadX509KeyPair(filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem"))
+	Expect(err, ToBeNil)
+	return certificate
+}
+
+func init() {
+	defer PrintSpecReport()
+
+	Describe("ReadConfigFile", func() {
+		file, err := ioutil.TempFile("", "gostalk-config")
+		Expect(err, ToBeNil)
+		defer os.Remove(file.Name())
+
+		_, err = file.WriteString("addr: 0.0.0.0:11300\nmax-job-size: 1024\nbinlog-fsync-interval: 50ms\n")
+		Expect(err, ToBeNil)
+		file.Close()
+
+		config, err := ReadConfigFile(file.Name())
+
+		It("reads the values in the file", func() {
+			Expect(err, ToBeNil)
+			Expect(config.Addr, ToEqual, "0.0.0.0:11300")
+			Expect(config.MaxJobSize, ToEqual, 1024)
+			Expect(config.BinlogFsyncInterval, ToEqual, 50*time.Millisecond)
+		})
+
+		It("keeps the defaults for everything else", func() {
+			Expect(config.BinlogMaxSize, ToEqual, DefaultConfig().BinlogMaxSize)
+			Expect(config.BinlogDir, ToEqual, "")
+		})
+
+		It("fails for missing files", func() {
+			_, err := ReadConfigFile(file.Name() + "-missing")
+			Expect(err == nil, ToEqual, false)
+		})
+	})
+
+	Describe("tlsConfig", func() {
+		dir, err := ioutil.TempDir("", "gostalk-tls")
+		Expect(err, ToBeNil)
+		defer os.RemoveAll(dir)
+		ca, caKey := writeCertificate(dir, "ca", nil, nil)
+		writeCertificate(dir, "server", ca, caKey)
+
+		It("is nil without a certificate", func() {
+			tlsConfig, err := DefaultConfig().tlsConfig()
+			Expect(err, ToBeNil)
+			Expect(tlsConfig == nil, ToEqual, true)
+		})
+
+		It("loads the certificate and key", func() {
+			config := DefaultConfig()
+			config.TLSCert = filepath.Join(dir, "server.pem")
+			config.TLSKey = filepath.Join(dir, "server-key.pem")
+			tlsConfig, err := config.tlsConfig()
+			Expect(err, ToBeNil)
+			Expect(len(tlsConfig.Certificates), ToEqual, 1)
+			Expect(tlsConfig.ClientAuth, ToEqual, tls.NoClientCert)
+		})
+
+		It("requires client certificates given a CA", func() {
+			config := DefaultConfig()
+			config.TLSCert = filepath.Join(dir, "server.pem")
+			config.TLSKey = filepath.Join(dir, "server-key.pem")
+			config.TLSClientCA = filepath.Join(dir, "ca.pem")
+			tlsConfig, err := config.tlsConfig()
+			Expect(err, ToBeNil)
+			Expect(tlsConfig.ClientAuth, ToEqual, tls.RequireAndVerifyClientCert)
+		})
+
+		It("fails for missing or unusable files", func() {
+			config := DefaultConfig()
+			config.TLSCert = filepath.Join(dir, "missing.pem")
+			config.TLSKey = filepath.Join(dir, "server-key.pem")
+			_, err := New(config)
+			Expect(err == nil, ToEqual, false)
+
+			config.TLSCert = filepath.Join(dir, "server.pem")
+			config.TLSClientCA = filepath.Join(dir, "server-key.pem")
+			_, err = config.tlsConfig()
+			Expect(err == nil, ToEqual, false)
+
+			config = DefaultConfig()
+			config.TLSClientCA = filepath.Join(dir, "ca.pem")
+			_, err = config.tlsConfig()
+			Expect(err == nil, ToEqual, false)
+		})
+	})
+
+	Describe("Config", func() {
+		config := DefaultConfig()
+		config.MaxJobSize = 4
+		_, addr := startServer(config)
+
+		It("limits the job size per server", func() {
+			conn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+			Expect(err, ToBeNil)
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+
+			sendCommand(conn, "put 0 0 60 4\r\nfour")
+			Expect(readResponseWithoutBody(reader), ToEqual, "INSERTED 0")
+			sendCommand(conn, "put 0 0 60 5\r\nfives")
+			Expect(readResponseWithoutBody(reader), ToEqual, "JOB_TOO_BIG")
+		})
+
+		It("reports the job size limit in stats", func() {
+			conn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+			Expect(err, ToBeNil)
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+
+			var stats map[string]interface{}
+			sendCommand(conn, "stats")
+			readResponseWithBody(reader, &stats)
+			Expect(stats["max-job-size"], ToEqual, 4)
+		})
+	})
+	Describe("memory budget", func() {
+		config := DefaultConfig()
+		config.MaxMemory = 2*jobOverhead + 8
+		config.MaxTubeMemory = jobOverhead + 4
+		_, addr := startServer(config)
+
+		conn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+		Expect(err, ToBeNil)
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		It("answers OUT_OF_MEMORY once a tube is full", func() {
+			sendCommand(conn, "use first")
+			readResponseWithoutBody(reader)
+			sendCommand(conn, "put 0 0 60 4\r\nfour")
+			Expect(readResponseWithoutBody(reader), ToEqual, "INSERTED 0")
+			sendCommand(conn, "put 0 0 60 1\r\na")
+			Expect(readResponseWithoutBody(reader), ToEqual, "OUT_OF_MEMORY")
+		})
+
+		It("answers OUT_OF_MEMORY once the server is full", func() {
+			sendCommand(conn, "use second")
+			readResponseWithoutBody(reader)
+			sendCommand(conn, "put 0 0 60 4\r\nfour")
+			Expect(readResponseWithoutBody(reader), ToEqual, "INSERTED 1")
+			sendCommand(conn, "use third")
+			readResponseWithoutBody(reader)
+			sendCommand(conn, "put 0 0 60 1\r\na")
+			Expect(readResponseWithoutBody(reader), ToEqual, "OUT_OF_MEMORY")
+		})
+
+		It("reports the memory in stats and stats-tube", func() {
+			var stats map[string]interface{}
+			sendCommand(conn, "stats")
+			readResponseWithBody(reader, &stats)
+			Expect(stats["current-memory-bytes"], ToEqual, int(2*jobOverhead+8))
+			Expect(stats["max-memory-bytes"], ToEqual, int(config.MaxMemory))
+
+			var tubeStats map[string]interface{}
+			sendCommand(conn, "stats-tube first")
+			readResponseWithBody(reader, &tubeStats)
+			Expect(tubeStats["current-memory-bytes"], ToEqual, int(jobOverhead+4))
+			Expect(tubeStats["max-memory-bytes"], ToEqual, int(config.MaxTubeMemory))
+		})
+
+		It("makes room again when jobs are deleted", func() {
+			sendCommand(conn, "delete 0")
+			Expect(readResponseWithoutBody(reader), ToEqual, "DELETED")
+			sendCommand(conn, "put 0 0 60 1\r\na")
+			Expect(readResponseWithoutBody(reader), ToEqual, "INSERTED 2")
+		})
+	})
+}
@@ -0,0 +1,25 @@
+package gostalk
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// the dashboard is a single page without external assets, so it works where
+// nothing but the server can be reached. It talks to the gateway.
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+func (server *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardPage)
+}
@@ -0,0 +1,52 @@
+package gostalk
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/manveru/gobdd"
+)
+
+func init() {
+	defer PrintSpecReport()
+
+	Describe("dashboard", func() {
+		server, _ := startServer(DefaultConfig())
+		web := httptest.NewServer(server.Handler())
+		defer web.Close()
+
+		response, err := http.Get(web.URL + "/")
+		Expect(err, ToBeNil)
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		Expect(err, ToBeNil)
+		page := string(body)
+
+		It("is served at the root", func() {
+			Expect(response.StatusCode, ToEqual, http.StatusOK)
+			Expect(response.Header.Get("Content-Type"), ToEqual, "text/html; charset=utf-8")
+			Expect(strings.Contains(page, "<title>gostalk</title>"), ToEqual, true)
+		})
+
+		It("needs nothing but the server", func() {
+			Expect(strings.Contains(page, "src="), ToEqual, false)
+			Expect(strings.Contains(page, "href="), ToEqual, false)
+			Expect(strings.Contains(page, "//"+"cdn"), ToEqual, false)
+		})
+
+		It("uses the gateway", func() {
+			for _, path := range []string{`"/stats"`, `"/tubes"`, `"/tubes/" + name + "/peek-"`, `/kick?bound=`, `/pause?delay=`, `"/jobs/"`} {
+				Expect(strings.Contains(page, path), ToEqual, true)
+			}
+		})
+
+		It("leaves other paths alone", func() {
+			response, err := http.Get(web.URL + "/nothing")
+			Expect(err, ToBeNil)
+			response.Body.Close()
+			Expect(response.StatusCode, ToEqual, http.StatusNotFound)
+		})
+	})
+}
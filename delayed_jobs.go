@@ -1,46 +1,84 @@
 package gostalk
 
 import (
+	"code.google.com/p/go-priority-queue/prio"
 	"time"
 )
 
+type delayedJobsItem job
+
+func (i *delayedJobsItem) Less(j prio.Interface) bool {
+	return i.delayEndsAt.Before(j.(*delayedJobsItem).delayEndsAt)
+}
+
+func (i *delayedJobsItem) Index(n int) {
+	i.index = n
+}
+
 type delayedJobs struct {
-	amount int
+	prio.Queue
 }
 
 func newDelayedJobs() (jobs *delayedJobs) {
-	return &delayedJobs{
-		amount: 0,
-	}
+	return &delayedJobs{}
 }
 
-func (jobs *delayedJobs) Len() int {
-	return jobs.amount
+func (jobs *delayedJobs) getJob() (j *job) {
+	j = (*job)(jobs.Pop().(*delayedJobsItem))
+	j.jobHolder = nil
+	return
 }
 
-func (jobs *delayedJobs) putJob(job *job, afterFunc func()) {
-	duration := job.delayEndsAt.Sub(time.Now())
-	job.jobHolder = jobs
-	job.timer = time.AfterFunc(duration, afterFunc)
+func (jobs *delayedJobs) peek() *job {
+	return (*job)(jobs.Peek().(*delayedJobsItem))
 }
 
-func (jobs *delayedJobs) buryJob(job *job) {
-	job.timer.Stop()
-	job.tube.buried.putJob(job)
+// returns a channel that receives once the shortest delay runs out, or nil if
+// there are no delayed jobs.
+func (jobs *delayedJobs) expiry() <-chan time.Time {
+	if jobs.Len() == 0 {
+		return nil
+	}
+
+	return time.After(jobs.peek().delayEndsAt.Sub(time.Now()))
 }
 
-func (jobs *delayedJobs) deleteJob(job *job) {
-	job.timer.Stop()
+func (jobs *delayedJobs) putJob(j *job) {
+	j.jobHolder = jobs
+	j.state = jobDelayedState
+	jobs.Push((*delayedJobsItem)(j))
 }
 
-func (jobs *delayedJobs) touchJob(job *job) {}
+func (jobs *delayedJobs) buryJob(j *job) {
+	jobs.deleteJob(j)
+	j.tube.buried.putJob(j)
+}
+
+func (jobs *delayedJobs) deleteJob(j *job) {
+	jobs.Remove(j.index)
+	j.jobHolder = nil
+}
+
+func (jobs *delayedJobs) touchJob(j *job) {}
+
+// moves up to bound jobs into the ready queue, the ones with the least delay
+// left first.
+func (jobs *delayedJobs) kickJobs(bound int) (kicked []*job) {
+	for bound > 0 && jobs.Len() > 0 {
+		job := jobs.getJob()
+		job.tube.ready.putJob(job)
+		kicked = append(kicked, job)
+		bound -= 1
+	}
 
-// TODO: implement!
-func (jobs *delayedJobs) kickJobs(bound int) (actual int) {
 	return
 }
 
-// TODO: implement!
 func (jobs *delayedJobs) peekJob(request *jobPeekRequest) {
-	request.success <- nil
+	if jobs.Len() == 0 {
+		request.success <- nil
+		return
+	}
+
+	request.success <- jobs.peek()
 }
@@ -0,0 +1,53 @@
+package gostalk
+
+import (
+	. "github.com/manveru/gobdd"
+)
+
+func init() {
+	defer PrintSpecReport()
+
+	Describe("delayedJobs", func() {
+		jobs := newDelayedJobs()
+		job := newJob(1, 1, 1, 1, []byte("bazbar"))
+
+		It("stores jobs", func() {
+			jobs.putJob(job)
+			Expect(jobs.Len(), ToEqual, 1)
+			Expect(job.state, ToEqual, jobDelayedState)
+		})
+
+		It("retrieves jobs", func() {
+			Expect(jobs.getJob(), ToDeepEqual, job)
+		})
+
+		It("has nothing to expire when empty", func() {
+			Expect(jobs.expiry() == nil, ToEqual, true)
+		})
+
+		It("orders jobs by delay left, lowest first", func() {
+			a := newJob(1, 0, 100, 0, []byte("a"))
+			b := newJob(2, 0, 25, 0, []byte("b"))
+			c := newJob(3, 0, 50, 0, []byte("c"))
+			jobs.putJob(c)
+			jobs.putJob(a)
+			jobs.putJob(b)
+			Expect(jobs.getJob(), ToDeepEqual, b)
+			Expect(jobs.getJob(), ToDeepEqual, c)
+			Expect(jobs.getJob(), ToDeepEqual, a)
+		})
+
+		It("removes jobs from the middle", func() {
+			a := newJob(1, 0, 100, 0, []byte("a"))
+			b := newJob(2, 0, 25, 0, []byte("b"))
+			c := newJob(3, 0, 50, 0, []byte("c"))
+			jobs.putJob(c)
+			jobs.putJob(a)
+			jobs.putJob(b)
+			jobs.deleteJob(c)
+			Expect(jobs.Len(), ToEqual, 2)
+			Expect(jobs.getJob(), ToDeepEqual, b)
+			Expect(jobs.getJob(), ToDeepEqual, a)
+		})
+	})
+}
@@ -0,0 +1,580 @@
+package gostalk
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The gateway offers the commands producers and workers need as JSON over
+// HTTP, for clients that can't keep a connection open:
+//
+//   POST   /tubes/{tube}/jobs             put, {"body", "priority", "delay", "ttr"}
+//   POST   /tubes/{tube}/reserve?timeout= reserve, waiting at most timeout seconds
+//   DELETE /jobs/{id}                     delete
+//   POST   /jobs/{id}/release             release, {"priority", "delay"}
+//   POST   /jobs/{id}/bury                bury
+//   POST   /jobs/{id}/touch               touch
+//   GET    /stats                         stats
+//   GET    /tubes                         stats-tube of every tube
+//   GET    /tubes/{tube}/stats            stats-tube
+//   GET    /tubes/{tube}/peek-{state}     peek-ready, peek-delayed or peek-buried
+//   POST   /tubes/{tube}/kick?bound=      kick
+//   POST   /tubes/{tube}/pause?delay=     pause-tube
+//
+// Bodies are JSON strings, which can't hold bytes that aren't UTF-8. Put,
+// reserve and peek take ?encoding=base64 to carry any body in base64 instead.
+//
+// Jobs reserved through the gateway are held for the user that reserved them,
+// as if each user had a connection of their own. Without an auth file any
+// request may work on them.
+//
+// With an auth file, requests sign in with HTTP Basic and are granted what
+// the user would be granted over a connection. Working on jobs the gateway
+// reserved for the user takes the right to reserve from their tube, other
+// jobs take admin.
+
+// what a job is put with, fields left out keep these defaults.
+type gatewayPut struct {
+	Body     string `json:"body"`
+	Priority uint32 `json:"priority"`
+	Delay    int64  `json:"delay"`
+	TTR      int64  `json:"ttr"`
+}
+
+type gatewayRelease struct {
+	Priority *uint32 `json:"priority"`
+	Delay    int64   `json:"delay"`
+}
+
+type gatewayJob struct {
+	Id       jobId                  `json:"id"`
+	Body     string                 `json:"body,omitempty"`
+	Encoding string                 `json:"encoding,omitempty"`
+	Stats    map[string]interface{} `json:"stats,omitempty"`
+}
+
+type gatewayKick struct {
+	Kicked int `json:"kicked"`
+}
+
+// the job state each peek looks at.
+var gatewayPeekStates = map[string]string{
+	"peek-ready":   jobReadyState,
+	"peek-delayed": jobDelayedState,
+	"peek-buried":  jobBuriedState,
+}
+
+type gatewayError struct {
+	Error string `json:"error"`
+}
+
+// the status each answer of the protocol turns into.
+var gatewayStatus = map[string]int{
+	MSG_BAD_FORMAT:     http.StatusBadRequest,
+	MSG_NOT_FOUND:      http.StatusNotFound,
+	MSG_JOB_TOO_BIG:    http.StatusRequestEntityTooLarge,
+	MSG_DRAINING:       http.StatusServiceUnavailable,
+	MSG_READ_ONLY:      http.StatusServiceUnavailable,
+	MSG_NOT_LEADER:     http.StatusServiceUnavailable,
+	MSG_UNAUTHORIZED:   http.StatusForbidden,
+	MSG_OUT_OF_MEMORY:  http.StatusInsufficientStorage,
+	MSG_INTERNAL_ERROR: http.StatusInternalServerError,
+	MSG_BURIED:         http.StatusInternalServerError, // a release that couldn't queue the job
+}
+
+// the client holding the jobs reserved through the gateway for the user the
+// request signed in as. It has no connection and watches no tubes, requests
+// name the tubes they work on.
+func (server *Server) gatewayClient(r *http.Request) *client {
+	user, _ := r.Context().Value(gatewayUserKey{}).(*account)
+
+	server.gatewayLock.Lock()
+	defer server.gatewayLock.Unlock()
+
+	holder, found := server.gateways[user]
+	if !found {
+		holder = &client{
+			server:       server,
+			watchedTubes: map[string]*tube{},
+			reservedJobs: map[jobId]reservation{},
+			user:         user,
+		}
+		server.gateways[user] = holder
+	}
+	return holder
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// answers like writeJSON once the changes made for the request are committed,
+// as processCommand does for commands. Answers the refusal of the cluster
+// instead if they never are.
+func (server *Server) writeCommitted(w http.ResponseWriter, status int, value interface{}) {
+	if server.cluster != nil {
+		if refusal := server.cluster.acknowledge(""); refusal != "" {
+			if refusal != MSG_INTERNAL_ERROR {
+				// the address of the leader isn't that of its HTTP server.
+				refusal = MSG_NOT_LEADER
+			}
+			writeGatewayError(w, refusal)
+			return
+		}
+	}
+	writeJSON(w, status, value)
+}
+
+// answers with the status and error matching response, one of the MSG_
+// constants.
+func writeGatewayError(w http.ResponseWriter, response string) {
+	status, found := gatewayStatus[response]
+	if !found {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, gatewayError{strings.TrimSpace(response)})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, gatewayError{"METHOD_NOT_ALLOWED"})
+	return false
+}
+
+// decodes the JSON request body into value, an empty body leaves value as is.
+func readJSON(r *http.Request, value interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(value)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// the key of the user a request signed in as in its context.
+type gatewayUserKey struct{}
+
+// passes requests on to handler once they signed in as a user of the auth
+// file, if the server has one.
+func (server *Server) requireAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server.users == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		name, password, _ := r.BasicAuth()
+		user := server.authenticate(name, password)
+		if user == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gostalk"`)
+			writeJSON(w, http.StatusUnauthorized, gatewayError{strings.TrimSpace(MSG_UNAUTHORIZED)})
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), gatewayUserKey{}, user)))
+	})
+}
+
+// answers requests whose user wasn't granted right on the tube.
+func (server *Server) refuseRight(w http.ResponseWriter, r *http.Request, right, tube string) bool {
+	if server.users == nil {
+		return false
+	}
+
+	user, _ := r.Context().Value(gatewayUserKey{}).(*account)
+	if user.may(right, tube) {
+		return false
+	}
+	writeGatewayError(w, MSG_UNAUTHORIZED)
+	return true
+}
+
+// answers requests that would change the jobs of a replica or a follower.
+func (server *Server) refuseWrites(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet {
+		return false
+	}
+
+	refusal := server.writeRefusal()
+	if refusal == "" {
+		return false
+	}
+	if server.cluster != nil {
+		// the address of the leader isn't that of its HTTP server.
+		refusal = MSG_NOT_LEADER
+	}
+	writeGatewayError(w, refusal)
+	return true
+}
+
+func (server *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	atomic.AddInt64(&server.stats.CmdStats, 1)
+	writeJSON(w, http.StatusOK, statsMap(server.statistics()))
+}
+
+// handles /tubes and everything below.
+func (server *Server) handleTubes(w http.ResponseWriter, r *http.Request) {
+	if server.refuseWrites(w, r) {
+		return
+	}
+
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/tubes"), "/")
+	if path == "" {
+		if allowMethod(w, r, http.MethodGet) {
+			server.gatewayTubes(w, r)
+		}
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	name, action := parts[0], parts[1]
+	if !NAME_CHARS.MatchString(name) {
+		writeGatewayError(w, MSG_BAD_FORMAT)
+		return
+	}
+
+	switch action {
+	case "jobs":
+		if allowMethod(w, r, http.MethodPost) && !server.refuseRight(w, r, RIGHT_PUT, name) {
+			server.gatewayPut(w, r, name)
+		}
+	case "reserve":
+		if allowMethod(w, r, http.MethodPost) && !server.refuseRight(w, r, RIGHT_RESERVE, name) {
+			server.gatewayReserve(w, r, name)
+		}
+	case "stats":
+		if allowMethod(w, r, http.MethodGet) {
+			server.gatewayTubeStats(w, r, name)
+		}
+	case "peek-ready", "peek-delayed", "peek-buried":
+		if allowMethod(w, r, http.MethodGet) && !server.refuseRight(w, r, RIGHT_RESERVE, name) {
+			server.gatewayPeek(w, r, name, gatewayPeekStates[action])
+		}
+	case "kick":
+		if allowMethod(w, r, http.MethodPost) && !server.refuseRight(w, r, RIGHT_ADMIN, name) {
+			server.gatewayKick(w, r, name)
+		}
+	case "pause":
+		if allowMethod(w, r, http.MethodPost) && !server.refuseRight(w, r, RIGHT_ADMIN, name) {
+			server.gatewayPause(w, r, name)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// reads the query parameter key as a number, missing ones are worth fallback.
+func queryUint(r *http.Request, key string, fallback uint64) (uint64, bool) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return fallback, true
+	}
+	n, err := strconv.ParseUint(value, 10, 32)
+	return n, err == nil
+}
+
+// reads the encoding of job bodies asked for with ?encoding=, empty for
+// plain text. Reports false if it's unknown.
+func queryEncoding(r *http.Request) (string, bool) {
+	encoding := r.URL.Query().Get("encoding")
+	return encoding, encoding == "" || encoding == "base64"
+}
+
+// returns the job with its body in encoding.
+func encodedJob(job *job, encoding string) gatewayJob {
+	if encoding == "base64" {
+		return gatewayJob{Id: job.id, Body: base64.StdEncoding.EncodeToString(job.body), Encoding: encoding}
+	}
+	return gatewayJob{Id: job.id, Body: string(job.body)}
+}
+
+func (server *Server) gatewayTubes(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&server.stats.CmdListTubes, 1)
+
+	tubes := server.tubeList()
+	sort.Sort(tubesByName(tubes))
+	list := make([]map[string]interface{}, 0, len(tubes))
+	for _, tube := range tubes {
+		list = append(list, statsMap(tube.statistics()))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (server *Server) gatewayTubeStats(w http.ResponseWriter, r *http.Request, name string) {
+	atomic.AddInt64(&server.stats.CmdStatsTube, 1)
+
+	tube, found := server.findTube(name)
+	if !found {
+		writeGatewayError(w, MSG_NOT_FOUND)
+		return
+	}
+	writeJSON(w, http.StatusOK, statsMap(tube.statistics()))
+}
+
+// answers with the next job to leave state in the tube and its stats.
+func (server *Server) gatewayPeek(w http.ResponseWriter, r *http.Request, name, state string) {
+	encoding, ok := queryEncoding(r)
+	if !ok {
+		writeGatewayError(w, MSG_BAD_FORMAT)
+		return
+	}
+
+	switch state {
+	case jobReadyState:
+		atomic.AddInt64(&server.stats.CmdPeekReady, 1)
+	case jobDelayedState:
+		atomic.AddInt64(&server.stats.CmdPeekDelayed, 1)
+	case jobBuriedState:
+		atomic.AddInt64(&server.stats.CmdPeekBuried, 1)
+	}
+
+	var job *job
+	if tube, found := server.findTube(name); found {
+		job = tube.peekFirst(state)
+	}
+	if job != nil {
+		job = job.snapshot()
+	}
+	if job == nil {
+		writeGatewayError(w, MSG_NOT_FOUND)
+		return
+	}
+
+	answer := encodedJob(job, encoding)
+	answer.Stats = server.jobStatistics(job)
+	server.writeCommitted(w, http.StatusOK, answer)
+}
+
+func (server *Server) gatewayKick(w http.ResponseWriter, r *http.Request, name string) {
+	atomic.AddInt64(&server.stats.CmdKick, 1)
+
+	bound, ok := queryUint(r, "bound", 1)
+	if !ok {
+		writeGatewayError(w, MSG_BAD_FORMAT)
+		return
+	}
+
+	tube, found := server.findTube(name)
+	if !found {
+		writeGatewayError(w, MSG_NOT_FOUND)
+		return
+	}
+	server.writeCommitted(w, http.StatusOK, gatewayKick{tube.kickUpTo(int(bound))})
+}
+
+// pauses the tube for delay seconds, a delay of 0 resumes it.
+func (server *Server) gatewayPause(w http.ResponseWriter, r *http.Request, name string) {
+	atomic.AddInt64(&server.stats.CmdPauseTube, 1)
+
+	delay, ok := queryUint(r, "delay", 0)
+	if !ok {
+		writeGatewayError(w, MSG_BAD_FORMAT)
+		return
+	}
+
+	tube, found := server.findTube(name)
+	if !found || !tube.pauseFor(time.Duration(delay)*time.Second) {
+		writeGatewayError(w, MSG_NOT_FOUND)
+		return
+	}
+	server.writeCommitted(w, http.StatusOK, statsMap(tube.statistics()))
+}
+
+func (server *Server) gatewayPut(w http.ResponseWriter, r *http.Request, name string) {
+	atomic.AddInt64(&server.stats.CmdPut, 1)
+
+	encoding, ok := queryEncoding(r)
+	if !ok {
+		writeGatewayError(w, MSG_BAD_FORMAT)
+		return
+	}
+
+	// JSON escapes a byte in at most 6, anything beyond can't fit a job.
+	r.Body = http.MaxBytesReader(w, r.Body, int64(server.config.MaxJobSize)*6+1024)
+	request := gatewayPut{TTR: 60}
+	err := readJSON(r, &request)
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			writeGatewayError(w, MSG_JOB_TOO_BIG)
+		} else {
+			writeGatewayError(w, MSG_BAD_FORMAT)
+		}
+		return
+	}
+
+	body := []byte(request.Body)
+	if encoding == "base64" {
+		body, err = base64.StdEncoding.DecodeString(request.Body)
+		if err != nil {
+			writeGatewayError(w, MSG_BAD_FORMAT)
+			return
+		}
+	}
+
+	tube := server.useTube(name)
+	defer server.unuseTube(tube)
+
+	job, response := server.put(tube, request.Priority, request.Delay, request.TTR, body)
+	if job == nil {
+		writeGatewayError(w, response)
+		return
+	}
+
+	server.writeCommitted(w, http.StatusCreated, gatewayJob{Id: job.id})
+}
+
+// waits for a job from the tube until it times out, the request is given up
+// or the server shuts down. A timeout is answered with 204 No Content, a
+// shutdown with 503 and SHUTTING_DOWN.
+func (server *Server) gatewayReserve(w http.ResponseWriter, r *http.Request, name string) {
+	encoding, ok := queryEncoding(r)
+	if !ok {
+		writeGatewayError(w, MSG_BAD_FORMAT)
+		return
+	}
+
+	var timeout <-chan time.Time
+	if r.URL.Query().Get("timeout") != "" {
+		atomic.AddInt64(&server.stats.CmdReserveWithTimeout, 1)
+		seconds, ok := queryUint(r, "timeout", 0)
+		if !ok {
+			writeGatewayError(w, MSG_BAD_FORMAT)
+			return
+		}
+		timeout = time.After(time.Duration(seconds) * time.Second)
+	} else {
+		atomic.AddInt64(&server.stats.CmdReserve, 1)
+	}
+
+	watched := server.watchTube(name)
+	defer server.unwatchTube(watched)
+
+	atomic.AddInt64(&server.stats.CurrentWaiting, 1)
+	atomic.AddInt64(&watched.waiting, 1)
+	defer atomic.AddInt64(&server.stats.CurrentWaiting, -1)
+	defer atomic.AddInt64(&watched.waiting, -1)
+
+	request := reserveCommon(server.gatewayClient(r), map[string]*tube{name: watched})
+	defer func() { request.cancel <- true }()
+
+	select {
+	case job := <-request.success:
+		server.writeCommitted(w, http.StatusOK, encodedJob(job, encoding))
+	case <-timeout:
+		w.WriteHeader(http.StatusNoContent)
+	case <-r.Context().Done():
+	case <-server.quit:
+		writeJSON(w, http.StatusServiceUnavailable, gatewayError{"SHUTTING_DOWN"})
+	}
+}
+
+// handles /jobs/{id} and /jobs/{id}/{release,bury,touch}.
+func (server *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if server.refuseWrites(w, r) {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	if len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		writeGatewayError(w, MSG_BAD_FORMAT)
+		return
+	}
+
+	action, method := "delete", http.MethodDelete
+	if len(parts) == 2 {
+		action, method = parts[1], http.MethodPost
+	}
+	if !allowMethod(w, r, method) {
+		return
+	}
+
+	var release gatewayRelease
+	switch action {
+	case "delete":
+		atomic.AddInt64(&server.stats.CmdDelete, 1)
+	case "release":
+		atomic.AddInt64(&server.stats.CmdRelease, 1)
+		if readJSON(r, &release) != nil {
+			writeGatewayError(w, MSG_BAD_FORMAT)
+			return
+		}
+	case "bury":
+		atomic.AddInt64(&server.stats.CmdBury, 1)
+	case "touch":
+		atomic.AddInt64(&server.stats.CmdTouch, 1)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	job, found := server.findJob(jobId(id))
+	if !found {
+		writeGatewayError(w, MSG_NOT_FOUND)
+		return
+	}
+
+	holder := server.gatewayClient(r)
+	right := RIGHT_ADMIN
+	if _, held := holder.reservedPriority(job); held {
+		right = RIGHT_RESERVE
+	}
+	if server.refuseRight(w, r, right, job.tube.name) {
+		return
+	}
+
+	var done bool
+	switch action {
+	case "delete":
+		done = job.deleteBy(holder)
+	case "release":
+		priority, held := holder.reservedPriority(job)
+		if release.Priority != nil {
+			priority = *release.Priority
+		}
+		response := MSG_NOT_FOUND
+		if held {
+			response = job.release(holder, priority, release.Delay)
+		}
+		if response == MSG_BURIED {
+			writeGatewayError(w, response)
+			return
+		}
+		done = response == MSG_RELEASED
+	case "bury":
+		done = job.buryBy(holder)
+	case "touch":
+		done = job.touchBy(holder)
+	}
+
+	if !done {
+		writeGatewayError(w, MSG_NOT_FOUND)
+		return
+	}
+	server.writeCommitted(w, http.StatusOK, gatewayJob{Id: job.id})
+}
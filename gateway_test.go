@@ -0,0 +1,369 @@
+package gostalk
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/manveru/gobdd"
+)
+
+// sends a request to the gateway and decodes the JSON answer, if any.
+func gatewayRequest(base, method, path, body string) (status int, answer map[string]interface{}) {
+	return gatewayRequestAs("", "", base, method, path, body)
+}
+
+// sends a request signed in as user with password, unless user is empty.
+func gatewayRequestAs(user, password, base, method, path, body string) (status int, answer map[string]interface{}) {
+	request, err := http.NewRequest(method, base+path, strings.NewReader(body))
+	Expect(err, ToBeNil)
+	if user != "" {
+		request.SetBasicAuth(user, password)
+	}
+	response, err := http.DefaultClient.Do(request)
+	Expect(err, ToBeNil)
+	defer response.Body.Close()
+
+	json.NewDecoder(response.Body).Decode(&answer)
+	return response.StatusCode, answer
+}
+
+func init() {
+	defer PrintSpecReport()
+
+	Describe("gateway", func() {
+		config := DefaultConfig()
+		config.MaxJobSize = 16
+		server, addr := startServer(config)
+		web := httptest.NewServer(server.Handler())
+		defer web.Close()
+		base := web.URL
+
+		It("puts jobs", func() {
+			status, answer := gatewayRequest(base, "POST", "/tubes/web/jobs", `{"body": "hello", "priority": 5}`)
+			Expect(status, ToEqual, http.StatusCreated)
+			Expect(answer["id"], ToEqual, 0.0)
+
+			job, found := server.findJob(0)
+			Expect(found, ToEqual, true)
+			job = job.snapshot()
+			Expect(string(job.body), ToEqual, "hello")
+			Expect(job.priority, ToEqual, uint32(5))
+			Expect(job.tube.name, ToEqual, "web")
+		})
+
+		It("rejects bad requests", func() {
+			status, answer := gatewayRequest(base, "POST", "/tubes/web/jobs", `{"body": `)
+			Expect(status, ToEqual, http.StatusBadRequest)
+			Expect(answer["error"], ToEqual, "BAD_FORMAT")
+
+			status, _ = gatewayRequest(base, "POST", "/tubes/-web/jobs", `{}`)
+			Expect(status, ToEqual, http.StatusBadRequest)
+
+			status, _ = gatewayRequest(base, "GET", "/tubes/web/jobs", "")
+			Expect(status, ToEqual, http.StatusMethodNotAllowed)
+
+			status, answer = gatewayRequest(base, "POST", "/tubes/web/jobs", `{"body": "much too big for this"}`)
+			Expect(status, ToEqual, http.StatusRequestEntityTooLarge)
+			Expect(answer["error"], ToEqual, "JOB_TOO_BIG")
+		})
+
+		It("reserves jobs for the gateway", func() {
+			status, answer := gatewayRequest(base, "POST", "/tubes/web/reserve?timeout=1", "")
+			Expect(status, ToEqual, http.StatusOK)
+			Expect(answer["id"], ToEqual, 0.0)
+			Expect(answer["body"], ToEqual, "hello")
+
+			conn := dialStats(addr)
+			defer conn.conn.Close()
+			Expect(conn.do("delete 0"), ToEqual, "NOT_FOUND")
+		})
+
+		It("answers 204 once a reserve times out", func() {
+			status, _ := gatewayRequest(base, "POST", "/tubes/web/reserve?timeout=0", "")
+			Expect(status, ToEqual, http.StatusNoContent)
+		})
+
+		It("touches, releases and buries reserved jobs", func() {
+			status, _ := gatewayRequest(base, "POST", "/jobs/0/touch", "")
+			Expect(status, ToEqual, http.StatusOK)
+
+			status, _ = gatewayRequest(base, "POST", "/jobs/0/release", `{"priority": 7}`)
+			Expect(status, ToEqual, http.StatusOK)
+			job, _ := server.findJob(0)
+			Expect(job.snapshot().state, ToEqual, jobReadyState)
+			Expect(job.snapshot().priority, ToEqual, uint32(7))
+
+			status, _ = gatewayRequest(base, "POST", "/jobs/0/bury", "")
+			Expect(status, ToEqual, http.StatusNotFound)
+
+			gatewayRequest(base, "POST", "/tubes/web/reserve", "")
+			status, _ = gatewayRequest(base, "POST", "/jobs/0/bury", "")
+			Expect(status, ToEqual, http.StatusOK)
+			Expect(job.snapshot().state, ToEqual, jobBuriedState)
+		})
+
+		It("deletes jobs", func() {
+			status, answer := gatewayRequest(base, "DELETE", "/jobs/0", "")
+			Expect(status, ToEqual, http.StatusOK)
+			Expect(answer["id"], ToEqual, 0.0)
+
+			status, answer = gatewayRequest(base, "DELETE", "/jobs/0", "")
+			Expect(status, ToEqual, http.StatusNotFound)
+			Expect(answer["error"], ToEqual, "NOT_FOUND")
+
+			status, _ = gatewayRequest(base, "DELETE", "/jobs/zero", "")
+			Expect(status, ToEqual, http.StatusBadRequest)
+		})
+
+		It("serves stats", func() {
+			status, answer := gatewayRequest(base, "GET", "/stats", "")
+			Expect(status, ToEqual, http.StatusOK)
+			Expect(answer["cmd-put"], ToEqual, 3.0)
+			Expect(answer["total-jobs"], ToEqual, 1.0)
+			Expect(answer["cmd-delete"], ToEqual, 3.0)
+		})
+
+		It("lists tubes with their stats", func() {
+			status, _ := gatewayRequest(base, "POST", "/tubes/admin/jobs", `{"body": "first", "delay": 60}`)
+			Expect(status, ToEqual, http.StatusCreated)
+
+			request, err := http.NewRequest("GET", base+"/tubes", nil)
+			Expect(err, ToBeNil)
+			response, err := http.DefaultClient.Do(request)
+			Expect(err, ToBeNil)
+			var tubes []map[string]interface{}
+			json.NewDecoder(response.Body).Decode(&tubes)
+			response.Body.Close()
+
+			names := []string{}
+			for _, tube := range tubes {
+				names = append(names, tube["name"].(string))
+			}
+			Expect(containsString(names, "admin"), ToEqual, true)
+			Expect(containsString(names, "default"), ToEqual, true)
+
+			status, answer := gatewayRequest(base, "GET", "/tubes/admin/stats", "")
+			Expect(status, ToEqual, http.StatusOK)
+			Expect(answer["current-jobs-delayed"], ToEqual, 1.0)
+
+			status, _ = gatewayRequest(base, "GET", "/tubes/missing/stats", "")
+			Expect(status, ToEqual, http.StatusNotFound)
+		})
+
+		It("peeks jobs by state", func() {
+			status, answer := gatewayRequest(base, "GET", "/tubes/admin/peek-delayed", "")
+			Expect(status, ToEqual, http.StatusOK)
+			Expect(answer["body"], ToEqual, "first")
+			stats := answer["stats"].(map[string]interface{})
+			Expect(stats["state"], ToEqual, jobDelayedState)
+			Expect(stats["tube"], ToEqual, "admin")
+			Expect(stats["age"], ToEqual, 0.0)
+
+			status, _ = gatewayRequest(base, "GET", "/tubes/admin/peek-buried", "")
+			Expect(status, ToEqual, http.StatusNotFound)
+		})
+
+		It("kicks jobs", func() {
+			status, answer := gatewayRequest(base, "POST", "/tubes/admin/kick?bound=5", "")
+			Expect(status, ToEqual, http.StatusOK)
+			Expect(answer["kicked"], ToEqual, 1.0)
+
+			status, answer = gatewayRequest(base, "GET", "/tubes/admin/peek-ready", "")
+			Expect(status, ToEqual, http.StatusOK)
+			Expect(answer["body"], ToEqual, "first")
+		})
+
+		It("pauses and resumes tubes", func() {
+			status, answer := gatewayRequest(base, "POST", "/tubes/admin/pause?delay=30", "")
+			Expect(status, ToEqual, http.StatusOK)
+			Expect(answer["pause"], ToEqual, 30.0)
+
+			status, answer = gatewayRequest(base, "POST", "/tubes/admin/pause", "")
+			Expect(status, ToEqual, http.StatusOK)
+			Expect(answer["pause"], ToEqual, 0.0)
+
+			status, _ = gatewayRequest(base, "POST", "/tubes/admin/pause?delay=soon", "")
+			Expect(status, ToEqual, http.StatusBadRequest)
+		})
+
+		It("carries bodies that aren't UTF-8 in base64", func() {
+			body := []byte{0xff, 0xfe, 0, 'x', 0x80}
+			encoded := base64.StdEncoding.EncodeToString(body)
+			status, answer := gatewayRequest(base, "POST", "/tubes/binary/jobs?encoding=base64", `{"body": "`+encoded+`"}`)
+			Expect(status, ToEqual, http.StatusCreated)
+			id := jobId(answer["id"].(float64))
+			job, found := server.findJob(id)
+			Expect(found, ToEqual, true)
+			Expect(bytes.Equal(job.snapshot().body, body), ToEqual, true)
+
+			status, answer = gatewayRequest(base, "GET", "/tubes/binary/peek-ready?encoding=base64", "")
+			Expect(status, ToEqual, http.StatusOK)
+			Expect(answer["body"], ToEqual, encoded)
+			Expect(answer["encoding"], ToEqual, "base64")
+
+			status, answer = gatewayRequest(base, "POST", "/tubes/binary/reserve?timeout=1&encoding=base64", "")
+			Expect(status, ToEqual, http.StatusOK)
+			Expect(answer["body"], ToEqual, encoded)
+			gatewayRequest(base, "DELETE", fmt.Sprintf("/jobs/%d", id), "")
+
+			status, _ = gatewayRequest(base, "POST", "/tubes/binary/jobs?encoding=base64", `{"body": "not base64!"}`)
+			Expect(status, ToEqual, http.StatusBadRequest)
+			status, _ = gatewayRequest(base, "POST", "/tubes/binary/jobs?encoding=rot13", `{"body": "hello"}`)
+			Expect(status, ToEqual, http.StatusBadRequest)
+		})
+
+		It("refuses jobs while draining", func() {
+			server.drain()
+			status, answer := gatewayRequest(base, "POST", "/tubes/web/jobs", `{"body": "late"}`)
+			Expect(status, ToEqual, http.StatusServiceUnavailable)
+			Expect(answer["error"], ToEqual, "DRAINING")
+		})
+
+		It("answers SHUTTING_DOWN to reserves waiting at shutdown", func() {
+			answered := make(chan map[string]interface{}, 1)
+			go func() {
+				status, answer := gatewayRequest(base, "POST", "/tubes/idle/reserve", "")
+				Expect(status, ToEqual, http.StatusServiceUnavailable)
+				answered <- answer
+			}()
+			time.Sleep(100 * time.Millisecond)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			defer cancel()
+			server.Shutdown(ctx)
+			Expect((<-answered)["error"], ToEqual, "SHUTTING_DOWN")
+		})
+	})
+
+	Describe("gateway with an auth file", func() {
+		aliceHash, _ := HashPassword("wonderland")
+		bobHash, _ := HashPassword("builder")
+		rootHash, _ := HashPassword("toor")
+		path := writeAuthFile(fmt.Sprintf(`
+alice:
+  password: %q
+  acl:
+    - tubes: mail.*
+      rights: [put, reserve]
+    - tubes: logs
+      rights: [put]
+bob:
+  password: %q
+  acl:
+    - tubes: mail.*
+      rights: [put, reserve]
+root:
+  password: %q
+  acl:
+    - tubes: "*"
+      rights: [admin]
+`, aliceHash, bobHash, rootHash))
+		defer os.Remove(path)
+
+		config := DefaultConfig()
+		config.AuthFile = path
+		server, _ := startServer(config)
+		web := httptest.NewServer(server.Handler())
+		defer web.Close()
+		base := web.URL
+
+		alice := func(method, path, body string) (int, map[string]interface{}) {
+			return gatewayRequestAs("alice", "wonderland", base, method, path, body)
+		}
+		bob := func(method, path, body string) (int, map[string]interface{}) {
+			return gatewayRequestAs("bob", "builder", base, method, path, body)
+		}
+		root := func(method, path, body string) (int, map[string]interface{}) {
+			return gatewayRequestAs("root", "toor", base, method, path, body)
+		}
+
+		It("asks requests to sign in", func() {
+			for _, path := range []string{"/", "/stats", "/metrics", "/tubes"} {
+				response, err := http.Get(base + path)
+				Expect(err, ToBeNil)
+				response.Body.Close()
+				Expect(response.StatusCode, ToEqual, http.StatusUnauthorized)
+				Expect(response.Header.Get("WWW-Authenticate"), ToEqual, `Basic realm="gostalk"`)
+			}
+
+			status, _ := gatewayRequest(base, "POST", "/tubes/mail.out/jobs", `{"body": "hello"}`)
+			Expect(status, ToEqual, http.StatusUnauthorized)
+			status, _ = gatewayRequestAs("alice", "toor", base, "GET", "/stats", "")
+			Expect(status, ToEqual, http.StatusUnauthorized)
+			status, _ = gatewayRequestAs("mallory", "wonderland", base, "GET", "/stats", "")
+			Expect(status, ToEqual, http.StatusUnauthorized)
+		})
+
+		It("serves stats to users", func() {
+			status, _ := alice("GET", "/stats", "")
+			Expect(status, ToEqual, http.StatusOK)
+		})
+
+		It("limits put to the tubes granted", func() {
+			status, answer := alice("POST", "/tubes/mail.out/jobs", `{"body": "mail"}`)
+			Expect(status, ToEqual, http.StatusCreated)
+			Expect(answer["id"], ToEqual, 0.0)
+			status, _ = alice("POST", "/tubes/logs/jobs", `{"body": "log"}`)
+			Expect(status, ToEqual, http.StatusCreated)
+
+			status, answer = alice("POST", "/tubes/other/jobs", `{"body": "other"}`)
+			Expect(status, ToEqual, http.StatusForbidden)
+			Expect(answer["error"], ToEqual, "UNAUTHORIZED")
+		})
+
+		It("limits reserve and peek to the tubes granted", func() {
+			status, _ := alice("GET", "/tubes/logs/peek-ready", "")
+			Expect(status, ToEqual, http.StatusForbidden)
+			status, _ = alice("POST", "/tubes/logs/reserve?timeout=0", "")
+			Expect(status, ToEqual, http.StatusForbidden)
+
+			status, answer := alice("POST", "/tubes/mail.out/reserve?timeout=1", "")
+			Expect(status, ToEqual, http.StatusOK)
+			Expect(answer["id"], ToEqual, 0.0)
+		})
+
+		It("keeps the jobs reserved for a user from the others", func() {
+			for _, action := range []string{"touch", "release", "bury"} {
+				status, _ := bob("POST", "/jobs/0/"+action, "")
+				Expect(status, ToEqual, http.StatusForbidden)
+			}
+			status, _ := bob("DELETE", "/jobs/0", "")
+			Expect(status, ToEqual, http.StatusForbidden)
+			status, _ = root("POST", "/jobs/0/release", "")
+			Expect(status, ToEqual, http.StatusNotFound)
+			status, _ = root("DELETE", "/jobs/0", "")
+			Expect(status, ToEqual, http.StatusNotFound)
+		})
+
+		It("lets users work on the jobs the gateway reserved for them", func() {
+			status, _ := alice("POST", "/jobs/0/touch", "")
+			Expect(status, ToEqual, http.StatusOK)
+			status, _ = alice("DELETE", "/jobs/0", "")
+			Expect(status, ToEqual, http.StatusOK)
+		})
+
+		It("limits deleting other jobs, kick and pause to admins", func() {
+			status, _ := alice("DELETE", "/jobs/1", "")
+			Expect(status, ToEqual, http.StatusForbidden)
+			status, _ = alice("POST", "/tubes/logs/kick", "")
+			Expect(status, ToEqual, http.StatusForbidden)
+			status, _ = alice("POST", "/tubes/logs/pause?delay=1", "")
+			Expect(status, ToEqual, http.StatusForbidden)
+
+			status, _ = root("POST", "/tubes/logs/kick", "")
+			Expect(status, ToEqual, http.StatusOK)
+			status, _ = root("POST", "/tubes/logs/pause", "")
+			Expect(status, ToEqual, http.StatusOK)
+			status, _ = root("DELETE", "/jobs/1", "")
+			Expect(status, ToEqual, http.StatusOK)
+		})
+	})
+}
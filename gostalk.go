@@ -1,17 +1,27 @@
 package gostalk
 
 import (
+	"log"
 	"net"
+	"os/user"
 	"regexp"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 )
 
 var (
 	NAME_CHARS = regexp.MustCompile("\\A[A-Za-z0-9()_$.;/+][A-Za-z0-9()_$.;/+-]{0,200}\\z")
+
+	// set by New when any server is configured to be verbose, logging is
+	// shared by all servers in the process.
+	verbose int32
 )
 
 const (
 	GOSTALK_VERSION     = "gostalk 2012-02-28"
-	JOB_DATA_SIZE_LIMIT = (1 << 16) - 1
+	MAX_LINE_LENGTH     = 224  // longest command line without its CRLF
+	URGENT_PRIORITY     = 1024 // jobs with a lower priority count as urgent
 	MSG_FOUND           = "FOUND\r\n"
 	MSG_NOTFOUND        = "NOT_FOUND\r\n"
 	MSG_DEADLINE_SOON   = "DEADLINE_SOON\r\n"
@@ -21,26 +31,43 @@ const (
 	MSG_RELEASED        = "RELEASED\r\n"
 	MSG_TOUCHED         = "TOUCHED\r\n"
 	MSG_NOT_FOUND       = "NOT_FOUND\r\n"
-	MSG_BURIED          = "BURIED %d\r\n"
+	MSG_BURIED          = "BURIED\r\n"
 	MSG_INSERTED        = "INSERTED %d\r\n"
 	MSG_NOT_IGNORED     = "NOT_IGNORED\r\n"
 	MSG_OUT_OF_MEMORY   = "OUT_OF_MEMORY\r\n"
 	MSG_INTERNAL_ERROR  = "INTERNAL_ERROR\r\n"
-	MSG_RESERVED        = "RESERVED %d %d\r\n%s\r\n"
-	MSG_PEEK_FOUND      = "FOUND %d %d\r\n%s\r\n"
+	MSG_RESERVED        = "RESERVED %d %d\r\n" // followed by the job body
+	MSG_PEEK_FOUND      = "FOUND %d %d\r\n"    // followed by the job body
 	MSG_DRAINING        = "DRAINING\r\n"
 	MSG_BAD_FORMAT      = "BAD_FORMAT\r\n"
 	MSG_UNKNOWN_COMMAND = "UNKNOWN_COMMAND\r\n"
 	MSG_EXPECTED_CRLF   = "EXPECTED_CRLF\r\n"
 	MSG_JOB_TOO_BIG     = "JOB_TOO_BIG\r\n"
+	MSG_AUTHENTICATED   = "AUTHENTICATED\r\n"
+	MSG_UNAUTHORIZED    = "UNAUTHORIZED\r\n"
+	MSG_READ_ONLY       = "READ_ONLY\r\n"
+	MSG_REPLICATING     = "REPLICATING\r\n" // followed by a stream of mutations
+	MSG_PROMOTED        = "PROMOTED\r\n"
+	MSG_NOT_LEADER      = "NOT_LEADER\r\n"
+	MSG_NOT_LEADER_AT   = "NOT_LEADER %s\r\n"
+	MSG_RAFT            = "RAFT\r\n" // followed by calls of another node
 )
 
+// the largest job body put accepted before it became configurable.
+//
+// Deprecated: use Config.MaxJobSize, which defaults to this.
+const JOB_DATA_SIZE_LIMIT = (1 << 16) - 1
+
 func p(v ...interface{}) {
-	// log.Println(v...)
+	if atomic.LoadInt32(&verbose) == 1 {
+		log.Println(v...)
+	}
 }
 
 func pf(format string, v ...interface{}) {
-	// log.Printf(format, v...)
+	if atomic.LoadInt32(&verbose) == 1 {
+		log.Printf(format, v...)
+	}
 }
 
 type exception string
@@ -59,33 +86,94 @@ type reader interface {
 	Read([]byte) (int, error)
 }
 
-func Start(hostAndPort string, running chan bool) {
-	server := newServer()
-
-	addr, err := net.ResolveTCPAddr("tcp", hostAndPort)
+// Start runs a server configured by config and sends on running once it is
+// listening. It panics on errors and never returns, embedders should use New
+// and Serve instead.
+func Start(config Config, running chan bool) {
+	addrs, err := config.listenAddrs()
 	if err != nil {
-		panic("net.ResolveTCPAddr: " + err.Error())
+		panic("listenAddrs: " + err.Error())
 	}
 
-	listener, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		panic("net.ListenTCP: " + err.Error())
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		listener, err := listen(addr, config.SocketMode)
+		if err != nil {
+			panic("listen " + addr.String() + ": " + err.Error())
+		}
+		listeners = append(listeners, listener)
 	}
 
-	running <- true
+	var httpListener net.Listener
+	if config.HTTPAddr != "" {
+		httpListener, err = net.Listen("tcp", config.HTTPAddr)
+		if err != nil {
+			panic("net.Listen: " + err.Error())
+		}
+	}
 
-	for {
-		conn, err := listener.AcceptTCP()
+	// the binlog is opened after switching, so its files belong to the user.
+	if config.User != "" {
+		err = switchUser(config.User)
 		if err != nil {
-			p("listener.AcceptTCP", err)
-		} else {
-			p("Accepted Connection:", conn)
-			err = conn.SetKeepAlive(true)
-			if err != nil {
-				p("conn.SetKeepAlive", err)
-			} else {
-				go server.accept(conn)
-			}
+			panic("switchUser: " + err.Error())
+		}
+	}
+
+	server, err := New(config)
+	if err != nil {
+		panic("New: " + err.Error())
+	}
+	server.drainOnSignal()
+
+	if httpListener != nil {
+		go func() {
+			panic("ServeHTTPListener: " + server.ServeHTTPListener(httpListener).Error())
+		}()
+	}
+
+	serve := func(n int) error {
+		if addrs[n].tls {
+			return server.ServeTLS(listeners[n])
 		}
+		return server.serve(listeners[n])
+	}
+	for n := 1; n < len(listeners); n += 1 {
+		go func(n int) {
+			panic("Serve " + addrs[n].String() + ": " + serve(n).Error())
+		}(n)
+	}
+
+	running <- true
+
+	panic("Serve " + addrs[0].String() + ": " + serve(0).Error())
+}
+
+// drops the privileges of the process to those of the named user.
+func switchUser(name string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+
+	// the groups have to go first, we may not change them anymore
+	// afterwards. Supplementary groups, like root's, would be kept otherwise.
+	err = syscall.Setgroups([]int{})
+	if err != nil {
+		return err
+	}
+	err = syscall.Setgid(gid)
+	if err != nil {
+		return err
 	}
+	return syscall.Setuid(uid)
 }
@@ -2,12 +2,15 @@ package gostalk
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net"
+	"os"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -89,6 +92,43 @@ func WhenSortedToEqual(actual, expected []string) (string, bool) {
 	return fmt.Sprintf("    expected: %#v\nto deeply be: %#v\n", expected, actual), false
 }
 
+// serves a new server on a free port and returns it with its address.
+func startServer(config Config) (*Server, string) {
+	server, err := New(config)
+	Expect(err, ToBeNil)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err, ToBeNil)
+	go server.Serve(listener)
+
+	return server, listener.Addr().String()
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func ToBeFloatBetween(f interface{}, lower, upper float64) (string, bool) {
+	var actual float64
+
+	switch f.(type) {
+	case float64:
+		actual = f.(float64)
+	case int:
+		actual = float64(f.(int))
+	}
+
+	if actual >= lower && actual <= upper {
+		return "", true
+	}
+	return fmt.Sprintf("    expected: %#v\nto be between %#v and %#v\n", actual, lower, upper), false
+}
+
 func init() {
 	defer PrintSpecReport()
 
@@ -123,10 +163,8 @@ func init() {
 	})
 
 	Describe("protocol", func() {
-		running := make(chan bool)
-		go Start("127.0.0.1:40401", running)
-		<-running
-		conn, err := net.DialTimeout("tcp", "127.0.0.1:40401", 1*time.Second)
+		_, addr := startServer(DefaultConfig())
+		conn, err := net.DialTimeout("tcp", addr, 1*time.Second)
 		Expect(err, ToBeNil)
 		reader := bufio.NewReader(conn)
 
@@ -177,7 +215,7 @@ func init() {
 		})
 
 		It("handles put <pri> <delay> <ttr> <bytes>", func() {
-			sendCommand(conn, "put 0 0 0 2\r\nhi")
+			sendCommand(conn, "put 0 0 60 2\r\nhi")
 			res := readResponseWithoutBody(reader)
 			Expect(res, ToEqual, "INSERTED 0")
 		})
@@ -216,9 +254,9 @@ func init() {
 			}()
 
 			go func() {
-				altConn, err := net.DialTimeout("tcp", "127.0.0.1:40401", 1*time.Second)
+				altConn, err := net.DialTimeout("tcp", addr, 1*time.Second)
 				Expect(err, ToBeNil)
-				sendCommand(altConn, "use test-tube\r\nput 0 0 0 3\r\nlol\r\nquit")
+				sendCommand(altConn, "use test-tube\r\nput 0 0 60 3\r\nlol\r\nquit")
 			}()
 
 			select {
@@ -229,13 +267,529 @@ func init() {
 			}
 		})
 
+		Describe("release <id> <pri> <delay>", func() {
+			It("puts a reserved job back into the ready queue", func() {
+				sendCommand(conn, "release 0 5 0")
+				res := readResponseWithoutBody(reader)
+				Expect(res, ToEqual, "RELEASED")
+
+				var stats map[string]interface{}
+				sendCommand(conn, "stats-job 0")
+				readResponseWithBody(reader, &stats)
+				Expect(stats["state"], ToEqual, "ready")
+				Expect(stats["pri"], ToEqual, 5)
+				Expect(stats["releases"], ToEqual, 1)
+				// whole seconds, like beanstalkd.
+				age, whole := stats["age"].(int)
+				Expect(whole, ToEqual, true)
+				Expect(age >= 0 && age < 60, ToEqual, true)
+
+				sendCommand(conn, "reserve")
+				Expect(readReserveResponse(reader), ToDeepEqual, jobResponse{0, "hi"})
+			})
+
+			It("can't release jobs reserved by another client", func() {
+				altConn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+				Expect(err, ToBeNil)
+				defer altConn.Close()
+				altReader := bufio.NewReader(altConn)
+
+				sendCommand(altConn, "release 1 0 0")
+				res := readResponseWithoutBody(altReader)
+				Expect(res, ToEqual, "NOT_FOUND")
+			})
+
+			It("can't release unknown jobs", func() {
+				sendCommand(conn, "release 42 0 0")
+				res := readResponseWithoutBody(reader)
+				Expect(res, ToEqual, "NOT_FOUND")
+			})
+
+			It("delays the job when given a delay", func() {
+				sendCommand(conn, "release 1 0 1")
+				res := readResponseWithoutBody(reader)
+				Expect(res, ToEqual, "RELEASED")
+
+				var stats map[string]interface{}
+				sendCommand(conn, "stats-job 1")
+				readResponseWithBody(reader, &stats)
+				Expect(stats["state"], ToEqual, "delayed")
+				Expect(stats["releases"], ToEqual, 1)
+			})
+		})
+
 		Describe("bury <id> <pri>", func() {
 			It("can't bury unreserved jobs", func() {
-				altConn, err := net.DialTimeout("tcp", "127.0.0.1:40401", 1*time.Second)
+				altConn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+				Expect(err, ToBeNil)
+				sendCommand(altConn, "use test-tube\r\nput 0 0 60 3\r\nlol\r\nquit")
+				altConn.Close()
+			})
+		})
+
+		Describe("time to run", func() {
+			It("puts the job back into the ready queue once it runs out", func() {
+				altConn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+				Expect(err, ToBeNil)
+				defer altConn.Close()
+				altReader := bufio.NewReader(altConn)
+
+				sendCommand(altConn, "use ttr-tube")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "USING ttr-tube")
+				sendCommand(altConn, "watch ttr-tube")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "OK")
+				sendCommand(altConn, "ignore default")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "WATCHING 1")
+				sendCommand(altConn, "put 0 0 1 3\r\nttr")
+				readResponseWithoutBody(altReader)
+
+				sendCommand(altConn, "reserve")
+				job := readReserveResponse(altReader)
+				Expect(job.body, ToEqual, "ttr")
+
+				time.Sleep(1100 * time.Millisecond)
+
+				var stats map[string]interface{}
+				sendCommand(altConn, fmt.Sprintf("stats-job %d", job.id))
+				readResponseWithBody(altReader, &stats)
+				Expect(stats["state"], ToEqual, "ready")
+				Expect(stats["timeouts"], ToEqual, 1)
+
+				sendCommand(altConn, "stats")
+				readResponseWithBody(altReader, &stats)
+				Expect(stats["job-timeouts"], ToEqual, 1)
+
+				sendCommand(altConn, fmt.Sprintf("bury %d", job.id))
+				Expect(readResponseWithoutBody(altReader), ToEqual, "NOT_FOUND")
+				sendCommand(altConn, fmt.Sprintf("touch %d", job.id))
+				Expect(readResponseWithoutBody(altReader), ToEqual, "NOT_FOUND")
+			})
+
+			It("answers DEADLINE_SOON to a reserve while a held job runs out", func() {
+				altConn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+				Expect(err, ToBeNil)
+				defer altConn.Close()
+				altReader := bufio.NewReader(altConn)
+
+				sendCommand(altConn, "use deadline-tube")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "USING deadline-tube")
+				sendCommand(altConn, "watch deadline-tube")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "OK")
+				sendCommand(altConn, "ignore default")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "WATCHING 1")
+				sendCommand(altConn, "put 0 0 1 8\r\ndeadline")
+				readResponseWithoutBody(altReader)
+
+				sendCommand(altConn, "reserve")
+				job := readReserveResponse(altReader)
+
+				sendCommand(altConn, "reserve")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "DEADLINE_SOON")
+
+				sendCommand(altConn, fmt.Sprintf("delete %d", job.id))
+				Expect(readResponseWithoutBody(altReader), ToEqual, "DELETED")
+			})
+
+			It("hands out ready jobs to a reserve while a held job runs out", func() {
+				worker := dialStats(addr)
+				defer worker.conn.Close()
+				worker.do("use deadline-ready-tube")
+				worker.do("watch deadline-ready-tube")
+				worker.do("ignore default")
+
+				for n := 0; n < 10; n += 1 {
+					worker.do("put 0 0 1 4\r\nheld")
+					held := worker.reserve("reserve")
+					var ready jobId
+					fmt.Sscanf(worker.do("put 0 0 60 5\r\nready"), "INSERTED %d", &ready)
+
+					response := worker.do("reserve")
+					Expect(response, ToEqual, fmt.Sprintf("RESERVED %d 5", ready))
+					if strings.HasPrefix(response, "RESERVED") {
+						readLine(worker.reader)
+					}
+					worker.do(fmt.Sprintf("delete %d", ready))
+					if n < 9 {
+						worker.do(fmt.Sprintf("delete %d", held.id))
+					}
+				}
+				// without ready jobs it doesn't wait for the held one to run out.
+				Expect(worker.do("reserve"), ToEqual, "DEADLINE_SOON")
+			})
+		})
+
+		Describe("delayed jobs", func() {
+			altConn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+			Expect(err, ToBeNil)
+			altReader := bufio.NewReader(altConn)
+
+			sendCommand(altConn, "use delayed-tube")
+			Expect(readResponseWithoutBody(altReader), ToEqual, "USING delayed-tube")
+			sendCommand(altConn, "put 0 100 60 4\r\nslow")
+			readResponseWithoutBody(altReader)
+			sendCommand(altConn, "put 0 50 60 4\r\nfast")
+			fast := strings.TrimPrefix(readResponseWithoutBody(altReader), "INSERTED ")
+
+			It("peeks at the job with the shortest delay left", func() {
+				sendCommand(altConn, "peek-delayed")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "FOUND "+fast+" 4")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "fast")
+			})
+
+			It("counts them in stats-tube", func() {
+				var stats map[string]interface{}
+				sendCommand(altConn, "stats-tube delayed-tube")
+				readResponseWithBody(altReader, &stats)
+				Expect(stats["current-jobs-delayed"], ToEqual, 2)
+				Expect(stats["current-jobs-ready"], ToEqual, 0)
+			})
+
+			It("kicks them into the ready queue", func() {
+				sendCommand(altConn, "kick 1")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "KICKED 1")
+
+				var stats map[string]interface{}
+				sendCommand(altConn, "stats-tube delayed-tube")
+				readResponseWithBody(altReader, &stats)
+				Expect(stats["current-jobs-delayed"], ToEqual, 1)
+				Expect(stats["current-jobs-ready"], ToEqual, 1)
+
+				sendCommand(altConn, "peek-ready")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "FOUND "+fast+" 4")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "fast")
+			})
+
+			It("answers NOT_FOUND when there is nothing to peek at", func() {
+				sendCommand(altConn, "kick 1")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "KICKED 1")
+				sendCommand(altConn, "peek-delayed")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "NOT_FOUND")
+				sendCommand(altConn, "peek-buried")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "NOT_FOUND")
+			})
+
+			altConn.Close()
+		})
+
+		Describe("pause-tube <tube> <delay>", func() {
+			altConn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+			Expect(err, ToBeNil)
+			altReader := bufio.NewReader(altConn)
+
+			for _, command := range []string{"use pause-tube", "watch pause-tube", "ignore default"} {
+				sendCommand(altConn, command)
+				readResponseWithoutBody(altReader)
+			}
+
+			It("keeps accepting jobs while paused", func() {
+				sendCommand(altConn, "pause-tube pause-tube 60")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "PAUSED")
+
+				sendCommand(altConn, "put 0 0 60 5\r\npause")
+				Expect(readResponseWithoutBody(altReader)[:len("INSERTED")], ToEqual, "INSERTED")
+
+				sendCommand(altConn, "peek-ready")
+				Expect(readResponseWithoutBody(altReader)[:len("FOUND")], ToEqual, "FOUND")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "pause")
+
+				var stats map[string]interface{}
+				sendCommand(altConn, "stats-tube pause-tube")
+				readResponseWithBody(altReader, &stats)
+				Expect(stats["pause-time-left"], ToBeFloatBetween, 58.0, 60.0)
+			})
+
+			It("doesn't hand out jobs while paused", func() {
+				sendCommand(altConn, "reserve-with-timeout 1")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "TIMED_OUT")
+			})
+
+			It("resumes right away when paused for 0 seconds", func() {
+				sendCommand(altConn, "pause-tube pause-tube 0")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "PAUSED")
+
+				var stats map[string]interface{}
+				sendCommand(altConn, "stats-tube pause-tube")
+				readResponseWithBody(altReader, &stats)
+				Expect(stats["pause"], ToEqual, 0)
+				Expect(stats["pause-time-left"], ToEqual, 0)
+
+				sendCommand(altConn, "reserve-with-timeout 1")
+				job := readReserveResponse(altReader)
+				Expect(job.body, ToEqual, "pause")
+				sendCommand(altConn, fmt.Sprintf("release %d 0 0", job.id))
+				Expect(readResponseWithoutBody(altReader), ToEqual, "RELEASED")
+			})
+
+			It("resumes once the pause is over", func() {
+				sendCommand(altConn, "pause-tube pause-tube 1")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "PAUSED")
+
+				sendCommand(altConn, "reserve-with-timeout 3")
+				Expect(readReserveResponse(altReader).body, ToEqual, "pause")
+
+				var stats map[string]interface{}
+				sendCommand(altConn, "stats-tube pause-tube")
+				readResponseWithBody(altReader, &stats)
+				Expect(stats["pause"], ToEqual, 0)
+				Expect(stats["pause-time-left"], ToEqual, 0)
+			})
+
+			altConn.Close()
+		})
+
+		Describe("malformed commands", func() {
+			altConn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+			Expect(err, ToBeNil)
+			altReader := bufio.NewReader(altConn)
+
+			for _, command := range []string{
+				"",
+				"   ",
+				"put",
+				"put 0 0 60",
+				"put 0 0 60 abc",
+				"put 0 0 60 -1",
+				"delete",
+				"delete abc",
+				"release 1",
+				"release 1 4294967296 0",
+				"release 1 -1 0",
+				"kick -1",
+				"use -dash",
+				"watch",
+				"pause-tube default",
+				"reserve-with-timeout soon",
+				"use " + strings.Repeat("a", 300),
+				strings.Repeat("x", 10000),
+			} {
+				command := command
+				It(fmt.Sprintf("answers BAD_FORMAT to %.30q", command), func() {
+					sendCommand(altConn, command)
+					Expect(readResponseWithoutBody(altReader), ToEqual, "BAD_FORMAT")
+				})
+			}
+
+			It("answers BAD_FORMAT to priorities beyond 2**32-1", func() {
+				conn := dialStats(addr)
+				defer conn.conn.Close()
+				Expect(conn.do("put 4294967296 0 60 5\r\nhello"), ToEqual, "BAD_FORMAT")
+			})
+
+			It("skips the body of jobs that are too big", func() {
+				body := strings.Repeat("b", 70000)
+				sendCommand(altConn, fmt.Sprintf("put 0 0 60 %d\r\n%s", len(body), body))
+				Expect(readResponseWithoutBody(altReader), ToEqual, "JOB_TOO_BIG")
+			})
+
+			It("keeps the connection open", func() {
+				sendCommand(altConn, "list-tube-used")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "USING default")
+			})
+
+			altConn.Close()
+		})
+
+		Describe("pipelining", func() {
+			altConn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+			Expect(err, ToBeNil)
+			altReader := bufio.NewReader(altConn)
+
+			It("answers pipelined commands in order", func() {
+				_, err := altConn.Write([]byte("use pipeline-tube\r\nwatch pipeline-tube\r\n" +
+					"put 0 0 60 3\r\none\r\nput 0 0 60 3\r\ntwo\r\n" +
+					"peek-ready\r\nlist-tube-used\r\n"))
 				Expect(err, ToBeNil)
-				sendCommand(altConn, "use test-tube\r\nput 0 0 0 3\r\nlol\r\nquit")
+
+				Expect(readResponseWithoutBody(altReader), ToEqual, "USING pipeline-tube")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "OK")
+				first := strings.TrimPrefix(readResponseWithoutBody(altReader), "INSERTED ")
+				second := strings.TrimPrefix(readResponseWithoutBody(altReader), "INSERTED ")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "FOUND "+first+" 3")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "one")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "USING pipeline-tube")
+
+				for _, id := range []string{first, second} {
+					sendCommand(altConn, "delete "+id)
+					Expect(readResponseWithoutBody(altReader), ToEqual, "DELETED")
+				}
+				sendCommand(altConn, "ignore pipeline-tube")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "WATCHING 1")
+			})
+
+			It("doesn't hold answers back while a reserve waits", func() {
+				sendCommand(altConn, "watch pipeline-empty")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "OK")
+				sendCommand(altConn, "ignore default")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "WATCHING 1")
+
+				_, err := altConn.Write([]byte("list-tubes-watched\r\nreserve-with-timeout 2\r\nlist-tube-used\r\n"))
+				Expect(err, ToBeNil)
+
+				started := time.Now()
+				var tubes []string
+				readResponseWithBody(altReader, &tubes)
+				Expect(tubes, ToDeepEqual, []string{"pipeline-empty"})
+				Expect(time.Since(started) < time.Second, ToEqual, true)
+
+				Expect(readResponseWithoutBody(altReader), ToEqual, "TIMED_OUT")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "USING pipeline-tube")
+			})
+
+			It("answers commands pipelined with quit before hanging up", func() {
+				quitConn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+				Expect(err, ToBeNil)
+				defer quitConn.Close()
+				quitReader := bufio.NewReader(quitConn)
+
+				_, err = quitConn.Write([]byte("use pipeline-quit\r\nput 0 0 10 2\r\nhi\r\nquit\r\n"))
+				Expect(err, ToBeNil)
+				Expect(readResponseWithoutBody(quitReader), ToEqual, "USING pipeline-quit")
+				id := strings.TrimPrefix(readResponseWithoutBody(quitReader), "INSERTED ")
+
+				sendCommand(altConn, "delete "+id)
+				Expect(readResponseWithoutBody(altReader), ToEqual, "DELETED")
+			})
+
+			altConn.Close()
+		})
+
+		Describe("unused tubes", func() {
+			altConn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+			Expect(err, ToBeNil)
+			altReader := bufio.NewReader(altConn)
+
+			listTubes := func() (tubes []string) {
+				time.Sleep(10 * time.Millisecond) // tubes are collected in the background
+				sendCommand(altConn, "list-tubes")
+				readResponseWithBody(altReader, &tubes)
+				return
+			}
+
+			It("are removed once nobody watches them", func() {
+				sendCommand(altConn, "watch typo-tube")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "OK")
+				Expect(containsString(listTubes(), "typo-tube"), ToEqual, true)
+
+				sendCommand(altConn, "ignore typo-tube")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "WATCHING 1")
+				Expect(containsString(listTubes(), "typo-tube"), ToEqual, false)
+			})
+
+			It("are kept as long as they hold jobs", func() {
+				sendCommand(altConn, "use gc-tube")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "USING gc-tube")
+				sendCommand(altConn, "put 0 0 60 2\r\ngc")
+				id := strings.TrimPrefix(readResponseWithoutBody(altReader), "INSERTED ")
+				sendCommand(altConn, "use default")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "USING default")
+				Expect(containsString(listTubes(), "gc-tube"), ToEqual, true)
+
+				sendCommand(altConn, "delete "+id)
+				Expect(readResponseWithoutBody(altReader), ToEqual, "DELETED")
+				Expect(containsString(listTubes(), "gc-tube"), ToEqual, false)
+			})
+
+			It("are removed once their last client disconnects", func() {
+				otherConn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+				Expect(err, ToBeNil)
+				otherReader := bufio.NewReader(otherConn)
+				sendCommand(otherConn, "use gone-tube")
+				Expect(readResponseWithoutBody(otherReader), ToEqual, "USING gone-tube")
+				Expect(containsString(listTubes(), "gone-tube"), ToEqual, true)
+
+				otherConn.Close()
+				Expect(containsString(listTubes(), "gone-tube"), ToEqual, false)
+			})
+
+			It("never removes the default tube", func() {
+				Expect(containsString(listTubes(), "default"), ToEqual, true)
+			})
+
+			altConn.Close()
+		})
+
+		Describe("disconnect", func() {
+			It("releases the jobs reserved by the client", func() {
+				altConn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+				Expect(err, ToBeNil)
+				altReader := bufio.NewReader(altConn)
+
+				sendCommand(altConn, "use disconnect-tube")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "USING disconnect-tube")
+				sendCommand(altConn, "watch disconnect-tube")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "OK")
+				sendCommand(altConn, "ignore default")
+				Expect(readResponseWithoutBody(altReader), ToEqual, "WATCHING 1")
+				sendCommand(altConn, "put 0 0 60 10\r\ndisconnect")
+				readResponseWithoutBody(altReader)
+
+				sendCommand(altConn, "reserve")
+				job := readReserveResponse(altReader)
 				altConn.Close()
+
+				time.Sleep(100 * time.Millisecond)
+
+				var stats map[string]interface{}
+				sendCommand(conn, fmt.Sprintf("stats-job %d", job.id))
+				readResponseWithBody(reader, &stats)
+				Expect(stats["state"], ToEqual, "ready")
+				Expect(stats["releases"], ToEqual, 1)
 			})
 		})
 	})
+	Describe("drain mode", func() {
+		_, addr := startServer(DefaultConfig())
+		conn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+		Expect(err, ToBeNil)
+		reader := bufio.NewReader(conn)
+
+		sendCommand(conn, "put 0 0 60 7\r\nundrain")
+		id := strings.TrimPrefix(readResponseWithoutBody(reader), "INSERTED ")
+
+		It("is entered with the drain command", func() {
+			sendCommand(conn, "drain")
+			Expect(readResponseWithoutBody(reader), ToEqual, "DRAINING")
+		})
+
+		It("rejects new jobs", func() {
+			sendCommand(conn, "put 0 0 60 5\r\nhello")
+			Expect(readResponseWithoutBody(reader), ToEqual, "DRAINING")
+		})
+
+		It("still hands out and deletes the jobs it has", func() {
+			sendCommand(conn, "reserve")
+			job := readReserveResponse(reader)
+			Expect(job.body, ToEqual, "undrain")
+
+			sendCommand(conn, "release "+id+" 0 0")
+			Expect(readResponseWithoutBody(reader), ToEqual, "RELEASED")
+			sendCommand(conn, "reserve")
+			readReserveResponse(reader)
+			sendCommand(conn, "bury "+id+" 0")
+			readResponseWithoutBody(reader)
+			sendCommand(conn, "delete "+id)
+			Expect(readResponseWithoutBody(reader), ToEqual, "DELETED")
+		})
+
+		It("is reported in stats", func() {
+			var stats map[string]interface{}
+			sendCommand(conn, "stats")
+			readResponseWithBody(reader, &stats)
+			Expect(stats["draining"], ToEqual, true)
+		})
+
+		It("is entered on SIGUSR1", func() {
+			server, err := New(DefaultConfig())
+			Expect(err, ToBeNil)
+			defer server.Shutdown(context.Background())
+			server.drainOnSignal()
+			Expect(server.isDraining(), ToEqual, false)
+
+			syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+			time.Sleep(10 * time.Millisecond)
+			Expect(server.isDraining(), ToEqual, true)
+		})
+
+		conn.Close()
+	})
 }
@@ -4,6 +4,7 @@ package gostalkc
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"strconv"
@@ -22,6 +23,7 @@ type Client struct {
 
 const (
 	BURIED        = "BURIED"
+	DEADLINE_SOON = "DEADLINE_SOON"
 	DELETED       = "DELETED"
 	DRAINING      = "DRAINING"
 	EXPECTED_CRLF = "EXPECTED_CRLF"
@@ -38,9 +40,12 @@ const (
 	WATCHING      = "WATCHING"
 	FOUND         = "FOUND"
 	RELEASED      = "RELEASED"
+	AUTHENTICATED = "AUTHENTICATED"
+	UNAUTHORIZED  = "UNAUTHORIZED"
 )
 
 const (
+	msgAuth               = "auth %s %s\r\n"
 	msgBury               = "bury %d\r\n"
 	msgDelete             = "delete %d\r\n"
 	msgIgnore             = "ignore %s\r\n"
@@ -70,21 +75,59 @@ func (e exception) Error() string {
 	return string(e)
 }
 
-// Dial opens a connection to hostAndPort (like "127.0.0.1:11300") and returns
-// a client instance or an error.
+// ErrDeadlineSoon is returned by Reserve and ReserveWithTimeout when a job
+// reserved by this client is about to run out of time. Touch, release or
+// delete that job before reserving another one.
+var ErrDeadlineSoon error = exception(DEADLINE_SOON)
+
+// splits addresses like "unix:///path/to/socket" into network and address,
+// anything else is a TCP host and port.
+func splitAddr(hostAndPort string) (network, address string) {
+	if strings.HasPrefix(hostAndPort, "unix://") {
+		return "unix", strings.TrimPrefix(hostAndPort, "unix://")
+	}
+	return "tcp", hostAndPort
+}
+
+// Dial opens a connection to hostAndPort (like "127.0.0.1:11300", or
+// "unix:///path/to/socket" for Unix sockets) and returns a client instance or
+// an error.
 func Dial(hostAndPort string) (i *Client, err error) {
-	conn, err := net.Dial("tcp", hostAndPort)
+	network, address := splitAddr(hostAndPort)
+	conn, err := net.Dial(network, address)
 	if err == nil {
 		i = newClient(conn)
 	}
 	return
 }
 
-// DialTimeout opens a connection to hostAndPort (like "127.0.0.1:11300") and
-// returns a client instance or an error.
+// DialTimeout opens a connection to hostAndPort like Dial does and returns a
+// client instance or an error.
 // Returns an error if the connection cannot be established within the timeout.
 func DialTimeout(hostAndPort string, timeout time.Duration) (i *Client, err error) {
-	conn, err := net.DialTimeout("tcp", hostAndPort, timeout)
+	network, address := splitAddr(hostAndPort)
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err == nil {
+		i = newClient(conn)
+	}
+	return
+}
+
+// DialTLS opens a TLS connection to hostAndPort (like "127.0.0.1:11300") and
+// returns a client instance or an error. The config holds the CAs to trust and
+// the certificate to present, if the server asks for one.
+func DialTLS(hostAndPort string, config *tls.Config) (i *Client, err error) {
+	conn, err := tls.Dial("tcp", hostAndPort, config)
+	if err == nil {
+		i = newClient(conn)
+	}
+	return
+}
+
+// DialTLSTimeout is like DialTLS, but returns an error if the connection and
+// handshake cannot be completed within the timeout.
+func DialTLSTimeout(hostAndPort string, config *tls.Config, timeout time.Duration) (i *Client, err error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", hostAndPort, config)
 	if err == nil {
 		i = newClient(conn)
 	}
@@ -358,6 +401,13 @@ func (i *Client) PeekReady() (jobId uint64, jobData []byte, err error) {
 	return
 }
 
+// Auth logs in as user, servers that require it answer UNAUTHORIZED to other
+// commands until then.
+func (i *Client) Auth(user, password string) (err error) {
+	_, err = i.wordsCmd(fmt.Sprintf(msgAuth, user, password), AUTHENTICATED)
+	return
+}
+
 func (i *Client) Touch(jobId uint64) (err error) {
 	_, err = i.wordsCmd(fmt.Sprintf(msgTouch, jobId), TOUCHED)
 	return
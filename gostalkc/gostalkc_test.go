@@ -1,13 +1,25 @@
 package gostalkc
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	. "github.com/manveru/gobdd"
 	"github.com/manveru/gostalk"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -21,12 +33,18 @@ func init() {
 		c := make(chan os.Signal)
 		signal.Notify(c)
 		for sig := range c {
+			// the runtime preempts long running goroutines with SIGURG.
+			if sig == syscall.SIGURG {
+				continue
+			}
 			panic(sig)
 		}
 	}()
 
 	running := make(chan bool)
-	go gostalk.Start("127.0.0.1:40402", running)
+	config := gostalk.DefaultConfig()
+	config.Addr = "127.0.0.1:40402"
+	go gostalk.Start(config, running)
 	<-running
 
 	i, err := DialTimeout("127.0.0.1:40402", 1*time.Second)
@@ -286,13 +304,13 @@ func init() {
 				Expect(stats["current-jobs-buried"], ToEqual, 0)
 			})
 			It("counts the amount of total jobs", func() {
-				Expect(stats["total-jobs"], ToEqual, 0)
+				Expect(stats["total-jobs"], ToEqual, 8)
 			})
 			It("counts the amount of waiting jobs", func() {
 				Expect(stats["current-waiting"], ToEqual, 0)
 			})
 			It("counts the number of times a job has been deleted", func() {
-				Expect(stats["cmd-delete"], ToEqual, 0)
+				Expect(stats["cmd-delete"], ToEqual, 8)
 			})
 			It("counts the number of times the tube has been paused", func() {
 				Expect(stats["cmd-pause-tube"], ToEqual, 0)
@@ -314,7 +332,7 @@ func init() {
 			Expect(stats["uptime"], ToBeFloatBetween, 0.0, 1.0)
 		})
 		It("has total job count", func() {
-			Expect(stats["total-jobs"], ToEqual, 0)
+			Expect(stats["total-jobs"], ToEqual, 8)
 		})
 		It("has total connection count", func() {
 			Expect(stats["total-connections"], ToEqual, 1)
@@ -431,21 +449,144 @@ func init() {
 			Expect(stats["current-jobs-urgent"], ToEqual, 0)
 		})
 		It("has the amount of currently connected producers", func() {
-			Expect(stats["current-producers"], ToEqual, 0)
+			Expect(stats["current-producers"], ToEqual, 1)
 		})
 		It("has the amount of currently active tubes", func() {
-			Expect(stats["current-tubes"], ToEqual, 2)
+			Expect(stats["current-tubes"], ToEqual, 1)
 		})
 		It("has the amount of currently waiting clients ", func() {
 			Expect(stats["current-waiting"], ToEqual, 0)
 		})
 		It("has the amount of currently connected workers", func() {
-			Expect(stats["current-workers"], ToEqual, 0)
+			Expect(stats["current-workers"], ToEqual, 1)
 		})
 		It("has the amount of current goroutines", func() {
-			Expect(stats["current-goroutines"], ToEqual, 0)
+			Expect(stats["current-goroutines"].(int) > 0, ToEqual, true)
 		})
 	})
+
+	Describe("ReserveWithTimeout", func() {
+		It("warns about a held job that is about to run out", func() {
+			jobId, _, err := i.Put(0, 0, 1, []byte("hi"))
+			Expect(err, ToBeNil)
+
+			id, _, err := i.Reserve()
+			Expect(err, ToBeNil)
+			Expect(id, ToEqual, jobId)
+
+			_, _, err = i.ReserveWithTimeout(1)
+			Expect(err, ToEqual, ErrDeadlineSoon)
+
+			err = i.Delete(jobId)
+			Expect(err, ToBeNil)
+		})
+	})
+
+	Describe("Auth", func() {
+		It("fails on servers without the user", func() {
+			err := i.Auth("nobody", "secret")
+			Expect(err.Error(), ToEqual, UNAUTHORIZED)
+		})
+	})
+
+	Describe("Dial", func() {
+		dir, err := ioutil.TempDir("", "gostalkc-unix")
+		Expect(err, ToBeNil)
+		defer os.RemoveAll(dir)
+
+		config := gostalk.DefaultConfig()
+		config.Addr = "unix://" + filepath.Join(dir, "gostalk.sock")
+		running := make(chan bool)
+		go gostalk.Start(config, running)
+		<-running
+
+		It("talks to servers on unix sockets", func() {
+			client, err := Dial(config.Addr)
+			Expect(err, ToBeNil)
+			defer client.Quit()
+
+			tube, err := client.ListTubeUsed()
+			Expect(err, ToBeNil)
+			Expect(tube, ToEqual, "default")
+		})
+	})
+
+	Describe("DialTLS", func() {
+		dir, err := ioutil.TempDir("", "gostalkc-tls")
+		Expect(err, ToBeNil)
+		defer os.RemoveAll(dir)
+		certificate, roots := selfSignedCertificate(dir)
+
+		// the certificate is its own CA, so it also serves as client
+		// certificate.
+		config := gostalk.DefaultConfig()
+		config.Addr = "127.0.0.1:40403"
+		config.TLSCert = filepath.Join(dir, "cert.pem")
+		config.TLSKey = filepath.Join(dir, "key.pem")
+		config.TLSClientCA = filepath.Join(dir, "cert.pem")
+		running := make(chan bool)
+		go gostalk.Start(config, running)
+		<-running
+
+		It("talks to servers over TLS", func() {
+			client, err := DialTLS("127.0.0.1:40403", &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{certificate}})
+			Expect(err, ToBeNil)
+			defer client.Quit()
+
+			tube, err := client.ListTubeUsed()
+			Expect(err, ToBeNil)
+			Expect(tube, ToEqual, "default")
+		})
+
+		It("fails when the server doesn't accept the client", func() {
+			client, err := DialTLSTimeout("127.0.0.1:40403", &tls.Config{RootCAs: roots}, 1*time.Second)
+			if err == nil {
+				// TLS 1.3 clients only learn of the rejection on their
+				// first read.
+				_, err = client.ListTubeUsed()
+			}
+			Expect(err == nil, ToEqual, false)
+		})
+
+		It("fails when the client doesn't trust the server", func() {
+			_, err := DialTLSTimeout("127.0.0.1:40403", &tls.Config{Certificates: []tls.Certificate{certificate}}, 1*time.Second)
+			Expect(err == nil, ToEqual, false)
+		})
+	})
+}
+
+// writes cert.pem and key.pem to dir, holding a self-signed certificate for
+// 127.0.0.1, and answers it along with a pool trusting it.
+func selfSignedCertificate(dir string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err, ToBeNil)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gostalkc"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err, ToBeNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err, ToBeNil)
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	Expect(ioutil.WriteFile(filepath.Join(dir, "cert.pem"), certPem, 0600), ToBeNil)
+	Expect(ioutil.WriteFile(filepath.Join(dir, "key.pem"), keyPem, 0600), ToBeNil)
+
+	certificate, err := tls.X509KeyPair(certPem, keyPem)
+	Expect(err, ToBeNil)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPem)
+	return certificate, roots
 }
 
 func ToBeFloatBetween(f interface{}, lower, upper float64) (string, bool) {
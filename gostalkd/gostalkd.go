@@ -1,11 +1,162 @@
 package main
 
 import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/manveru/gostalk"
 )
 
+// collects the values of a flag given several times.
+type addrList []string
+
+func (list *addrList) String() string { return strings.Join(*list, ",") }
+
+func (list *addrList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
 func main() {
+	defaults := gostalk.DefaultConfig()
+	host, port, _ := net.SplitHostPort(defaults.Addr)
+
+	configFile := flag.String("c", "", "read the configuration from this YAML file, flags take precedence")
+	listen := flag.String("l", host, "listen on this address")
+	listenPort := flag.String("p", port, "listen on this port")
+	var listenAlso addrList
+	flag.Var(&listenAlso, "L", "also listen on this address, like unix:///path/to/socket, tcp://host:port or tls://host:port, may be repeated")
+	socketMode := flag.Uint("S", uint(defaults.SocketMode), "permissions of unix sockets, like 0660, 0 leaves them to the umask")
+	httpAddr := flag.String("H", defaults.HTTPAddr, "serve the dashboard, Prometheus metrics and the JSON gateway over HTTP on this address")
+	maxJobSize := flag.Int("z", defaults.MaxJobSize, "maximum job size in bytes")
+	maxMemory := flag.Int64("m", defaults.MaxMemory, "maximum bytes all jobs may take, 0 is unlimited")
+	maxTubeMemory := flag.Int64("t", defaults.MaxTubeMemory, "maximum bytes the jobs of one tube may take, 0 is unlimited")
+	binlogDir := flag.String("b", defaults.BinlogDir, "write the binlog to this directory")
+	fsync := flag.Int("f", int(defaults.BinlogFsyncInterval/time.Millisecond), "fsync the binlog at most every this many milliseconds, -1 never")
+	tlsCert := flag.String("tls-cert", defaults.TLSCert, "serve TLS with the certificate in this PEM file")
+	tlsKey := flag.String("tls-key", defaults.TLSKey, "serve TLS with the private key in this PEM file")
+	tlsClientCA := flag.String("tls-client-ca", defaults.TLSClientCA, "require client certificates signed by a CA in this PEM file")
+	authFile := flag.String("a", defaults.AuthFile, "require clients to authenticate as a user of this YAML file")
+	clusterAddr := flag.String("cluster-addr", defaults.ClusterAddr, "join a cluster, reachable by the other nodes at this address")
+	var clusterPeers addrList
+	flag.Var(&clusterPeers, "cluster-peer", "the cluster-addr of another node of the cluster, may be repeated")
+	replicaOf := flag.String("R", defaults.ReplicaOf, "replicate the primary at this address, serving only reads until promoted")
+	replicaCA := flag.String("replica-ca", defaults.ReplicaCA, "verify the primary and cluster peers dialed with tls:// against the CAs in this PEM file")
+	replicaCert := flag.String("replica-cert", defaults.ReplicaCert, "present the certificate in this PEM file to the primary and cluster peers")
+	replicaKey := flag.String("replica-key", defaults.ReplicaKey, "present the private key in this PEM file to the primary and cluster peers")
+	hashPassword := flag.Bool("hash-password", false, "read a password from stdin, print its hash for the auth file and exit")
+	userName := flag.String("u", defaults.User, "become this user once listening")
+	verbose := flag.Bool("V", defaults.Verbose, "log connections and errors")
+	version := flag.Bool("v", false, "show the version and exit")
+	flag.Parse()
+
+	if *version {
+		fmt.Println(gostalk.GOSTALK_VERSION)
+		return
+	}
+
+	if *hashPassword {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			fmt.Fprintln(os.Stderr, "gostalkd:", err)
+			os.Exit(1)
+		}
+		hash, err := gostalk.HashPassword(strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "gostalkd:", err)
+			os.Exit(1)
+		}
+		fmt.Println(hash)
+		return
+	}
+
+	config := defaults
+	if *configFile != "" {
+		var err error
+		config, err = gostalk.ReadConfigFile(*configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "gostalkd:", err)
+			os.Exit(1)
+		}
+		host, port, _ = net.SplitHostPort(config.Addr)
+	}
+
+	// the address of the config file is kept unless overridden, it may not
+	// be a host and port.
+	addrGiven := *configFile == ""
+
+	// only flags given on the command line override the config file.
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "l":
+			host = *listen
+			addrGiven = true
+		case "p":
+			port = *listenPort
+			addrGiven = true
+		case "L":
+			config.Listen = append(config.Listen, listenAlso...)
+		case "S":
+			config.SocketMode = os.FileMode(*socketMode)
+		case "H":
+			config.HTTPAddr = *httpAddr
+		case "z":
+			config.MaxJobSize = *maxJobSize
+		case "m":
+			config.MaxMemory = *maxMemory
+		case "t":
+			config.MaxTubeMemory = *maxTubeMemory
+		case "b":
+			config.BinlogDir = *binlogDir
+		case "f":
+			if *fsync < 0 {
+				config.BinlogFsyncInterval = -1
+			} else {
+				config.BinlogFsyncInterval = time.Duration(*fsync) * time.Millisecond
+			}
+		case "tls-cert":
+			config.TLSCert = *tlsCert
+		case "tls-key":
+			config.TLSKey = *tlsKey
+		case "tls-client-ca":
+			config.TLSClientCA = *tlsClientCA
+		case "a":
+			config.AuthFile = *authFile
+		case "cluster-addr":
+			config.ClusterAddr = *clusterAddr
+		case "cluster-peer":
+			config.ClusterPeers = append(config.ClusterPeers, clusterPeers...)
+		case "R":
+			config.ReplicaOf = *replicaOf
+		case "replica-ca":
+			config.ReplicaCA = *replicaCA
+		case "replica-cert":
+			config.ReplicaCert = *replicaCert
+		case "replica-key":
+			config.ReplicaKey = *replicaKey
+		case "u":
+			config.User = *userName
+		case "V":
+			config.Verbose = *verbose
+		}
+	})
+
+	if addrGiven {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			fmt.Fprintln(os.Stderr, "gostalkd: invalid port", port)
+			os.Exit(1)
+		}
+		config.Addr = net.JoinHostPort(host, port)
+	}
+
 	// buffer 1, the channel is only useful for testing and embedding.
 	running := make(chan bool, 1)
-	gostalk.Start("127.0.0.1:40400", running)
+	gostalk.Start(config, running)
 }
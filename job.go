@@ -27,9 +27,8 @@ type job struct {
 	priority                                                              uint32
 	state                                                                 string
 	tube                                                                  *tube
-	timer                                                                 *time.Timer
 	timeToReserve                                                         time.Duration
-	createdAt, delayEndsAt, reserveEndsAt                                 time.Time
+	createdAt, delayEndsAt, readyAt, reservedAt, reserveEndsAt            time.Time
 	index, reserveCount, releaseCount, timeoutCount, buryCount, kickCount int
 }
 
@@ -64,19 +63,68 @@ func (job job) timeLeft() (left time.Duration) {
 	return
 }
 
-func (job *job) deleteFrom(server *server) {
-	delete(server.jobs, job.id)
-	job.tube.jobDelete <- job
+// sends a delete, bury or touch request to the tube of the job. Fails if the
+// tube is gone, which means the job is gone as well.
+func (job *job) request(requests chan *jobRequest, client *client) bool {
+	request := &jobRequest{
+		client:  client,
+		job:     job,
+		success: make(chan bool),
+	}
+
+	select {
+	case requests <- request:
+		return <-request.success
+	case <-job.tube.stopped:
+		return false
+	}
+}
+
+func (job *job) deleteBy(client *client) bool {
+	return job.request(job.tube.jobDelete, client)
+}
+
+func (job *job) buryBy(client *client) bool {
+	return job.request(job.tube.jobBury, client)
 }
 
-func (job *job) bury() {
-	job.tube.jobBury <- job
+func (job *job) touchBy(client *client) bool {
+	return job.request(job.tube.jobTouch, client)
 }
 
-func (job *job) touch() {
-	job.tube.jobTouch <- job
+// answers like the release command.
+func (job *job) release(client *client, priority uint32, delay int64) string {
+	request := &jobReleaseRequest{
+		client:   client,
+		job:      job,
+		priority: priority,
+		delay:    delay,
+		success:  make(chan string),
+	}
+
+	select {
+	case job.tube.jobRelease <- request:
+		return <-request.success
+	case <-job.tube.stopped:
+		return MSG_NOT_FOUND
+	}
+}
+
+// returns a copy of the job that is safe to read, or nil if it's gone.
+func (j *job) snapshot() *job {
+	request := &jobStatsRequest{
+		job:     j,
+		success: make(chan *job),
+	}
+
+	select {
+	case j.tube.jobStats <- request:
+		return <-request.success
+	case <-j.tube.stopped:
+		return nil
+	}
 }
 
 func (job *job) isUrgent() bool {
-	return job.priority > 1024
+	return job.priority < URGENT_PRIORITY
 }
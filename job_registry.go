@@ -0,0 +1,88 @@
+package gostalk
+
+import (
+	"sort"
+	"sync"
+)
+
+// number of independently locked parts of the job registry, job ids are
+// spread over them round robin.
+const jobRegistryShards = 32
+
+type jobRegistryShard struct {
+	sync.RWMutex
+	jobs map[jobId]*job
+}
+
+// jobRegistry finds jobs by id for every connection. It's split into shards
+// so connections working on different jobs rarely wait on each other.
+type jobRegistry struct {
+	shards [jobRegistryShards]jobRegistryShard
+}
+
+func newJobRegistry() *jobRegistry {
+	registry := &jobRegistry{}
+	for n := range registry.shards {
+		registry.shards[n].jobs = make(map[jobId]*job)
+	}
+	return registry
+}
+
+func (registry *jobRegistry) shard(id jobId) *jobRegistryShard {
+	return &registry.shards[id%jobRegistryShards]
+}
+
+func (registry *jobRegistry) add(job *job) {
+	shard := registry.shard(job.id)
+	shard.Lock()
+	defer shard.Unlock()
+	shard.jobs[job.id] = job
+}
+
+func (registry *jobRegistry) find(id jobId) (job *job, found bool) {
+	shard := registry.shard(id)
+	shard.RLock()
+	defer shard.RUnlock()
+	job, found = shard.jobs[id]
+	return
+}
+
+// removes the job and reports whether it was still registered, so only one of
+// several concurrent removals wins.
+func (registry *jobRegistry) remove(id jobId) bool {
+	shard := registry.shard(id)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if _, found := shard.jobs[id]; !found {
+		return false
+	}
+	delete(shard.jobs, id)
+	return true
+}
+
+// returns every registered job, ordered by id.
+func (registry *jobRegistry) all() []*job {
+	jobs := []*job{}
+	for i := range registry.shards {
+		shard := &registry.shards[i]
+		shard.RLock()
+		for _, job := range shard.jobs {
+			jobs = append(jobs, job)
+		}
+		shard.RUnlock()
+	}
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].id < jobs[j].id })
+	return jobs
+}
+
+func (registry *jobRegistry) Len() (n int) {
+	for i := range registry.shards {
+		shard := &registry.shards[i]
+		shard.RLock()
+		n += len(shard.jobs)
+		shard.RUnlock()
+	}
+	return
+}
@@ -0,0 +1,112 @@
+package gostalk
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// an address to listen on, parsed from one like "unix:///run/gostalk.sock".
+type listenAddr struct {
+	network string // tcp or unix
+	address string
+	tls     bool
+}
+
+func (addr listenAddr) String() string {
+	scheme := addr.network
+	if addr.tls {
+		scheme = "tls"
+	}
+	return scheme + "://" + addr.address
+}
+
+// parses an address with a scheme of tcp://, tls:// or unix://. Addresses
+// without one are served with TLS if the config has a certificate, as the
+// main address always was.
+func parseListenAddr(addr string, secure bool) (listenAddr, error) {
+	scheme, address := "", addr
+	if n := strings.Index(addr, "://"); n >= 0 {
+		scheme, address = addr[:n], addr[n+3:]
+	}
+
+	switch scheme {
+	case "":
+		return listenAddr{network: "tcp", address: address, tls: secure}, nil
+	case "tcp":
+		return listenAddr{network: "tcp", address: address}, nil
+	case "tls":
+		if !secure {
+			return listenAddr{}, fmt.Errorf("gostalk: %s needs tls-cert and tls-key", addr)
+		}
+		return listenAddr{network: "tcp", address: address, tls: true}, nil
+	case "unix":
+		if address == "" {
+			return listenAddr{}, fmt.Errorf("gostalk: %s has no path", addr)
+		}
+		return listenAddr{network: "unix", address: address}, nil
+	}
+	return listenAddr{}, fmt.Errorf("gostalk: unknown scheme in %s", addr)
+}
+
+// the main address followed by the others the config lists.
+func (config Config) listenAddrs() ([]listenAddr, error) {
+	secure := config.TLSCert != "" && config.TLSKey != ""
+
+	addrs := []listenAddr{}
+	for _, addr := range append([]string{config.Addr}, config.Listen...) {
+		if addr == "" {
+			continue
+		}
+		parsed, err := parseListenAddr(addr, secure)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, parsed)
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("gostalk: nothing to listen on")
+	}
+	return addrs, nil
+}
+
+// listens on addr. Unix sockets left behind by a server that died are
+// replaced, and get mode if it isn't zero.
+func listen(addr listenAddr, mode os.FileMode) (net.Listener, error) {
+	if addr.network != "unix" {
+		return net.Listen(addr.network, addr.address)
+	}
+
+	if info, err := os.Stat(addr.address); err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.DialTimeout("unix", addr.address, 1*time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("gostalk: %s is in use", addr.address)
+		}
+		os.Remove(addr.address)
+	}
+
+	// created for the owner alone, so no one else connects before the chmod.
+	// The umask is the process's, but owners keep their rights in the
+	// meantime.
+	if mode != 0 {
+		defer syscall.Umask(syscall.Umask(0077))
+	}
+	listener, err := net.Listen("unix", addr.address)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode != 0 {
+		err = os.Chmod(addr.address, mode)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
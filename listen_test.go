@@ -0,0 +1,175 @@
+package gostalk
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "github.com/manveru/gobdd"
+)
+
+func init() {
+	defer PrintSpecReport()
+
+	Describe("parseListenAddr", func() {
+		It("reads the scheme of addresses", func() {
+			addr, err := parseListenAddr("tcp://127.0.0.1:11300", true)
+			Expect(err, ToBeNil)
+			Expect(addr, ToEqual, listenAddr{network: "tcp", address: "127.0.0.1:11300"})
+
+			addr, err = parseListenAddr("tls://127.0.0.1:11301", true)
+			Expect(err, ToBeNil)
+			Expect(addr, ToEqual, listenAddr{network: "tcp", address: "127.0.0.1:11301", tls: true})
+
+			addr, err = parseListenAddr("unix:///run/gostalk.sock", true)
+			Expect(err, ToBeNil)
+			Expect(addr, ToEqual, listenAddr{network: "unix", address: "/run/gostalk.sock"})
+			Expect(addr.String(), ToEqual, "unix:///run/gostalk.sock")
+		})
+
+		It("serves addresses without a scheme with TLS if there is a certificate", func() {
+			addr, _ := parseListenAddr("127.0.0.1:11300", false)
+			Expect(addr.tls, ToEqual, false)
+			addr, _ = parseListenAddr("127.0.0.1:11300", true)
+			Expect(addr.tls, ToEqual, true)
+		})
+
+		It("fails for unusable addresses", func() {
+			_, err := parseListenAddr("tls://127.0.0.1:11301", false)
+			Expect(err == nil, ToEqual, false)
+			_, err = parseListenAddr("unix://", false)
+			Expect(err == nil, ToEqual, false)
+			_, err = parseListenAddr("udp://127.0.0.1:11300", false)
+			Expect(err == nil, ToEqual, false)
+		})
+
+		It("needs at least one address", func() {
+			config := DefaultConfig()
+			config.Addr = ""
+			_, err := config.listenAddrs()
+			Expect(err == nil, ToEqual, false)
+
+			config.Listen = []string{"unix:///tmp/a.sock", "tcp://:0"}
+			addrs, err := config.listenAddrs()
+			Expect(err, ToBeNil)
+			Expect(len(addrs), ToEqual, 2)
+		})
+	})
+
+	Describe("listen", func() {
+		dir, err := ioutil.TempDir("", "gostalk-listen")
+		Expect(err, ToBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "gostalk.sock")
+		addr := listenAddr{network: "unix", address: path}
+
+		It("gives unix sockets the mode asked for", func() {
+			listener, err := listen(addr, 0600)
+			Expect(err, ToBeNil)
+			defer listener.Close()
+
+			info, err := os.Stat(path)
+			Expect(err, ToBeNil)
+			Expect(info.Mode().Perm(), ToEqual, os.FileMode(0600))
+		})
+
+		It("restores the umask it created them with", func() {
+			before := syscall.Umask(0)
+			defer syscall.Umask(before)
+
+			listener, err := listen(addr, 0666)
+			Expect(err, ToBeNil)
+			defer listener.Close()
+			Expect(syscall.Umask(0), ToEqual, 0)
+		})
+
+		It("refuses sockets in use", func() {
+			listener, err := listen(addr, 0)
+			Expect(err, ToBeNil)
+			defer listener.Close()
+
+			_, err = listen(addr, 0)
+			Expect(err == nil, ToEqual, false)
+		})
+
+		It("replaces sockets left behind", func() {
+			listener, err := net.Listen("unix", path)
+			Expect(err, ToBeNil)
+			listener.(*net.UnixListener).SetUnlinkOnClose(false)
+			listener.Close()
+
+			listener, err = listen(addr, 0)
+			Expect(err, ToBeNil)
+			listener.Close()
+		})
+	})
+
+	Describe("Server on several listeners", func() {
+		dir, err := ioutil.TempDir("", "gostalk-listen")
+		Expect(err, ToBeNil)
+		defer os.RemoveAll(dir)
+
+		server, err := New(DefaultConfig())
+		Expect(err, ToBeNil)
+		defer server.Shutdown(context.Background())
+
+		tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err, ToBeNil)
+		go server.Serve(tcpListener)
+
+		path := filepath.Join(dir, "gostalk.sock")
+		unixListener, err := listen(listenAddr{network: "unix", address: path}, 0)
+		Expect(err, ToBeNil)
+		go server.Serve(unixListener)
+
+		It("shares its tubes between them", func() {
+			producer, err := net.DialTimeout("unix", path, 1*time.Second)
+			Expect(err, ToBeNil)
+			defer producer.Close()
+			sendCommand(producer, "put 0 0 60 5\r\nhello")
+			Expect(readResponseWithoutBody(bufio.NewReader(producer)), ToEqual, "INSERTED 0")
+
+			worker := dialStats(tcpListener.Addr().String())
+			defer worker.conn.Close()
+			Expect(worker.reserve("reserve").body, ToEqual, "hello")
+		})
+
+		It("serves tcp:// and unix:// addresses without TLS when it has a certificate", func() {
+			certDir, err := ioutil.TempDir("", "gostalk-tls")
+			Expect(err, ToBeNil)
+			defer os.RemoveAll(certDir)
+			writeCertificate(certDir, "server", nil, nil)
+
+			config := DefaultConfig()
+			config.Addr = "unix://" + filepath.Join(dir, "plain.sock")
+			config.TLSCert = filepath.Join(certDir, "server.pem")
+			config.TLSKey = filepath.Join(certDir, "server-key.pem")
+			running := make(chan bool)
+			go Start(config, running)
+			<-running
+
+			conn, err := net.DialTimeout("unix", filepath.Join(dir, "plain.sock"), 1*time.Second)
+			Expect(err, ToBeNil)
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(1 * time.Second))
+			sendCommand(conn, "list-tube-used")
+			Expect(readResponseWithoutBody(bufio.NewReader(conn)), ToEqual, "USING default")
+		})
+
+		It("closes them all on Shutdown", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			defer cancel()
+			Expect(server.Shutdown(ctx), ToBeNil)
+
+			_, err := net.DialTimeout("unix", path, 100*time.Millisecond)
+			Expect(err == nil, ToEqual, false)
+			_, err = net.DialTimeout("tcp", tcpListener.Addr().String(), 100*time.Millisecond)
+			Expect(err == nil, ToEqual, false)
+		})
+	})
+}
@@ -0,0 +1,61 @@
+package gostalk
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// memory accounted for every job on top of its body.
+var jobOverhead = int64(unsafe.Sizeof(job{}))
+
+// the memory a job with a body of bodySize bytes is accounted with.
+func jobMemory(bodySize int) int64 {
+	return int64(bodySize) + jobOverhead
+}
+
+func (job *job) memory() int64 {
+	return jobMemory(len(job.body))
+}
+
+// adds size to used unless that would exceed max, a max of 0 is unlimited.
+func allocate(used *int64, max, size int64) bool {
+	for {
+		current := atomic.LoadInt64(used)
+		if max > 0 && current+size > max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(used, current, current+size) {
+			return true
+		}
+	}
+}
+
+// takes size bytes from the budgets of tube and the server, reports whether
+// they fit into both.
+func (server *Server) allocate(tube *tube, size int64) bool {
+	if !allocate(&tube.memory, server.config.MaxTubeMemory, size) {
+		return false
+	}
+
+	if !allocate(&server.memory, server.config.MaxMemory, size) {
+		atomic.AddInt64(&tube.memory, -size)
+		return false
+	}
+
+	return true
+}
+
+// accounts for a job restored from the binlog, which is kept no matter the
+// budget.
+func (server *Server) allocateAlways(job *job) {
+	size := job.memory()
+	atomic.AddInt64(&job.tube.memory, size)
+	atomic.AddInt64(&server.memory, size)
+}
+
+// gives the room taken by a deleted job back.
+func (server *Server) free(job *job) {
+	size := job.memory()
+	atomic.AddInt64(&job.tube.memory, -size)
+	atomic.AddInt64(&server.memory, -size)
+}
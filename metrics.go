@@ -0,0 +1,168 @@
+package gostalk
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upper bounds in seconds of the buckets job times are sorted into.
+var histogramBuckets = []float64{
+	.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 1800, 3600,
+}
+
+// histogram counts durations in buckets, as Prometheus histograms do.
+type histogram struct {
+	sync.Mutex
+	counts []uint64 // per bucket, the last one being +Inf
+	count  uint64
+	sum    float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(histogramBuckets)+1)}
+}
+
+func (h *histogram) observe(duration time.Duration) {
+	seconds := duration.Seconds()
+	bucket := sort.SearchFloat64s(histogramBuckets, seconds)
+
+	h.Lock()
+	defer h.Unlock()
+	h.counts[bucket] += 1
+	h.count += 1
+	h.sum += seconds
+}
+
+func (h *histogram) write(w io.Writer, name string) {
+	h.Lock()
+	defer h.Unlock()
+
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	var cumulative uint64
+	for n, count := range h.counts {
+		cumulative += count
+		bound := math.Inf(1)
+		if n < len(histogramBuckets) {
+			bound = histogramBuckets[n]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Handler serves the HTTP side of the server: the dashboard at /, Prometheus
+// metrics at /metrics and the gateway everywhere else.
+func (server *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.handleDashboard)
+	mux.HandleFunc("/stats", server.handleStats)
+	mux.HandleFunc("/tubes", server.handleTubes)
+	mux.HandleFunc("/tubes/", server.handleTubes)
+	mux.HandleFunc("/jobs/", server.handleJobs)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		server.writeMetrics(w)
+	})
+	return server.requireAuth(mux)
+}
+
+// writes every field of stats and stats-tube, followed by the histograms of
+// job times.
+func (server *Server) writeMetrics(w io.Writer) {
+	writeStatsMetrics(w, "gostalk_", "", []interface{}{server.statistics()}, nil)
+
+	tubes := server.tubeList()
+	sort.Sort(tubesByName(tubes))
+	tubeStats := make([]interface{}, 0, len(tubes))
+	names := make([]string, 0, len(tubes))
+	for _, tube := range tubes {
+		tubeStats = append(tubeStats, tube.statistics())
+		names = append(names, tube.name)
+	}
+	writeStatsMetrics(w, "gostalk_tube_", "tube", tubeStats, names)
+
+	server.waitTime.write(w, "gostalk_job_wait_seconds")
+	server.processingTime.write(w, "gostalk_job_processing_seconds")
+}
+
+// writes a metric per field of the stats structs, named after the key the
+// field has in stats, with a sample per struct labelled by label=values[n].
+// String fields become a label of their own on a sample of 1, the name field
+// is only used as label.
+func writeStatsMetrics(w io.Writer, prefix, label string, stats []interface{}, values []string) {
+	if len(stats) == 0 {
+		return
+	}
+
+	statsType := reflect.TypeOf(stats[0])
+	for field := 0; field < statsType.NumField(); field += 1 {
+		key := statsType.Field(field).Tag.Get("yaml")
+		if key == "name" {
+			continue
+		}
+		name := prefix + strings.Replace(key, "-", "_", -1)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType(key))
+
+		for n, s := range stats {
+			var labels []string
+			if label != "" {
+				labels = append(labels, fmt.Sprintf("%s=%q", label, values[n]))
+			}
+
+			value := reflect.ValueOf(s).Field(field)
+			var sample string
+			switch value.Kind() {
+			case reflect.Int, reflect.Int64:
+				sample = strconv.FormatInt(value.Int(), 10)
+			case reflect.Float64:
+				sample = formatFloat(value.Float())
+			case reflect.Bool:
+				sample = "0"
+				if value.Bool() {
+					sample = "1"
+				}
+			case reflect.String:
+				labels = append(labels, fmt.Sprintf("%s=%q", strings.Replace(key, "-", "_", -1), value.String()))
+				sample = "1"
+			}
+
+			if len(labels) > 0 {
+				fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(labels, ","), sample)
+			} else {
+				fmt.Fprintf(w, "%s %s\n", name, sample)
+			}
+		}
+	}
+}
+
+// stats that only ever grow are counters, everything else is a gauge.
+func metricType(key string) string {
+	for _, prefix := range []string{"cmd-", "total-", "binlog-records-", "rusage-", "job-timeouts"} {
+		if strings.HasPrefix(key, prefix) {
+			return "counter"
+		}
+	}
+	return "gauge"
+}
+
+type tubesByName []*tube
+
+func (tubes tubesByName) Len() int           { return len(tubes) }
+func (tubes tubesByName) Less(i, j int) bool { return tubes[i].name < tubes[j].name }
+func (tubes tubesByName) Swap(i, j int)      { tubes[i], tubes[j] = tubes[j], tubes[i] }
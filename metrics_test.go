@@ -0,0 +1,107 @@
+package gostalk
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/manveru/gobdd"
+)
+
+func fetchMetrics(addr string) (string, string) {
+	response, err := http.Get("http://" + addr + "/metrics")
+	Expect(err, ToBeNil)
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	Expect(err, ToBeNil)
+	return response.Header.Get("Content-Type"), string(body)
+}
+
+func init() {
+	defer PrintSpecReport()
+
+	Describe("histogram", func() {
+		h := newHistogram()
+		h.observe(0)
+		h.observe(2 * time.Second)
+		h.observe(2 * time.Hour)
+
+		var out strings.Builder
+		h.write(&out, "h")
+		lines := strings.Split(out.String(), "\n")
+
+		It("counts cumulatively per bucket", func() {
+			Expect(containsString(lines, `h_bucket{le="0.005"} 1`), ToEqual, true)
+			Expect(containsString(lines, `h_bucket{le="1"} 1`), ToEqual, true)
+			Expect(containsString(lines, `h_bucket{le="2.5"} 2`), ToEqual, true)
+			Expect(containsString(lines, `h_bucket{le="3600"} 2`), ToEqual, true)
+			Expect(containsString(lines, `h_bucket{le="+Inf"} 3`), ToEqual, true)
+		})
+
+		It("sums and counts every observation", func() {
+			Expect(containsString(lines, "h_sum 7202"), ToEqual, true)
+			Expect(containsString(lines, "h_count 3"), ToEqual, true)
+		})
+	})
+
+	Describe("metrics", func() {
+		server, addr := startServer(DefaultConfig())
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err, ToBeNil)
+		served := make(chan error, 1)
+		go func() { served <- server.ServeHTTPListener(listener) }()
+
+		client := dialStats(addr)
+		client.do("use measured")
+		client.do("watch measured")
+		client.do("put 0 0 60 2\r\nhi")
+		job := client.reserve("reserve")
+		client.do(fmt.Sprintf("delete %d", job.id))
+		client.do("put 0 0 60 2\r\nho")
+
+		contentType, body := fetchMetrics(listener.Addr().String())
+		lines := strings.Split(body, "\n")
+
+		It("are served in the Prometheus text format", func() {
+			Expect(contentType, ToEqual, "text/plain; version=0.0.4; charset=utf-8")
+			Expect(containsString(lines, "# TYPE gostalk_cmd_put counter"), ToEqual, true)
+			Expect(containsString(lines, "# TYPE gostalk_current_connections gauge"), ToEqual, true)
+		})
+
+		It("include every stats field", func() {
+			Expect(containsString(lines, "gostalk_cmd_put 2"), ToEqual, true)
+			Expect(containsString(lines, "gostalk_total_jobs 2"), ToEqual, true)
+			Expect(containsString(lines, "gostalk_current_jobs_ready 1"), ToEqual, true)
+			Expect(containsString(lines, "gostalk_current_producers 1"), ToEqual, true)
+			Expect(containsString(lines, "gostalk_draining 0"), ToEqual, true)
+			Expect(containsString(lines, `gostalk_version{version="`+GOSTALK_VERSION+`"} 1`), ToEqual, true)
+		})
+
+		It("include every stats-tube field per tube", func() {
+			Expect(containsString(lines, `gostalk_tube_total_jobs{tube="measured"} 2`), ToEqual, true)
+			Expect(containsString(lines, `gostalk_tube_cmd_delete{tube="measured"} 1`), ToEqual, true)
+			Expect(containsString(lines, `gostalk_tube_current_jobs_urgent{tube="measured"} 1`), ToEqual, true)
+			Expect(containsString(lines, `gostalk_tube_current_watching{tube="measured"} 1`), ToEqual, true)
+			Expect(containsString(lines, `gostalk_tube_current_jobs_ready{tube="default"} 0`), ToEqual, true)
+		})
+
+		It("include histograms of job wait and processing times", func() {
+			Expect(containsString(lines, "# TYPE gostalk_job_wait_seconds histogram"), ToEqual, true)
+			Expect(containsString(lines, "gostalk_job_wait_seconds_count 1"), ToEqual, true)
+			Expect(containsString(lines, "gostalk_job_processing_seconds_count 1"), ToEqual, true)
+			Expect(containsString(lines, `gostalk_job_processing_seconds_bucket{le="+Inf"} 1`), ToEqual, true)
+		})
+
+		It("stop being served on Shutdown", func() {
+			client.conn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			Expect(server.Shutdown(ctx), ToBeNil)
+			Expect(<-served, ToEqual, ErrServerClosed)
+		})
+	})
+}
@@ -0,0 +1,227 @@
+package gostalk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// the file in the binlog directory holding the state of a cluster node.
+const raftLogName = "raft"
+
+// kinds of raftRecord.
+const (
+	raftRecordVote  = "vote"  // the term and the vote given in it
+	raftRecordEntry = "entry" // an entry, replacing the one at its index and all after
+	raftRecordBase  = "base"  // the index and term of the last entry dropped
+)
+
+// A raftLog keeps the term, vote and log of a cluster node in a file, framed
+// like binlog records. Everything a node answers a call with is synced first,
+// so a restarted node neither votes twice in a term nor forgets entries it
+// told the leader it has.
+//
+// The file grows until the log is compacted or replaced by a snapshot, then
+// it is written anew.
+type raftLog struct {
+	path string
+	file *os.File
+}
+
+type raftRecord struct {
+	Kind  string     `json:"kind"`
+	Term  uint64     `json:"term,omitempty"`
+	Vote  string     `json:"vote,omitempty"`
+	Index uint64     `json:"index,omitempty"`
+	Entry *raftEntry `json:"entry,omitempty"`
+}
+
+// the state of a node as it was last written.
+type raftState struct {
+	term      uint64
+	votedFor  string
+	baseIndex uint64
+	baseTerm  uint64
+	log       []raftEntry
+}
+
+// opens the raft file in dir, creating it if necessary, and returns the state
+// it holds. A record that was only partially written ends the replay.
+func openRaftLog(dir string) (*raftLog, *raftState, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	raftLog := &raftLog{path: filepath.Join(dir, raftLogName)}
+	state, good, err := raftLog.replay()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	raftLog.file, err = os.OpenFile(raftLog.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// drop whatever is left of a torn record at the end.
+	err = raftLog.file.Truncate(good)
+	if err == nil {
+		_, err = raftLog.file.Seek(good, io.SeekStart)
+	}
+	if err != nil {
+		raftLog.file.Close()
+		return nil, nil, err
+	}
+
+	return raftLog, state, nil
+}
+
+func (raftLog *raftLog) replay() (state *raftState, good int64, err error) {
+	state = &raftState{}
+
+	file, err := os.Open(raftLog.path)
+	if os.IsNotExist(err) {
+		return state, 0, nil
+	}
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, binlogHeaderSize)
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+
+		size := int64(binary.LittleEndian.Uint32(header[0:4]))
+		if good+binlogHeaderSize+size > info.Size() {
+			break
+		}
+
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			break
+		}
+
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+			pf("raft log: checksum mismatch at offset %d", good)
+			break
+		}
+
+		record := &raftRecord{}
+		if err := json.Unmarshal(payload, record); err != nil {
+			pf("raft log: %v at offset %d", err, good)
+			break
+		}
+
+		if !state.apply(record) {
+			pf("raft log: entry %d out of order at offset %d", record.Index, good)
+			break
+		}
+		good += int64(binlogHeaderSize + len(payload))
+	}
+
+	return state, good, nil
+}
+
+// reports false if record doesn't fit the state.
+func (state *raftState) apply(record *raftRecord) bool {
+	switch record.Kind {
+	case raftRecordVote:
+		state.term, state.votedFor = record.Term, record.Vote
+	case raftRecordBase:
+		state.baseIndex, state.baseTerm = record.Index, record.Term
+		state.log = nil
+	case raftRecordEntry:
+		last := state.baseIndex + uint64(len(state.log))
+		if record.Entry == nil || record.Index <= state.baseIndex || record.Index > last+1 {
+			return false
+		}
+		state.log = append(state.log[:record.Index-state.baseIndex-1], *record.Entry)
+	}
+	return true
+}
+
+// writes records and syncs them to disk.
+func (raftLog *raftLog) write(records ...*raftRecord) error {
+	frames := []byte{}
+	for _, record := range records {
+		payload, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		frames = append(frames, binlogFrame(payload)...)
+	}
+
+	_, err := raftLog.file.Write(frames)
+	if err != nil {
+		return err
+	}
+	return raftLog.file.Sync()
+}
+
+func (raftLog *raftLog) saveVote(term uint64, votedFor string) error {
+	return raftLog.write(&raftRecord{Kind: raftRecordVote, Term: term, Vote: votedFor})
+}
+
+// saves entries, the first of which is at index from.
+func (raftLog *raftLog) saveEntries(from uint64, entries []raftEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	records := make([]*raftRecord, len(entries))
+	for n := range entries {
+		records[n] = &raftRecord{Kind: raftRecordEntry, Index: from + uint64(n), Entry: &entries[n]}
+	}
+	return raftLog.write(records...)
+}
+
+// replaces the file with one holding just state, once the log was compacted
+// or replaced by a snapshot.
+func (raftLog *raftLog) rewrite(state *raftState) error {
+	temporary := raftLog.path + ".new"
+	file, err := os.OpenFile(temporary, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	previous := raftLog.file
+	raftLog.file = file
+	err = raftLog.write(
+		&raftRecord{Kind: raftRecordVote, Term: state.term, Vote: state.votedFor},
+		&raftRecord{Kind: raftRecordBase, Index: state.baseIndex, Term: state.baseTerm},
+	)
+	if err == nil {
+		err = raftLog.saveEntries(state.baseIndex+1, state.log)
+	}
+	if err == nil {
+		err = os.Rename(temporary, raftLog.path)
+	}
+	if err != nil {
+		raftLog.file = previous
+		file.Close()
+		os.Remove(temporary)
+		return err
+	}
+
+	previous.Close()
+	return nil
+}
+
+func (raftLog *raftLog) close() error {
+	return raftLog.file.Close()
+}
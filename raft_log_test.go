@@ -0,0 +1,89 @@
+package gostalk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/manveru/gobdd"
+)
+
+func init() {
+	defer PrintSpecReport()
+
+	Describe("raft log", func() {
+		dir, err := ioutil.TempDir("", "gostalk-raft")
+		Expect(err, ToBeNil)
+		defer os.RemoveAll(dir)
+
+		put := func(id jobId) *mutation {
+			return &mutation{Op: mutationPut, Job: &binlogRecord{Id: id}}
+		}
+
+		reopen := func() *raftState {
+			disk, state, err := openRaftLog(dir)
+			Expect(err, ToBeNil)
+			disk.close()
+			return state
+		}
+
+		It("starts out empty", func() {
+			state := reopen()
+			Expect(state.term, ToEqual, uint64(0))
+			Expect(len(state.log), ToEqual, 0)
+		})
+
+		It("keeps the term, vote and entries", func() {
+			disk, _, err := openRaftLog(dir)
+			Expect(err, ToBeNil)
+			Expect(disk.saveVote(2, "node-2"), ToBeNil)
+			Expect(disk.saveEntries(1, []raftEntry{{Term: 1}, {Term: 2, Mutation: put(0)}, {Term: 2, Mutation: put(1)}}), ToBeNil)
+			// a new leader replaced the last entry.
+			Expect(disk.saveVote(3, ""), ToBeNil)
+			Expect(disk.saveEntries(3, []raftEntry{{Term: 3}}), ToBeNil)
+			disk.close()
+
+			state := reopen()
+			Expect(state.term, ToEqual, uint64(3))
+			Expect(state.votedFor, ToEqual, "")
+			Expect(len(state.log), ToEqual, 3)
+			Expect(state.log[1].Mutation.Job.Id, ToEqual, jobId(0))
+			Expect(state.log[2].Term, ToEqual, uint64(3))
+		})
+
+		It("drops a record written partially", func() {
+			file, err := os.OpenFile(filepath.Join(dir, raftLogName), os.O_WRONLY|os.O_APPEND, 0600)
+			Expect(err, ToBeNil)
+			_, err = file.Write([]byte{42, 0, 0, 0, 1, 2})
+			Expect(err, ToBeNil)
+			file.Close()
+
+			state := reopen()
+			Expect(state.term, ToEqual, uint64(3))
+			Expect(len(state.log), ToEqual, 3)
+
+			disk, _, err := openRaftLog(dir)
+			Expect(err, ToBeNil)
+			Expect(disk.saveEntries(4, []raftEntry{{Term: 3, Mutation: put(2)}}), ToBeNil)
+			disk.close()
+			Expect(len(reopen().log), ToEqual, 4)
+		})
+
+		It("writes the file anew once compacted", func() {
+			disk, state, err := openRaftLog(dir)
+			Expect(err, ToBeNil)
+			state.baseIndex, state.baseTerm = 3, 3
+			state.log = state.log[3:]
+			Expect(disk.rewrite(state), ToBeNil)
+			Expect(disk.saveEntries(5, []raftEntry{{Term: 3, Mutation: put(3)}}), ToBeNil)
+			disk.close()
+
+			state = reopen()
+			Expect(state.term, ToEqual, uint64(3))
+			Expect(state.baseIndex, ToEqual, uint64(3))
+			Expect(state.baseTerm, ToEqual, uint64(3))
+			Expect(len(state.log), ToEqual, 2)
+			Expect(state.log[1].Mutation.Job.Id, ToEqual, jobId(3))
+		})
+	})
+}
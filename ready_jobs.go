@@ -1,6 +1,8 @@
 package gostalk
 
 import (
+	"time"
+
 	"code.google.com/p/go-priority-queue/prio"
 )
 
@@ -16,6 +18,8 @@ func (i *readyJobsItem) Index(n int) {
 
 type readyJobs struct {
 	prio.Queue
+	// ready jobs with a priority below URGENT_PRIORITY.
+	urgent int
 }
 
 func newReadyJobs() (jobs *readyJobs) {
@@ -25,18 +29,28 @@ func newReadyJobs() (jobs *readyJobs) {
 func (jobs *readyJobs) getJob() (j *job) {
 	j = (*job)(jobs.Pop().(*readyJobsItem))
 	j.jobHolder = nil
+	if j.isUrgent() {
+		jobs.urgent -= 1
+	}
 	return
 }
 
 func (jobs *readyJobs) putJob(j *job) {
 	j.jobHolder = jobs
 	j.state = jobReadyState
+	j.readyAt = time.Now()
 	jobs.Push((*readyJobsItem)(j))
+	if j.isUrgent() {
+		jobs.urgent += 1
+	}
 }
 
 func (jobs *readyJobs) deleteJob(j *job) {
 	jobs.Remove(j.index)
 	j.jobHolder = nil
+	if j.isUrgent() {
+		jobs.urgent -= 1
+	}
 }
 
 func (jobs *readyJobs) touchJob(j *job) {
@@ -48,5 +62,10 @@ func (jobs *readyJobs) buryJob(j *job) {
 }
 
 func (jobs *readyJobs) peekJob(request *jobPeekRequest) {
+	if jobs.Len() == 0 {
+		request.success <- nil
+		return
+	}
+
 	request.success <- (*job)(jobs.Peek().(*readyJobsItem))
 }
@@ -0,0 +1,551 @@
+package gostalk
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A replica connects to its primary like any client and sends "replicate".
+// The primary answers REPLICATING, then sends a line of JSON per mutation:
+// first a "sync" for every job it holds and a "pause" for every paused tube,
+// then "synced", then every change to its jobs as it happens. Mutations carry
+// the whole state of a job, so applying one twice does no harm.
+
+// what happened to a job, or tube for "pause".
+const (
+	mutationPut     = "put"
+	mutationReserve = "reserve"
+	mutationRelease = "release"
+	mutationBury    = "bury"
+	mutationKick    = "kick"
+	mutationTouch   = "touch"
+	mutationTimeout = "timeout"
+	mutationDelete  = "delete"
+	mutationPause   = "pause"
+	mutationSync    = "sync"   // a job as it was when the replica connected
+	mutationSynced  = "synced" // jobs not synced before this are gone
+)
+
+// how long a replica waits before connecting to its primary again.
+const replicaRetryDelay = 1 * time.Second
+
+// how long a replica waits for its primary to accept the connection.
+const replicaDialTimeout = 5 * time.Second
+
+// the most mutations a replica may fall behind before the primary drops it.
+// It then connects again and starts over with a snapshot.
+const replicaBacklog = 1 << 16
+
+var errReplicaOverrun = errors.New("gostalk: replica fell too far behind")
+
+type mutation struct {
+	Op             string        `json:"op"`
+	Job            *binlogRecord `json:"job,omitempty"`
+	Tube           string        `json:"tube,omitempty"`
+	PauseStartedAt time.Time     `json:"pause-started"`
+	PauseEndsAt    time.Time     `json:"pause-ends"`
+}
+
+// the mutations waiting to be sent to one replica.
+type replicaStream struct {
+	lock    sync.Mutex
+	queue   []*mutation
+	pending chan bool // receives once the queue isn't empty anymore
+	overrun bool
+}
+
+func (stream *replicaStream) push(m *mutation) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	if len(stream.queue) >= replicaBacklog {
+		stream.overrun = true
+		stream.queue = nil
+	}
+	if stream.overrun {
+		return
+	}
+
+	stream.queue = append(stream.queue, m)
+	select {
+	case stream.pending <- true:
+	default: // already pending
+	}
+}
+
+func (stream *replicaStream) take() ([]*mutation, bool) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	queue := stream.queue
+	stream.queue = nil
+	return queue, stream.overrun
+}
+
+// sends the state of a job the tube just changed to the replicas and the
+// cluster, if there are any. Must be called by the tube goroutine, or by
+// server.put before the tube has the job.
+func (tube *tube) publish(op string, job *job) {
+	if !tube.server.isPublishing() {
+		return
+	}
+
+	record := recordOf(job)
+	record.Tube = tube.name
+	if op == mutationPut {
+		record.Body = job.body
+	}
+	tube.server.broadcast(&mutation{Op: op, Job: record})
+}
+
+func (tube *tube) publishPause() {
+	if !tube.server.isPublishing() {
+		return
+	}
+
+	tube.server.broadcast(tube.pauseMutation())
+}
+
+// the pause of the tube, times are zero if it isn't paused.
+func (tube *tube) pauseMutation() *mutation {
+	return &mutation{
+		Op:             mutationPause,
+		Tube:           tube.name,
+		PauseStartedAt: tube.pauseStartedAt,
+		PauseEndsAt:    tube.pauseEndsAt,
+	}
+}
+
+// asks the tube goroutine for its pause, nil if the tube is gone.
+func (tube *tube) pauseState() *mutation {
+	success := make(chan *mutation)
+	select {
+	case tube.tubePaused <- success:
+		return <-success
+	case <-tube.stopped:
+		return nil
+	}
+}
+
+func (server *Server) isPublishing() bool {
+	return server.cluster != nil || atomic.LoadInt64(&server.stats.CurrentReplicas) > 0
+}
+
+func (server *Server) broadcast(m *mutation) {
+	if server.cluster != nil {
+		server.cluster.propose(m)
+	}
+
+	server.replicasLock.Lock()
+	defer server.replicasLock.Unlock()
+
+	for stream := range server.replicas {
+		stream.push(m)
+	}
+}
+
+// the mutations that bring a new replica up to date.
+func (server *Server) snapshot() []*mutation {
+	mutations := []*mutation{}
+
+	for _, job := range server.jobs.all() {
+		copy := job.snapshot()
+		if copy == nil {
+			continue
+		}
+
+		record := recordOf(copy)
+		record.Tube = copy.tube.name
+		record.Body = copy.body
+		mutations = append(mutations, &mutation{Op: mutationSync, Job: record})
+	}
+
+	for _, tube := range server.tubeList() {
+		pause := tube.pauseState()
+		if pause != nil && !pause.PauseEndsAt.IsZero() {
+			mutations = append(mutations, pause)
+		}
+	}
+
+	return append(mutations, &mutation{Op: mutationSynced})
+}
+
+// streams the jobs of the server and every change to them to the replica
+// connected as client, until either goes away.
+func (server *Server) replicateTo(client *client) error {
+	stream := &replicaStream{pending: make(chan bool, 1)}
+
+	// registered before the snapshot is taken, so no change falls between.
+	server.replicasLock.Lock()
+	server.replicas[stream] = true
+	server.replicasLock.Unlock()
+	atomic.AddInt64(&server.stats.CurrentReplicas, 1)
+
+	defer func() {
+		server.replicasLock.Lock()
+		delete(server.replicas, stream)
+		server.replicasLock.Unlock()
+		atomic.AddInt64(&server.stats.CurrentReplicas, -1)
+	}()
+
+	// a replica sends nothing after replicate, so reading only ends once it
+	// hangs up.
+	gone := make(chan bool)
+	go func() {
+		io.Copy(ioutil.Discard, client.reader)
+		close(gone)
+	}()
+
+	encoder := json.NewEncoder(client.writer)
+	_, err := client.writer.WriteString(MSG_REPLICATING)
+	if err != nil {
+		return err
+	}
+
+	mutations := server.snapshot()
+	for {
+		for _, m := range mutations {
+			err = encoder.Encode(m)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = client.writer.Flush()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-stream.pending:
+		case <-gone:
+			return nil
+		case <-server.quit:
+			return nil
+		}
+
+		var overrun bool
+		mutations, overrun = stream.take()
+		if overrun {
+			return errReplicaOverrun
+		}
+	}
+}
+
+func (server *Server) isReplica() bool {
+	return atomic.LoadInt32(&server.replica) == 1
+}
+
+// connects to the primary and applies what it streams until the server is
+// promoted or shut down, connecting again whenever the connection fails.
+func (server *Server) follow() {
+	defer server.conns.Done()
+	defer close(server.followed)
+
+	for {
+		err := server.followOnce()
+		if !server.isReplica() || server.isClosed() {
+			return
+		}
+		pf("replicating %s: %v", server.config.ReplicaOf, err)
+
+		select {
+		case <-time.After(replicaRetryDelay):
+		case <-server.quit:
+			return
+		case <-server.promoted:
+			return
+		}
+	}
+}
+
+func (server *Server) followOnce() error {
+	// gives up dialing once the server shuts down or is promoted.
+	ctx, cancel := context.WithTimeout(context.Background(), replicaDialTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-server.quit:
+		case <-server.promoted:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	conn, err := server.dialNode(ctx, server.config.ReplicaOf)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Shutdown and promote close the connection to stop the replication.
+	server.connLock.Lock()
+	if server.isClosed() || !server.isReplica() {
+		server.connLock.Unlock()
+		return ErrServerClosed
+	}
+	server.upstream = conn
+	server.connLock.Unlock()
+
+	defer func() {
+		server.connLock.Lock()
+		server.upstream = nil
+		server.connLock.Unlock()
+	}()
+
+	reader := bufio.NewReader(conn)
+	err = server.login(conn, reader, "replicate", MSG_REPLICATING)
+	if err != nil {
+		return err
+	}
+
+	// jobs of the snapshot, nil once it's complete.
+	synced := map[jobId]bool{}
+	decoder := json.NewDecoder(reader)
+	for {
+		m := &mutation{}
+		err = decoder.Decode(m)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case m.Op == mutationSynced:
+			server.dropUnsynced(synced)
+			synced = nil
+			continue
+		case m.Op == mutationSync && synced != nil:
+			synced[m.Job.Id] = true
+		}
+		server.apply(m)
+	}
+}
+
+// connects to another server at addr, which is a host and port or starts with
+// tcp://, tls:// or unix://.
+func (server *Server) dialNode(ctx context.Context, addr string) (net.Conn, error) {
+	network, address := "tcp", strings.TrimPrefix(addr, "tcp://")
+	if strings.HasPrefix(addr, "unix://") {
+		network, address = "unix", strings.TrimPrefix(addr, "unix://")
+	}
+
+	dialer := &net.Dialer{}
+	if strings.HasPrefix(addr, "tls://") {
+		// the server name is taken from the host of the address.
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: server.dialTLS}
+		return tlsDialer.DialContext(ctx, network, strings.TrimPrefix(addr, "tls://"))
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// authenticates at another server as config.ReplicaUser if set, then sends
+// command and checks it is answered with expected.
+func (server *Server) login(conn net.Conn, reader *bufio.Reader, command, expected string) error {
+	if server.config.ReplicaUser != "" {
+		fmt.Fprintf(conn, "auth %s %s\r\n", server.config.ReplicaUser, server.config.ReplicaPassword)
+		err := expectLine(reader, MSG_AUTHENTICATED)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(conn, "%s\r\n", command)
+	return expectLine(reader, expected)
+}
+
+func expectLine(reader *bufio.Reader, expected string) error {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line != expected {
+		return fmt.Errorf("gostalk: primary answered %q", strings.TrimSpace(line))
+	}
+	return nil
+}
+
+// deletes the jobs the replica has from before it connected that the primary
+// doesn't have anymore.
+func (server *Server) dropUnsynced(synced map[jobId]bool) {
+	for _, job := range server.jobs.all() {
+		if !synced[job.id] {
+			server.apply(&mutation{Op: mutationDelete, Job: &binlogRecord{Id: job.id}})
+		}
+	}
+}
+
+// applies the mutations of a snapshot, deleting the jobs it doesn't have.
+func (server *Server) installSnapshot(mutations []*mutation) {
+	synced := map[jobId]bool{}
+	for _, m := range mutations {
+		switch m.Op {
+		case mutationSynced:
+			server.dropUnsynced(synced)
+			continue
+		case mutationSync:
+			synced[m.Job.Id] = true
+		}
+		server.apply(m)
+	}
+}
+
+// hands a mutation from the primary to the tube it is about.
+func (server *Server) apply(m *mutation) {
+	if m.Job == nil && m.Op != mutationPause {
+		return
+	}
+
+	server.noteJobId(m)
+
+	for {
+		var tube *tube
+		if m.Job == nil {
+			tube = server.findOrCreateTube(m.Tube)
+		} else if job, found := server.jobs.find(m.Job.Id); found {
+			tube = job.tube
+			// a stale cluster node may hold another job under the id, one its
+			// leader put but never committed.
+			if (m.Op == mutationPut || m.Op == mutationSync) && !job.createdAt.Equal(m.Job.CreatedAt) {
+				server.apply(&mutation{Op: mutationDelete, Job: &binlogRecord{Id: job.id}})
+				continue
+			}
+		} else if m.Op == mutationDelete {
+			return
+		} else {
+			tube = server.findOrCreateTube(m.Job.Tube)
+		}
+
+		select {
+		case tube.jobSync <- m:
+			return
+		case <-tube.stopped:
+			// collected before it got the mutation, a new one takes it.
+		}
+	}
+}
+
+// keeps nextJobId beyond the job of a mutation from the primary or the leader.
+func (server *Server) noteJobId(m *mutation) {
+	if m.Job != nil && m.Job.Id >= server.nextJobId {
+		server.nextJobId = m.Job.Id + 1
+	}
+}
+
+// applies a mutation from the primary to a job of this tube, creating the job
+// if it's new, or to the pause of the tube.
+func (tube *tube) sync(m *mutation) {
+	if m.Op == mutationPause {
+		tube.unpause()
+		if m.PauseEndsAt.After(time.Now()) {
+			tube.paused = true
+			tube.pauseStartedAt = m.PauseStartedAt
+			tube.pauseEndsAt = m.PauseEndsAt
+		}
+		return
+	}
+
+	record := m.Job
+	job, found := tube.server.jobs.find(record.Id)
+
+	if m.Op == mutationDelete {
+		if found && job.jobHolder != nil && tube.server.jobs.remove(job.id) {
+			job.jobHolder.deleteJob(job)
+			tube.server.binlog.deleteJob(job)
+			tube.stats.CmdDelete += 1
+			tube.server.free(job)
+		}
+		return
+	}
+
+	if !found && m.Op != mutationPut && m.Op != mutationSync {
+		// the put of the job never arrived, only a snapshot has its body.
+		tube.server.resync()
+		return
+	}
+
+	if found {
+		if job.jobHolder != nil {
+			job.jobHolder.deleteJob(job)
+		}
+		record.copyTo(job)
+	} else {
+		job = record.job()
+		job.tube = tube
+		tube.server.allocateAlways(job)
+		tube.server.binlog.putJob(job, tube)
+		atomic.AddInt64(&tube.server.stats.TotalJobs, 1)
+		tube.stats.TotalJobs += 1
+	}
+
+	switch record.State {
+	case jobReservedState:
+		job.client = nil
+		job.reservedAt = time.Now()
+		tube.reserved.putJob(job)
+	case jobBuriedState:
+		job.state = jobBuriedState
+		tube.buried.putJob(job)
+	case jobDelayedState, jobWillHaveDelayedState:
+		tube.delayed.putJob(job)
+	default:
+		tube.ready.putJob(job)
+	}
+
+	if found {
+		tube.server.binlog.updateJob(job)
+	} else {
+		tube.server.jobs.add(job)
+	}
+}
+
+// asks for a snapshot of the jobs: a replica connects to the primary again,
+// a cluster node turns stale until its leader sent one.
+func (server *Server) resync() {
+	if server.cluster != nil {
+		server.cluster.lock.Lock()
+		server.cluster.stale = true
+		server.cluster.lock.Unlock()
+		return
+	}
+
+	server.connLock.Lock()
+	if server.upstream != nil {
+		server.upstream.Close()
+	}
+	server.connLock.Unlock()
+}
+
+// turns a replica into a primary: it stops following, takes commands that
+// change jobs and hands out ids after the highest one it has seen.
+func (server *Server) promote() {
+	if !atomic.CompareAndSwapInt32(&server.replica, 1, 0) {
+		return
+	}
+
+	server.connLock.Lock()
+	if server.upstream != nil {
+		server.upstream.Close()
+	}
+	server.connLock.Unlock()
+	close(server.promoted)
+
+	// no more jobs come in once it's done.
+	<-server.followed
+	if server.isClosed() {
+		return
+	}
+
+	server.routines.Add(1)
+	go server.runGetJobId(server.nextJobId)
+}
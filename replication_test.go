@@ -0,0 +1,220 @@
+package gostalk
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/manveru/gobdd"
+)
+
+func init() {
+	defer PrintSpecReport()
+
+	Describe("replication", func() {
+		_, primaryAddr := startServer(DefaultConfig())
+		producer := dialStats(primaryAddr)
+		defer producer.conn.Close()
+		worker := dialStats(primaryAddr)
+		defer worker.conn.Close()
+
+		// put before the replica exists, so it has to come with the snapshot.
+		producer.do("use mail")
+		producer.do("put 10 0 60 5\r\nfirst")
+
+		config := DefaultConfig()
+		config.ReplicaOf = primaryAddr
+		_, replicaAddr := startServer(config)
+		observer := dialStats(replicaAddr)
+		defer observer.conn.Close()
+		observer.do("use mail")
+
+		It("receives the jobs the primary had", func() {
+			stats := observer.awaitStat("stats-tube mail", "current-jobs-ready", 1)
+			Expect(stats["current-jobs-ready"], ToEqual, 1)
+			Expect(observer.do("peek 0"), ToEqual, "FOUND 0 5")
+			Expect(readResponseWithoutBody(observer.reader), ToEqual, "first")
+		})
+
+		It("reports being a replica in stats", func() {
+			Expect(observer.stats("stats")["replica"], ToEqual, true)
+			Expect(producer.awaitStat("stats", "current-replicas", 1)["current-replicas"], ToEqual, 1)
+		})
+
+		It("follows the jobs put, reserved, buried and deleted on the primary", func() {
+			producer.do("put 20 0 60 6\r\nsecond")
+			producer.do("put 30 0 60 5\r\nthird")
+			worker.do("watch mail")
+			worker.do("ignore default")
+			Expect(worker.reserve("reserve").id, ToEqual, jobId(0))
+			Expect(worker.reserve("reserve").id, ToEqual, jobId(1))
+			worker.do("bury 0 10")
+			Expect(worker.do("delete 1"), ToEqual, "DELETED")
+			Expect(worker.reserve("reserve").id, ToEqual, jobId(2))
+
+			stats := observer.awaitStat("stats-tube mail", "current-jobs-reserved", 1)
+			Expect(stats["current-jobs-ready"], ToEqual, 0)
+			Expect(stats["current-jobs-reserved"], ToEqual, 1)
+			Expect(stats["current-jobs-buried"], ToEqual, 1)
+			Expect(observer.do("peek 1"), ToEqual, "NOT_FOUND")
+			Expect(observer.do("peek-buried"), ToEqual, "FOUND 0 5")
+			Expect(readResponseWithoutBody(observer.reader), ToEqual, "first")
+		})
+
+		It("follows kicks, releases and pauses", func() {
+			Expect(producer.do("kick 1"), ToEqual, "KICKED 1")
+			Expect(worker.do("release 2 40 0"), ToEqual, "RELEASED")
+			Expect(producer.do("pause-tube mail 60"), ToEqual, "PAUSED")
+
+			stats := observer.awaitStat("stats-tube mail", "current-jobs-ready", 2)
+			Expect(stats["current-jobs-ready"], ToEqual, 2)
+			Expect(stats["current-jobs-reserved"], ToEqual, 0)
+			Expect(stats["current-jobs-buried"], ToEqual, 0)
+			stats = observer.awaitStat("stats-tube mail", "pause", 60)
+			Expect(stats["pause"], ToEqual, 60)
+
+			stats = observer.stats("stats-job 0")
+			Expect(stats["kicks"], ToEqual, 1)
+			Expect(stats["buries"], ToEqual, 1)
+			stats = observer.stats("stats-job 2")
+			Expect(stats["releases"], ToEqual, 1)
+			Expect(stats["pri"], ToEqual, 40)
+		})
+
+		It("refuses commands that change jobs", func() {
+			Expect(observer.do("put 0 0 60 5\r\nhello"), ToEqual, "READ_ONLY")
+			Expect(observer.do("delete 0"), ToEqual, "READ_ONLY")
+			Expect(observer.do("kick 1"), ToEqual, "READ_ONLY")
+			Expect(observer.do("reserve-with-timeout 0"), ToEqual, "READ_ONLY")
+			Expect(observer.do("pause-tube mail 0"), ToEqual, "READ_ONLY")
+			Expect(observer.do("list-tube-used"), ToEqual, "USING mail")
+		})
+
+		It("becomes a primary when promoted", func() {
+			Expect(observer.do("promote"), ToEqual, "PROMOTED")
+			Expect(observer.stats("stats")["replica"], ToEqual, false)
+			Expect(producer.awaitStat("stats", "current-replicas", 0)["current-replicas"], ToEqual, 0)
+
+			// ids carry on after the highest one replicated.
+			Expect(observer.do("put 0 0 60 5\r\nfifth"), ToEqual, "INSERTED 3")
+			Expect(observer.do("delete 0"), ToEqual, "DELETED")
+			Expect(observer.do("promote"), ToEqual, "PROMOTED")
+		})
+
+		It("stops following the old primary once promoted", func() {
+			producer.do("put 0 0 60 5\r\nsixth")
+			time.Sleep(50 * time.Millisecond)
+			Expect(observer.do("peek 3"), ToEqual, "FOUND 3 5")
+			Expect(readResponseWithoutBody(observer.reader), ToEqual, "fifth")
+			Expect(observer.stats("stats-tube mail")["total-jobs"], ToEqual, 4)
+		})
+	})
+
+	Describe("replication after reconnecting", func() {
+		_, primaryAddr := startServer(DefaultConfig())
+		producer := dialStats(primaryAddr)
+		defer producer.conn.Close()
+		producer.do("put 0 0 60 4\r\ngone")
+
+		config := DefaultConfig()
+		config.ReplicaOf = primaryAddr
+		replica, replicaAddr := startServer(config)
+		observer := dialStats(replicaAddr)
+		defer observer.conn.Close()
+
+		It("drops the jobs the primary deleted meanwhile", func() {
+			observer.awaitStat("stats", "current-jobs-ready", 1)
+
+			// cut the stream, the replica has to catch up from the snapshot it
+			// gets once it's back.
+			replica.connLock.Lock()
+			replica.upstream.Close()
+			replica.connLock.Unlock()
+			Expect(producer.do("delete 0"), ToEqual, "DELETED")
+			producer.do("put 0 0 60 4\r\nkept")
+
+			// the replica waits a second before connecting again.
+			time.Sleep(replicaRetryDelay)
+			stats := observer.awaitStat("stats", "total-jobs", 2)
+			Expect(stats["total-jobs"], ToEqual, 2)
+			Expect(stats["current-jobs-ready"], ToEqual, 1)
+			Expect(observer.do("peek 0"), ToEqual, "NOT_FOUND")
+			Expect(observer.do("peek 1"), ToEqual, "FOUND 1 4")
+			Expect(readResponseWithoutBody(observer.reader), ToEqual, "kept")
+			Expect(producer.stats("stats")["cmd-replicate"], ToEqual, 2)
+		})
+
+		It("connects again for jobs whose put it missed", func() {
+			replica.apply(&mutation{Op: mutationBury, Job: &binlogRecord{Id: 7, Tube: "default", State: jobBuriedState}})
+			Expect(observer.do("peek 7"), ToEqual, "NOT_FOUND")
+
+			time.Sleep(replicaRetryDelay)
+			stats := producer.awaitStat("stats", "cmd-replicate", 3)
+			Expect(stats["cmd-replicate"], ToEqual, 3)
+			Expect(observer.do("peek 1"), ToEqual, "FOUND 1 4")
+			Expect(readResponseWithoutBody(observer.reader), ToEqual, "kept")
+		})
+	})
+
+	Describe("replication over TLS", func() {
+		dir, err := ioutil.TempDir("", "gostalk-tls")
+		Expect(err, ToBeNil)
+		defer os.RemoveAll(dir)
+		ca, caKey := writeCertificate(dir, "ca", nil, nil)
+		writeCertificate(dir, "server", ca, caKey)
+		writeCertificate(dir, "client", ca, caKey)
+		writeCertificate(dir, "other", nil, nil)
+
+		// the primary asks for client certificates on tlsAddr, producers use
+		// the plain primaryAddr.
+		config := DefaultConfig()
+		config.TLSCert = filepath.Join(dir, "server.pem")
+		config.TLSKey = filepath.Join(dir, "server-key.pem")
+		config.TLSClientCA = filepath.Join(dir, "ca.pem")
+		primary, err := New(config)
+		Expect(err, ToBeNil)
+		plain, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err, ToBeNil)
+		go primary.serve(plain)
+		primaryAddr := plain.Addr().String()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err, ToBeNil)
+		go primary.Serve(listener)
+		tlsAddr := "tls://" + listener.Addr().String()
+
+		producer := dialStats(primaryAddr)
+		defer producer.conn.Close()
+		producer.do("put 0 0 60 6\r\nsecret")
+
+		config = DefaultConfig()
+		config.ReplicaOf = tlsAddr
+		config.ReplicaCA = filepath.Join(dir, "ca.pem")
+		config.ReplicaCert = filepath.Join(dir, "client.pem")
+		config.ReplicaKey = filepath.Join(dir, "client-key.pem")
+		_, replicaAddr := startServer(config)
+		observer := dialStats(replicaAddr)
+		defer observer.conn.Close()
+
+		It("follows a primary at a tls:// address", func() {
+			observer.awaitStat("stats", "current-jobs-ready", 1)
+			Expect(peekBody(&clusterNode{conn: observer}, 0), ToEqual, "secret")
+			Expect(producer.stats("stats")["current-replicas"], ToEqual, 1)
+		})
+
+		It("doesn't trust a primary signed by another CA", func() {
+			config := DefaultConfig()
+			config.ReplicaCA = filepath.Join(dir, "other.pem")
+			server, err := New(config)
+			Expect(err, ToBeNil)
+			defer server.Shutdown(context.Background())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			defer cancel()
+			_, err = server.dialNode(ctx, tlsAddr)
+			Expect(err == nil, ToEqual, false)
+		})
+	})
+}
@@ -26,24 +26,51 @@ func newReservedJobs() (jobs *reservedJobs) {
 func (jobs *reservedJobs) getJob() (j *job) {
 	j = (*job)(jobs.Pop().(*reservedJobsItem))
 	j.jobHolder = nil
+	if j.client != nil {
+		j.client.removeReservedJob(j)
+	}
 	return
 }
 
+func (jobs *reservedJobs) peek() *job {
+	return (*job)(jobs.Peek().(*reservedJobsItem))
+}
+
+// returns a channel that receives once the earliest reservation runs out, or
+// nil if there are no reserved jobs.
+func (jobs *reservedJobs) expiry() <-chan time.Time {
+	if jobs.Len() == 0 {
+		return nil
+	}
+
+	return time.After(jobs.peek().reserveEndsAt.Sub(time.Now()))
+}
+
 func (jobs *reservedJobs) putJob(j *job) {
 	j.jobHolder = jobs
 	j.state = jobReservedState
+	j.reserveEndsAt = time.Now().Add(j.timeToReserve)
 	jobs.Push((*reservedJobsItem)(j))
+	if j.client != nil {
+		j.client.addReservedJob(j)
+	}
 }
 
 func (jobs *reservedJobs) deleteJob(j *job) {
 	jobs.Remove(j.index)
 	j.jobHolder = nil
+	if j.client != nil {
+		j.client.removeReservedJob(j)
+	}
 }
 
 func (jobs *reservedJobs) touchJob(j *job) {
 	jobs.Remove(j.index)
 	j.reserveEndsAt = time.Now().Add(j.timeToReserve)
 	jobs.Push((*reservedJobsItem)(j))
+	if j.client != nil {
+		j.client.addReservedJob(j)
+	}
 }
 
 func (jobs *reservedJobs) buryJob(j *job) {
@@ -52,5 +79,5 @@ func (jobs *reservedJobs) buryJob(j *job) {
 }
 
 func (jobs *reservedJobs) peekJob(request *jobPeekRequest) {
-	request.success <- (*job)(jobs.Peek().(*reservedJobsItem))
+	request.success <- jobs.peek()
 }
@@ -1,75 +1,635 @@
 package gostalk
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-type server struct {
+// ErrServerClosed is returned by Serve once Shutdown was called.
+var ErrServerClosed = errors.New("gostalk: server closed")
+
+// Server is a beanstalkd compatible job queue. Create it with New, then hand
+// it listeners with Serve.
+type Server struct {
+	// bytes taken by jobs, first so it stays aligned for atomic access.
+	memory int64
+
 	getJobId  chan jobId
-	jobs      map[jobId]*job
+	setJobId  chan jobId
+	jobs      *jobRegistry
 	tubes     map[string]*tube
+	tubesLock sync.Mutex
+	binlog    *binlog
 	startedAt time.Time
+	config    Config
+	tls       *tls.Config
+	dialTLS   *tls.Config         // for the primary or other nodes at tls://
+	users     map[string]*account // nil unless clients have to authenticate
+	draining  int32
 	stats     *serverStats
+
+	// set while the server follows the primary at config.ReplicaOf.
+	replica int32
+	// the connection to the primary, guarded by connLock.
+	upstream net.Conn
+	// closed on promotion, and once the replica stopped following.
+	promoted, followed chan bool
+	// one more than the highest job id restored or replicated.
+	nextJobId jobId
+
+	// the streams to replicas of this server.
+	replicas     map[*replicaStream]bool
+	replicasLock sync.Mutex
+
+	// nil unless the server is a node of a cluster.
+	cluster *raftNode
+
+	// hold the jobs reserved through the HTTP gateway, one for each user.
+	gateways    map[*account]*client
+	gatewayLock sync.Mutex
+
+	// time jobs spend ready before being reserved, and reserved before being
+	// deleted.
+	waitTime, processingTime *histogram
+
+	// closed once Shutdown is called, tells everyone waiting to give up.
+	quit     chan bool
+	quitOnce sync.Once
+	// closed once every connection is gone, stops the tube goroutines.
+	halt chan bool
+	// closed once the shutdown is complete, shutdownErr is what it ended with.
+	shutdown    chan bool
+	shutdownErr error
+
+	listeners []net.Listener // in the order they were handed to Serve
+	webs      map[*http.Server]bool
+	clients   map[*client]bool
+	connLock  sync.Mutex
+	conns     sync.WaitGroup
+	routines  sync.WaitGroup
+}
+
+// New returns a server configured by config, restoring the jobs in its
+// binlog if it has one.
+func New(config Config) (*Server, error) {
+	return newServer(config, nil)
 }
 
-func newServer() *server {
-	s := &server{
+// creates a server whose cluster node calls the others through transport,
+// or over their client port if it's nil.
+func newServer(config Config, transport raftTransport) (*Server, error) {
+	if config.ClusterAddr != "" && config.ReplicaOf != "" {
+		return nil, errors.New("gostalk: a node of a cluster can't be a replica")
+	}
+	if config.ClusterAddr != "" && config.BinlogDir == "" {
+		return nil, errors.New("gostalk: a node of a cluster needs binlog-dir for its log")
+	}
+
+	if config.Verbose {
+		atomic.StoreInt32(&verbose, 1)
+	}
+
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialTLS, err := config.dialTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
 		getJobId:  make(chan jobId, 42),
+		setJobId:  make(chan jobId),
 		tubes:     make(map[string]*tube),
-		jobs:      make(map[jobId]*job),
+		jobs:      newJobRegistry(),
 		startedAt: time.Now(),
+		config:    config,
+		tls:       tlsConfig,
+		dialTLS:   dialTLS,
+		quit:      make(chan bool),
+		halt:      make(chan bool),
+		shutdown:  make(chan bool),
+		webs:      make(map[*http.Server]bool),
+		clients:   make(map[*client]bool),
+		promoted:  make(chan bool),
+		followed:  make(chan bool),
+		replicas:  make(map[*replicaStream]bool),
 		stats: &serverStats{
-			Version:    GOSTALK_VERSION,
-			PID:        os.Getpid(),
-			MaxJobSize: JOB_DATA_SIZE_LIMIT,
+			Version:        GOSTALK_VERSION,
+			PID:            os.Getpid(),
+			MaxJobSize:     config.MaxJobSize,
+			MaxMemoryBytes: config.MaxMemory,
 		},
+		waitTime:       newHistogram(),
+		processingTime: newHistogram(),
+	}
+
+	s.gateways = map[*account]*client{}
+
+	if config.AuthFile != "" {
+		s.users, err = readUsers(config.AuthFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.BinlogDir != "" {
+		binlog, records, err := openBinlog(config.BinlogDir, config.BinlogMaxSize, config.BinlogFsyncInterval, s.stats)
+		if err != nil {
+			return nil, err
+		}
+		s.binlog = binlog
+		s.nextJobId = s.restore(records)
+	}
+
+	// replicas hand out no ids until they are promoted.
+	if config.ReplicaOf != "" {
+		s.replica = 1
+		s.conns.Add(1)
+		go s.follow()
+	} else {
+		close(s.followed)
+		s.routines.Add(1)
+		go s.runGetJobId(s.nextJobId)
+	}
+
+	if config.ClusterAddr != "" {
+		if transport == nil {
+			transport = newTCPTransport(s)
+		}
+		s.cluster, err = newRaftNode(s, transport)
+		if err != nil {
+			return nil, err
+		}
+		s.cluster.start()
+	}
+
+	return s, nil
+}
+
+// returned by ServeTLS when the config has no certificate.
+var errNoTLS = errors.New("gostalk: TLS needs tls-cert and tls-key")
+
+// ServeTLS is like Serve, but fails unless the config has a certificate.
+func (server *Server) ServeTLS(listener net.Listener) error {
+	if server.tls == nil {
+		listener.Close()
+		return errNoTLS
+	}
+	return server.Serve(listener)
+}
+
+// Serve accepts connections on listener until it fails or Shutdown is called.
+// It always returns an error, ErrServerClosed after Shutdown. The listener is
+// closed on return. Connections speak TLS if the config asks for it. A server
+// can serve any number of listeners at once.
+func (server *Server) Serve(listener net.Listener) error {
+	if server.tls != nil {
+		listener = tls.NewListener(listener, server.tls)
+	}
+	return server.serve(listener)
+}
+
+// serves listener as it is, for the tcp:// and unix:// addresses of the
+// config.
+func (server *Server) serve(listener net.Listener) error {
+	if !server.track(listener) {
+		listener.Close()
+		return ErrServerClosed
+	}
+	defer server.untrack(listener)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if server.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		p("Accepted Connection:", conn)
+		raw := conn
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			raw = tlsConn.NetConn()
+		}
+		if tcpConn, ok := raw.(*net.TCPConn); ok {
+			err = tcpConn.SetKeepAlive(true)
+			if err != nil {
+				p("conn.SetKeepAlive", err)
+				conn.Close()
+				continue
+			}
+		}
+
+		if !server.addConn() {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go server.accept(conn)
+	}
+}
+
+// ServeHTTPListener answers HTTP requests on listener with Handler until
+// Shutdown is called, over TLS if the config asks for it.
+func (server *Server) ServeHTTPListener(listener net.Listener) error {
+	web := &http.Server{Handler: server.Handler()}
+	if server.tls != nil {
+		listener = tls.NewListener(listener, server.tls)
+	}
+
+	server.connLock.Lock()
+	if server.isClosed() {
+		server.connLock.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	server.webs[web] = true
+	server.connLock.Unlock()
+
+	err := web.Serve(listener)
+
+	server.connLock.Lock()
+	delete(server.webs, web)
+	server.connLock.Unlock()
+
+	if err == http.ErrServerClosed {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// Addr returns the address of the first listener handed to Serve that is
+// still served, or nil.
+func (server *Server) Addr() net.Addr {
+	server.connLock.Lock()
+	defer server.connLock.Unlock()
+
+	if len(server.listeners) == 0 {
+		return nil
+	}
+	return server.listeners[0].Addr()
+}
+
+// Shutdown stops accepting connections, closes the open ones, stops the tubes
+// and closes the binlog. If ctx is done first, its error is returned and the
+// rest of the shutdown carries on in the background.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.quitOnce.Do(func() {
+		close(server.quit)
+
+		server.connLock.Lock()
+		for _, listener := range server.listeners {
+			listener.Close()
+		}
+		for web := range server.webs {
+			web.Close()
+		}
+		for client := range server.clients {
+			client.conn.Close()
+		}
+		if server.upstream != nil {
+			server.upstream.Close()
+		}
+		server.connLock.Unlock()
+
+		go func() {
+			// jobs of closing connections are released through their tubes, so
+			// the tubes have to outlive the connections.
+			server.conns.Wait()
+			close(server.halt)
+			server.routines.Wait()
+			server.shutdownErr = server.binlog.close()
+			close(server.shutdown)
+		}()
+	})
+
+	// later calls wait for the same shutdown, like a retry after ctx ran out.
+	select {
+	case <-server.shutdown:
+		return server.shutdownErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (server *Server) isClosed() bool {
+	select {
+	case <-server.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (server *Server) track(listener net.Listener) bool {
+	server.connLock.Lock()
+	defer server.connLock.Unlock()
+
+	if server.isClosed() {
+		return false
+	}
+	server.listeners = append(server.listeners, listener)
+	return true
+}
+
+// counts a new connection unless the server is shutting down, so Shutdown
+// doesn't stop waiting too early.
+func (server *Server) addConn() bool {
+	server.connLock.Lock()
+	defer server.connLock.Unlock()
+
+	if server.isClosed() {
+		return false
+	}
+	server.conns.Add(1)
+	return true
+}
+
+func (server *Server) untrack(listener net.Listener) {
+	server.connLock.Lock()
+	defer server.connLock.Unlock()
+
+	listener.Close()
+	for n, tracked := range server.listeners {
+		if tracked == listener {
+			server.listeners = append(server.listeners[:n], server.listeners[n+1:]...)
+			break
+		}
+	}
+}
+
+// puts the jobs replayed from the binlog back into their tubes and returns
+// the id the next new job should get.
+func (server *Server) restore(records []*binlogRecord) (nextJobId jobId) {
+	for _, record := range records {
+		job := record.job()
+		job.tube = server.findOrCreateTube(record.Tube)
+		server.allocateAlways(job)
+		atomic.AddInt64(&server.stats.TotalJobs, 1)
+		job.tube.jobSupply <- job
+		server.jobs.add(job)
+
+		if job.id >= nextJobId {
+			nextJobId = job.id + 1
+		}
+	}
+
+	return
+}
+
+// puts a new job into tube. Returns nil and the answer to give instead if the
+// job can't be taken.
+func (server *Server) put(tube *tube, priority uint32, delay, ttr int64, body []byte) (*job, string) {
+	if ttr < 1 {
+		ttr = 1
+	}
+
+	if len(body) > server.config.MaxJobSize {
+		return nil, MSG_JOB_TOO_BIG
+	}
+
+	if refusal := server.writeRefusal(); refusal != "" {
+		return nil, refusal
+	}
+
+	if server.isDraining() {
+		return nil, MSG_DRAINING
+	}
+
+	// taken before the job id, so rejected jobs don't leave gaps.
+	if !server.allocate(tube, jobMemory(len(body))) {
+		return nil, MSG_OUT_OF_MEMORY
+	}
+
+	id := <-server.getJobId
+	job := newJob(id, priority, delay, ttr, body)
+	job.tube = tube
+
+	err := server.binlog.putJob(job, tube)
+	if err != nil {
+		server.free(job)
+		return nil, MSG_INTERNAL_ERROR
+	}
+
+	// registered before the tube has it, so a worker reserving it right away
+	// can delete it. Until then the tube answers for it as if it were gone.
+	server.jobs.add(job)
+
+	// published before the tube has it, so it reaches replicas before any
+	// change to it. A replica registering meanwhile may miss it, and asks for
+	// another snapshot once a change to it arrives.
+	tube.publish(mutationPut, job)
+
+	select {
+	case tube.jobSupply <- job:
+	case <-tube.stopped:
+		server.unput(job)
+		return nil, MSG_INTERNAL_ERROR
+	case <-server.halt:
+		server.unput(job)
+		return nil, MSG_INTERNAL_ERROR
 	}
 
-	go s.runGetJobId()
+	atomic.AddInt64(&server.stats.TotalJobs, 1)
+	return job, ""
+}
+
+// takes back a job whose tube stopped before it could take it.
+func (server *Server) unput(job *job) {
+	server.jobs.remove(job.id)
+	server.binlog.deleteJob(job)
+	server.free(job)
+	job.tube.publish(mutationDelete, job)
+}
+
+// stops accepting new jobs, so the server can be emptied by its workers
+// before it is shut down.
+func (server *Server) drain() {
+	atomic.StoreInt32(&server.draining, 1)
+}
+
+func (server *Server) isDraining() bool {
+	return atomic.LoadInt32(&server.draining) == 1
+}
 
-	return s
+// the answer to commands that change jobs, empty if the server takes them.
+func (server *Server) writeRefusal() string {
+	if server.isReplica() {
+		return MSG_READ_ONLY
+	}
+	if server.cluster != nil {
+		return server.cluster.refusal()
+	}
+	return ""
 }
 
-func (server *server) runGetJobId() {
-	var n jobId
+// enters drain mode on SIGUSR1 until the server is shut down.
+func (server *Server) drainOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-signals:
+				server.drain()
+			case <-server.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (server *Server) runGetJobId(n jobId) {
+	defer server.routines.Done()
+
 	for {
-		server.getJobId <- n
-		n = n + 1
+		select {
+		case server.getJobId <- n:
+			n = n + 1
+		case n = <-server.setJobId:
+			// ids taken before belong to the sequence given up.
+			for len(server.getJobId) > 0 {
+				<-server.getJobId
+			}
+		case <-server.halt:
+			return
+		}
 	}
 }
 
-// TODO: get rid of unused tubes.
-func (server *server) findOrCreateTube(name string) *tube {
-	tube, found := server.findTube(name)
+func (server *Server) findOrCreateTube(name string) *tube {
+	server.tubesLock.Lock()
+	defer server.tubesLock.Unlock()
+	return server.findOrCreateTubeLocked(name)
+}
+
+func (server *Server) findOrCreateTubeLocked(name string) *tube {
+	tube, found := server.tubes[name]
 
 	if !found {
-		tube = newTube(name)
+		tube = newTube(name, server)
 		server.tubes[name] = tube
 	}
 
 	return tube
 }
 
-func (server *server) findJob(id jobId) (job *job, found bool) {
-	job, found = server.jobs[id]
-	return
+// returns the named tube for a client that starts using it.
+func (server *Server) useTube(name string) *tube {
+	server.tubesLock.Lock()
+	defer server.tubesLock.Unlock()
+
+	tube := server.findOrCreateTubeLocked(name)
+	tube.using += 1
+	return tube
+}
+
+func (server *Server) unuseTube(tube *tube) {
+	server.tubesLock.Lock()
+	defer server.tubesLock.Unlock()
+
+	tube.using -= 1
+	tube.check()
+}
+
+// returns the named tube for a client that starts watching it.
+func (server *Server) watchTube(name string) *tube {
+	server.tubesLock.Lock()
+	defer server.tubesLock.Unlock()
+
+	tube := server.findOrCreateTubeLocked(name)
+	tube.watching += 1
+	return tube
+}
+
+func (server *Server) unwatchTube(tube *tube) {
+	server.tubesLock.Lock()
+	defer server.tubesLock.Unlock()
+
+	tube.watching -= 1
+	tube.check()
+}
+
+// removes a tube nobody uses or watches anymore. The default tube is never
+// removed.
+func (server *Server) removeTube(tube *tube) bool {
+	server.tubesLock.Lock()
+	defer server.tubesLock.Unlock()
+
+	if tube.name == "default" || tube.using > 0 || tube.watching > 0 {
+		return false
+	}
+
+	if server.tubes[tube.name] == tube {
+		delete(server.tubes, tube.name)
+	}
+	return true
+}
+
+func (server *Server) tubeNames() []string {
+	server.tubesLock.Lock()
+	defer server.tubesLock.Unlock()
+
+	names := make([]string, 0, len(server.tubes))
+	for name := range server.tubes {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (server *Server) tubeList() []*tube {
+	server.tubesLock.Lock()
+	defer server.tubesLock.Unlock()
+
+	tubes := make([]*tube, 0, len(server.tubes))
+	for _, tube := range server.tubes {
+		tubes = append(tubes, tube)
+	}
+	return tubes
+}
+
+func (server *Server) findJob(id jobId) (job *job, found bool) {
+	return server.jobs.find(id)
 }
 
-func (server *server) findTube(name string) (tube *tube, found bool) {
+func (server *Server) findTube(name string) (tube *tube, found bool) {
+	server.tubesLock.Lock()
+	defer server.tubesLock.Unlock()
+
 	tube, found = server.tubes[name]
 	return
 }
 
-func (server *server) accept(conn conn) {
-	defer server.acceptFinalize(conn)
+func (server *Server) accept(conn conn) {
+	defer server.conns.Done()
 	atomic.AddInt64(&server.stats.CurrentConnections, 1)
 	atomic.AddInt64(&server.stats.TotalConnections, 1)
 
 	client := newClient(server, conn)
+	defer server.acceptFinalize(client)
+
+	server.connLock.Lock()
+	server.clients[client] = true
+	server.connLock.Unlock()
+
+	// Shutdown may have missed this one.
+	if server.isClosed() {
+		return
+	}
 
 	for {
 		err := processCommand(client)
@@ -80,52 +640,130 @@ func (server *server) accept(conn conn) {
 	}
 }
 
-func (server *server) acceptFinalize(conn conn) {
+func (server *Server) acceptFinalize(client *client) {
 	if x := recover(); x != nil {
 		pf("runtime panic: %v\n", x)
 		debug.PrintStack()
 	}
 
-	pf("Closing Connection: %#v", conn)
-	conn.Close()
+	pf("Closing Connection: %#v", client.conn)
+	client.writer.Flush()
+	client.conn.Close()
+
+	server.connLock.Lock()
+	delete(server.clients, client)
+	server.connLock.Unlock()
+
+	client.releaseAll()
+	client.leaveTubes()
+	if client.isProducer {
+		atomic.AddInt64(&server.stats.CurrentProducers, -1)
+	}
+	if client.isWorker {
+		atomic.AddInt64(&server.stats.CurrentWorkers, -1)
+	}
 	atomic.AddInt64(&server.stats.CurrentConnections, -1)
 }
 
+// returned by readCommand for lines that can't be a command, the connection
+// carries on after answering BAD_FORMAT.
+var errBadFormat = exception(MSG_BAD_FORMAT)
+
 func processCommand(client *client) (err error) {
 	name, args, err := readCommand(client.reader)
 
+	if err == errBadFormat {
+		_, err = client.writer.WriteString(MSG_BAD_FORMAT)
+		if err == nil {
+			err = client.flushIfDrained()
+		}
+		return
+	}
+
 	if err != nil {
 		p("readCommand", err)
 		return
 	}
 
-	handler, found := commands[name]
+	// put refuses itself, after reading the body that follows.
+	refusal := ""
+	if writeCommands[name] {
+		refusal = client.server.writeRefusal()
+	}
 
-	if found {
-		response := handler(client, args)
-		client.conn.Write([]byte(response))
-	} else {
-		client.conn.Write([]byte(MSG_UNKNOWN_COMMAND))
+	response := MSG_UNKNOWN_COMMAND
+	if handler, found := commands[name]; found {
+		switch {
+		// put checks rights itself too.
+		case !client.authenticated() && name != "auth" && name != "quit" && name != "put":
+			response = MSG_UNAUTHORIZED
+		case refusal != "":
+			response = refusal
+		default:
+			response = runCommand(handler, client, args)
+		}
+	}
+
+	// a cluster answers changes to jobs once they are committed.
+	cluster := client.server.cluster
+	if cluster != nil && response != "" && (writeCommands[name] || name == "put") {
+		response = cluster.acknowledge(response)
 	}
 
+	_, err = client.writer.WriteString(response)
+	if err == nil {
+		err = client.flushIfDrained()
+	}
 	return
 }
 
+// runs a command handler, turning a BAD_FORMAT raised by the argument parsers
+// into its response.
+func runCommand(handler func(*client, args) string, client *client, args args) (response string) {
+	defer func() {
+		if x := recover(); x != nil {
+			if x != MSG_BAD_FORMAT {
+				panic(x)
+			}
+			response = MSG_BAD_FORMAT
+		}
+	}()
+
+	return handler(client, args)
+}
+
 func readCommand(reader reader) (name string, arguments args, err error) {
-	line, _, err := reader.ReadLine()
-	if err == nil {
-		chunks := strings.Fields(string(line))
-		return chunks[0], args(chunks[1:]), err
+	line, isPrefix, err := reader.ReadLine()
+	if err != nil {
+		return
 	}
 
-	return
+	// the rest of an over-long line is dropped so the next one is read whole.
+	tooLong := isPrefix || len(line) > MAX_LINE_LENGTH
+	for isPrefix && err == nil {
+		_, isPrefix, err = reader.ReadLine()
+	}
+	if err != nil {
+		return
+	}
+
+	if tooLong {
+		return "", nil, errBadFormat
+	}
+
+	chunks := strings.Fields(string(line))
+	if len(chunks) == 0 {
+		return "", nil, errBadFormat
+	}
+
+	return chunks[0], args(chunks[1:]), nil
 }
 
-func (server *server) exit(status int) {
+func (server *Server) exit(status int) {
 	os.Exit(status)
 }
 
-func (server *server) exitOn(name string, err error) {
+func (server *Server) exitOn(name string, err error) {
 	if err != nil {
 		pf("Exit in %s: %v", name, err)
 		server.exit(1)
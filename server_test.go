@@ -0,0 +1,364 @@
+package gostalk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/manveru/gobdd"
+)
+
+// a connection that reads from a fixed input and keeps what is written.
+type bufferConn struct {
+	input  *bytes.Reader
+	output bytes.Buffer
+}
+
+func (conn *bufferConn) Read(b []byte) (int, error)  { return conn.input.Read(b) }
+func (conn *bufferConn) Write(b []byte) (int, error) { return conn.output.Write(b) }
+func (conn *bufferConn) Close() error                { return nil }
+
+func FuzzProcessCommand(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"\r\n",
+		"put 0 0 60 5\r\nhello\r\n",
+		"put 0 0 60 5\r\nhello world\r\n",
+		"put 0 0 60 5\r\nhel",
+		"put 0 0 60 99999999\r\nshort\r\n",
+		"put -1 -1 -1 -1\r\n",
+		"use fuzz\r\nput 1 0 1 1\r\na\r\npeek-ready\r\nkick 10\r\n",
+		"delete\r\nbury\r\ntouch\r\nrelease\r\nstats-job x\r\n",
+		"watch fuzz\r\nignore fuzz\r\nignore default\r\nlist-tubes-watched\r\n",
+		"pause-tube fuzz 0\r\nstats-tube fuzz\r\nstats\r\n",
+		strings.Repeat("x", 5000) + "\r\nlist-tube-used\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	server, err := New(DefaultConfig())
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer server.Shutdown(context.Background())
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		// reserving waits for jobs that may never come.
+		if bytes.Contains(input, []byte("reserve")) {
+			t.Skip()
+		}
+
+		conn := &bufferConn{input: bytes.NewReader(input)}
+		client := newClient(server, conn)
+		defer client.leaveTubes()
+
+		for processCommand(client) == nil {
+		}
+
+		for _, line := range strings.Split(conn.output.String(), "\r\n") {
+			if strings.HasPrefix(line, "INTERNAL_ERROR") {
+				t.Fatalf("%q answered %q", input, line)
+			}
+		}
+	})
+}
+
+func init() {
+	defer PrintSpecReport()
+
+	Describe("Server", func() {
+		dir, err := ioutil.TempDir("", "gostalk-server")
+		Expect(err, ToBeNil)
+		defer os.RemoveAll(dir)
+
+		config := DefaultConfig()
+		config.BinlogDir = dir
+		server, err := New(config)
+		Expect(err, ToBeNil)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err, ToBeNil)
+		served := make(chan error, 1)
+		go func() { served <- server.Serve(listener) }()
+
+		time.Sleep(10 * time.Millisecond)
+
+		It("reports the address it listens on", func() {
+			Expect(server.Addr().String(), ToEqual, listener.Addr().String())
+		})
+
+		It("reports the first of several listeners", func() {
+			other, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err, ToBeNil)
+			go server.Serve(other)
+			Expect(eventually(func() bool {
+				server.connLock.Lock()
+				defer server.connLock.Unlock()
+				return len(server.listeners) == 2
+			}), ToEqual, true)
+
+			for n := 0; n < 20; n += 1 {
+				Expect(server.Addr().String(), ToEqual, listener.Addr().String())
+			}
+		})
+
+		conn, err := net.DialTimeout("tcp", listener.Addr().String(), 1*time.Second)
+		Expect(err, ToBeNil)
+		reader := bufio.NewReader(conn)
+
+		It("serves clients", func() {
+			sendCommand(conn, "put 0 0 60 5\r\nhello")
+			Expect(readResponseWithoutBody(reader), ToEqual, "INSERTED 0")
+			sendCommand(conn, "reserve")
+			Expect(readReserveResponse(reader).body, ToEqual, "hello")
+		})
+
+		It("shuts down while clients wait for jobs", func() {
+			sendCommand(conn, "reserve")
+			time.Sleep(10 * time.Millisecond)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			defer cancel()
+			Expect(server.Shutdown(ctx), ToBeNil)
+			Expect(<-served, ToEqual, ErrServerClosed)
+		})
+
+		It("closes the connections", func() {
+			conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+			_, err := reader.ReadByte()
+			Expect(err == nil, ToEqual, false)
+		})
+
+		It("stops accepting connections", func() {
+			_, err := net.DialTimeout("tcp", listener.Addr().String(), 100*time.Millisecond)
+			Expect(err == nil, ToEqual, false)
+			Expect(server.Serve(listener), ToEqual, ErrServerClosed)
+		})
+
+		It("stops its tubes", func() {
+			tube, found := server.findTube("default")
+			Expect(found, ToEqual, true)
+			select {
+			case tube.tubePause <- &tubePauseRequest{success: make(chan bool, 1)}:
+				Expect("tube still running", ToEqual, "tube stopped")
+			case <-time.After(10 * time.Millisecond):
+			}
+		})
+
+		It("can be shut down again", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			defer cancel()
+			Expect(server.Shutdown(ctx), ToBeNil)
+		})
+
+		It("keeps the released jobs in its binlog", func() {
+			restarted := restartFrom(dir)
+			defer restarted.Shutdown(context.Background())
+
+			job, found := restarted.findJob(0)
+			Expect(found, ToEqual, true)
+			job = job.snapshot()
+			Expect(job.state, ToEqual, jobReadyState)
+			Expect(job.releaseCount, ToEqual, 1)
+		})
+	})
+}
+
+func init() {
+	defer PrintSpecReport()
+
+	Describe("Server over TLS", func() {
+		dir, err := ioutil.TempDir("", "gostalk-tls")
+		Expect(err, ToBeNil)
+		defer os.RemoveAll(dir)
+		ca, caKey := writeCertificate(dir, "ca", nil, nil)
+		writeCertificate(dir, "server", ca, caKey)
+		writeCertificate(dir, "client", ca, caKey)
+		other, otherKey := writeCertificate(dir, "other", nil, nil)
+		writeCertificate(dir, "stranger", other, otherKey)
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+
+		config := DefaultConfig()
+		config.TLSCert = filepath.Join(dir, "server.pem")
+		config.TLSKey = filepath.Join(dir, "server-key.pem")
+		_, addr := startServer(config)
+
+		config.TLSClientCA = filepath.Join(dir, "ca.pem")
+		_, mutualAddr := startServer(config)
+
+		// dials addr and puts a job, answering the error of the first step
+		// that failed.
+		put := func(addr string, certificates ...tls.Certificate) (string, error) {
+			conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, Certificates: certificates})
+			if err != nil {
+				return "", err
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(1 * time.Second))
+
+			reader := bufio.NewReader(conn)
+			sendCommand(conn, "put 0 0 60 5\r\nhello")
+			line, err := reader.ReadString('\n')
+			return strings.TrimSpace(line), err
+		}
+
+		It("serves clients over TLS", func() {
+			answer, err := put(addr)
+			Expect(err, ToBeNil)
+			Expect(answer, ToEqual, "INSERTED 0")
+		})
+
+		It("refuses plain connections", func() {
+			conn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+			Expect(err, ToBeNil)
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(1 * time.Second))
+			sendCommand(conn, "list-tubes")
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			Expect(strings.HasPrefix(line, "OK"), ToEqual, false)
+		})
+
+		It("accepts clients presenting a certificate of the client CA", func() {
+			answer, err := put(mutualAddr, loadCertificate(dir, "client"))
+			Expect(err, ToBeNil)
+			Expect(answer, ToEqual, "INSERTED 0")
+		})
+
+		It("rejects clients without a certificate of the client CA", func() {
+			_, err := put(mutualAddr)
+			Expect(err == nil, ToEqual, false)
+
+			_, err = put(mutualAddr, loadCertificate(dir, "stranger"))
+			Expect(err == nil, ToEqual, false)
+		})
+
+		It("needs a certificate to serve TLS", func() {
+			server, err := New(DefaultConfig())
+			Expect(err, ToBeNil)
+			defer server.Shutdown(context.Background())
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err, ToBeNil)
+			Expect(server.ServeTLS(listener), ToEqual, errNoTLS)
+		})
+	})
+}
+
+func init() {
+	defer PrintSpecReport()
+
+	Describe("Server.put", func() {
+		server, err := New(DefaultConfig())
+		Expect(err, ToBeNil)
+		defer server.Shutdown(context.Background())
+
+		// a tube that nobody runs, so the jobs handed to it can be looked at.
+		idleTube := func(name string) *tube {
+			return &tube{name: name, server: server, jobSupply: make(chan *job), stopped: make(chan bool), stats: &tubeStats{Name: name}}
+		}
+
+		It("registers the job before its tube has it", func() {
+			tube := idleTube("idle")
+			go server.put(tube, 0, 0, 60, []byte("hello"))
+
+			job := <-tube.jobSupply
+			_, found := server.findJob(job.id)
+			Expect(found, ToEqual, true)
+		})
+
+		It("takes the job back if its tube stopped", func() {
+			tube := idleTube("stopped")
+			close(tube.stopped)
+			registered := server.jobs.Len()
+
+			job, response := server.put(tube, 0, 0, 60, []byte("hello"))
+			Expect(job == nil, ToEqual, true)
+			Expect(response, ToEqual, MSG_INTERNAL_ERROR)
+			Expect(server.jobs.Len(), ToEqual, registered)
+			Expect(tube.memory, ToEqual, int64(0))
+		})
+	})
+}
+
+// puts, reserves and deletes a job per iteration, waiting for every answer
+// before sending the next command.
+func BenchmarkPutReserveDelete(b *testing.B) {
+	_, addr := startServer(DefaultConfig())
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	body := strings.Repeat("x", 1024)
+
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for n := 0; n < b.N; n += 1 {
+		fmt.Fprintf(conn, "put 0 0 60 %d\r\n%s\r\n", len(body), body)
+		line, _ := reader.ReadString('\n')
+		id := strings.TrimSpace(strings.TrimPrefix(line, "INSERTED "))
+
+		fmt.Fprintf(conn, "reserve\r\n")
+		reader.ReadString('\n')
+		reader.Discard(len(body) + 2)
+
+		fmt.Fprintf(conn, "delete %s\r\n", id)
+		reader.ReadString('\n')
+	}
+}
+
+// like BenchmarkPutReserveDelete, but sends the commands of many iterations
+// before reading any answer.
+func BenchmarkPipelinedPutReserveDelete(b *testing.B) {
+	const batch = 64
+
+	_, addr := startServer(DefaultConfig())
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	body := strings.Repeat("x", 1024)
+
+	// job ids are handed out in order, so the ids of a batch are known up
+	// front.
+	id := 0
+
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for n := 0; n < b.N; n += batch {
+		size := batch
+		if b.N-n < size {
+			size = b.N - n
+		}
+
+		for i := 0; i < size; i += 1 {
+			fmt.Fprintf(writer, "put 0 0 60 %d\r\n%s\r\nreserve\r\ndelete %d\r\n", len(body), body, id+i)
+		}
+		writer.Flush()
+
+		for i := 0; i < size; i += 1 {
+			reader.ReadString('\n')
+			reader.ReadString('\n')
+			reader.Discard(len(body) + 2)
+			if line, _ := reader.ReadString('\n'); line != "DELETED\r\n" {
+				b.Fatalf("expected DELETED, got %q", line)
+			}
+		}
+		id += size
+	}
+}
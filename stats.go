@@ -1,8 +1,9 @@
 package gostalk
 
 import (
-	"fmt"
 	"reflect"
+	"runtime"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -11,128 +12,215 @@ import (
 
 // adds support for serializing structs
 func toYaml(obj interface{}) (out []byte, err error) {
-	objValue := reflect.ValueOf(obj)
-	objKind := objValue.Kind()
-
-	if objKind == reflect.Struct {
-		raw := map[string]interface{}{}
-		objType := objValue.Type()
-		fieldCount := objValue.NumField()
-		for n := 0; n < fieldCount; n += 1 {
-			fieldType := objType.Field(n)
-			fieldValue := objValue.Field(n)
-			if fieldType.Tag == "" {
-				raw[fieldType.Name] = fieldValue.Interface()
-			} else {
-				raw[string(fieldType.Tag)] = fieldValue.Interface()
-			}
-		}
-
-		out, err = yaml.Marshal(raw)
+	if reflect.ValueOf(obj).Kind() == reflect.Struct {
+		out, err = yaml.Marshal(statsMap(obj))
 	} else {
 		out, err = yaml.Marshal(obj)
 	}
 	return
 }
 
+// maps the fields of a struct to their values, keyed by their tags.
+func statsMap(obj interface{}) map[string]interface{} {
+	raw := map[string]interface{}{}
+	objValue := reflect.ValueOf(obj)
+	objType := objValue.Type()
+	fieldCount := objValue.NumField()
+	for n := 0; n < fieldCount; n += 1 {
+		fieldType := objType.Field(n)
+		fieldValue := objValue.Field(n)
+		if key := fieldType.Tag.Get("yaml"); key == "" {
+			raw[fieldType.Name] = fieldValue.Interface()
+		} else {
+			raw[key] = fieldValue.Interface()
+		}
+	}
+	return raw
+}
+
 type tubeStats struct {
-	Name                string "name"
-	TotalJobs           int    "total-jobs"
-	CurrentWaiting      int    "current-waiting"
-	CmdDelete           int    "cmd-delete"
-	CmdPauseTube        int    "cmd-pause-tube"
-	Pause               int    "pause"
-	PauseTimeLeft       int    "pause-time-left"
-	CurrentUrgentJobs   int    "current-jobs-urgent"
-	CurrentJobsBuried   int    "current-jobs-buried"
-	CurrentJobsDelayed  int    "current-jobs-delayed"
-	CurrentJobsReady    int    "current-jobs-ready"
-	CurrentJobsReserved int    "current-jobs-reserved"
+	Name                string `yaml:"name"`
+	TotalJobs           int    `yaml:"total-jobs"`
+	CurrentWaiting      int    `yaml:"current-waiting"`
+	CmdDelete           int    `yaml:"cmd-delete"`
+	CmdPauseTube        int    `yaml:"cmd-pause-tube"`
+	Pause               int    `yaml:"pause"`
+	PauseTimeLeft       int    `yaml:"pause-time-left"`
+	CurrentUsing        int    `yaml:"current-using"`
+	CurrentWatching     int    `yaml:"current-watching"`
+	CurrentUrgentJobs   int    `yaml:"current-jobs-urgent"`
+	CurrentJobsBuried   int    `yaml:"current-jobs-buried"`
+	CurrentJobsDelayed  int    `yaml:"current-jobs-delayed"`
+	CurrentJobsReady    int    `yaml:"current-jobs-ready"`
+	CurrentJobsReserved int    `yaml:"current-jobs-reserved"`
+	CurrentMemoryBytes  int64  `yaml:"current-memory-bytes"`
+	MaxMemoryBytes      int64  `yaml:"max-memory-bytes"`
 }
 
+// asks the tube goroutine for its stats. A tube that has been removed reports
+// nothing but its name.
 func (tube *tube) statistics() tubeStats {
+	success := make(chan tubeStats)
+	select {
+	case tube.tubeStats <- success:
+		return <-success
+	case <-tube.stopped:
+		return tubeStats{Name: tube.name}
+	}
+}
+
+func (tube *tube) currentStats() tubeStats {
 	stats := *(tube.stats)
+	stats.CurrentJobsBuried = tube.buried.Len()
+	stats.CurrentJobsDelayed = tube.delayed.Len()
+	stats.CurrentJobsReady = tube.ready.Len()
+	stats.CurrentJobsReserved = tube.reserved.Len()
+	stats.CurrentUrgentJobs = tube.ready.urgent
+	stats.CurrentWaiting = int(atomic.LoadInt64(&tube.waiting))
+	stats.CurrentMemoryBytes = atomic.LoadInt64(&tube.memory)
+	stats.MaxMemoryBytes = tube.server.config.MaxTubeMemory
 	if tube.paused {
 		stats.PauseTimeLeft = int(tube.pauseEndsAt.Sub(time.Now()).Seconds())
-		stats.Pause = int(time.Since(tube.pauseStartedAt).Seconds())
+		stats.Pause = int(tube.pauseEndsAt.Sub(tube.pauseStartedAt).Seconds())
 	}
+
+	tube.server.tubesLock.Lock()
+	stats.CurrentUsing = tube.using
+	stats.CurrentWatching = tube.watching
+	tube.server.tubesLock.Unlock()
+
 	return stats
 }
 
 type serverStats struct {
-	BinlogCurrentIndex    int64   "binlog-current-index"    // TODO
-	BinlogMaxSize         int64   "binlog-max-size"         // TODO
-	BinlogOldestIndex     int64   "binlog-oldest-index"     // TODO
-	BinlogRecordsMigrated int64   "binlog-records-migrated" // TODO
-	BinlogRecordsWritten  int64   "binlog-records-written"  // TODO
-	CmdBury               int64   "cmd-bury"
-	CmdDelete             int64   "cmd-delete"
-	CmdIgnore             int64   "cmd-ignore"
-	CmdKick               int64   "cmd-kick"
-	CmdListTubes          int64   "cmd-list-tubes"
-	CmdListTubesWatched   int64   "cmd-list-tubes-watched"
-	CmdListTubeUsed       int64   "cmd-list-tube-used"
-	CmdPauseTube          int64   "cmd-pause-tube"
-	CmdPeekBuried         int64   "cmd-peek-buried"
-	CmdPeekDelayed        int64   "cmd-peek-delayed"
-	CmdPeek               int64   "cmd-peek"
-	CmdPeekReady          int64   "cmd-peek-ready"
-	CmdPut                int64   "cmd-put"
-	CmdQuit               int64   "cmd-quit"
-	CmdReserve            int64   "cmd-reserve"
-	CmdReserveWithTimeout int64   "cmd-reserve-with-timeout"
-	CmdStats              int64   "cmd-stats"
-	CmdStatsJob           int64   "cmd-stats-job"
-	CmdStatsTube          int64   "cmd-stats-tube"
-	CmdTouch              int64   "cmd-touch"
-	CmdUse                int64   "cmd-use"
-	CmdWatch              int64   "cmd-watch"
-	CurrentConnections    int64   "current-connections"
-	CurrentJobsBuried     int     "current-jobs-buried"
-	CurrentJobsDelayed    int     "current-jobs-delayed"
-	CurrentJobsReady      int     "current-jobs-ready"
-	CurrentJobsReserved   int     "current-jobs-reserved"
-	CurrentJobsUrgent     int     "current-jobs-urgent"
-	CurrentProducers      int     "current-producers" // TODO
-	CurrentTubes          int     "current-tubes"
-	CurrentWaiting        int     "current-waiting" // TODO
-	CurrentWorkers        int     "current-workers" // TODO
-	GoCurrentGoroutines   int     "current-goroutines"
-	MaxJobSize            int     "max-job-size"
-	PID                   int     "pid"
-	RusageStime           float64 "rusage-stime"
-	RusageUtime           float64 "rusage-utime"
-	TotalConnections      int64   "total-connections"
-	TotalJobs             int     "total-jobs"
-	TotalJobTimeouts      int64   "job-timeouts" // TODO
-	Uptime                float64 "uptime"
-	Version               string  "version"
+	BinlogCurrentIndex    int64   `yaml:"binlog-current-index"`
+	BinlogMaxSize         int64   `yaml:"binlog-max-size"`
+	BinlogOldestIndex     int64   `yaml:"binlog-oldest-index"`
+	BinlogRecordsMigrated int64   `yaml:"binlog-records-migrated"`
+	BinlogRecordsWritten  int64   `yaml:"binlog-records-written"`
+	ClusterLeader         string  `yaml:"cluster-leader"`
+	ClusterRole           string  `yaml:"cluster-role"`
+	ClusterTerm           uint64  `yaml:"cluster-term"`
+	CmdAuth               int64   `yaml:"cmd-auth"`
+	CmdBury               int64   `yaml:"cmd-bury"`
+	CmdDelete             int64   `yaml:"cmd-delete"`
+	CmdDrain              int64   `yaml:"cmd-drain"`
+	CmdIgnore             int64   `yaml:"cmd-ignore"`
+	CmdKick               int64   `yaml:"cmd-kick"`
+	CmdListTubes          int64   `yaml:"cmd-list-tubes"`
+	CmdListTubesWatched   int64   `yaml:"cmd-list-tubes-watched"`
+	CmdListTubeUsed       int64   `yaml:"cmd-list-tube-used"`
+	CmdPauseTube          int64   `yaml:"cmd-pause-tube"`
+	CmdPeekBuried         int64   `yaml:"cmd-peek-buried"`
+	CmdPeekDelayed        int64   `yaml:"cmd-peek-delayed"`
+	CmdPeek               int64   `yaml:"cmd-peek"`
+	CmdPeekReady          int64   `yaml:"cmd-peek-ready"`
+	CmdPromote            int64   `yaml:"cmd-promote"`
+	CmdPut                int64   `yaml:"cmd-put"`
+	CmdQuit               int64   `yaml:"cmd-quit"`
+	CmdRaft               int64   `yaml:"cmd-raft"`
+	CmdRelease            int64   `yaml:"cmd-release"`
+	CmdReplicate          int64   `yaml:"cmd-replicate"`
+	CmdReserve            int64   `yaml:"cmd-reserve"`
+	CmdReserveWithTimeout int64   `yaml:"cmd-reserve-with-timeout"`
+	CmdStats              int64   `yaml:"cmd-stats"`
+	CmdStatsJob           int64   `yaml:"cmd-stats-job"`
+	CmdStatsTube          int64   `yaml:"cmd-stats-tube"`
+	CmdTouch              int64   `yaml:"cmd-touch"`
+	CmdUse                int64   `yaml:"cmd-use"`
+	CmdWatch              int64   `yaml:"cmd-watch"`
+	CurrentConnections    int64   `yaml:"current-connections"`
+	CurrentJobsBuried     int     `yaml:"current-jobs-buried"`
+	CurrentJobsDelayed    int     `yaml:"current-jobs-delayed"`
+	CurrentJobsReady      int     `yaml:"current-jobs-ready"`
+	CurrentJobsReserved   int     `yaml:"current-jobs-reserved"`
+	CurrentJobsUrgent     int     `yaml:"current-jobs-urgent"`
+	CurrentMemoryBytes    int64   `yaml:"current-memory-bytes"`
+	CurrentProducers      int64   `yaml:"current-producers"`
+	CurrentReplicas       int64   `yaml:"current-replicas"`
+	CurrentTubes          int     `yaml:"current-tubes"`
+	CurrentWaiting        int64   `yaml:"current-waiting"`
+	CurrentWorkers        int64   `yaml:"current-workers"`
+	Draining              bool    `yaml:"draining"`
+	GoCurrentGoroutines   int     `yaml:"current-goroutines"`
+	MaxJobSize            int     `yaml:"max-job-size"`
+	MaxMemoryBytes        int64   `yaml:"max-memory-bytes"`
+	PID                   int     `yaml:"pid"`
+	Replica               bool    `yaml:"replica"`
+	RusageStime           float64 `yaml:"rusage-stime"`
+	RusageUtime           float64 `yaml:"rusage-utime"`
+	TotalConnections      int64   `yaml:"total-connections"`
+	TotalJobs             int64   `yaml:"total-jobs"`
+	TotalJobTimeouts      int64   `yaml:"job-timeouts"`
+	Uptime                float64 `yaml:"uptime"`
+	Version               string  `yaml:"version"`
 }
 
-func (server *server) statistics() serverStats {
-	stats := *server.stats
+// copies the stats, loading the counters other goroutines update atomically.
+func (stats *serverStats) load() serverStats {
+	var copy serverStats
+	src := reflect.ValueOf(stats).Elem()
+	dst := reflect.ValueOf(&copy).Elem()
+
+	for n := 0; n < src.NumField(); n += 1 {
+		field := src.Field(n)
+		if field.Kind() == reflect.Int64 {
+			dst.Field(n).SetInt(atomic.LoadInt64(field.Addr().Interface().(*int64)))
+		} else {
+			dst.Field(n).Set(field)
+		}
+	}
+
+	return copy
+}
+
+// the stats of a job copied with snapshot, as stats-job answers them.
+func (server *Server) jobStatistics(job *job) map[string]interface{} {
+	return map[string]interface{}{
+		"id":        job.id,
+		"tube":      job.tube.name,
+		"state":     job.state,
+		"pri":       job.priority,
+		"age":       int(time.Since(job.createdAt).Seconds()),
+		"time-left": job.timeLeft().Seconds(),
+		"file":      server.binlog.fileOf(job.id),
+		"reserves":  job.reserveCount,
+		"releases":  job.releaseCount,
+		"timeouts":  job.timeoutCount,
+		"buries":    job.buryCount,
+		"kicks":     job.kickCount,
+	}
+}
+
+func (server *Server) statistics() serverStats {
+	stats := server.stats.load()
 	stats.Uptime = time.Since(server.startedAt).Seconds()
-	stats.CurrentTubes = len(server.tubes)
-	stats.TotalJobs = len(server.jobs)
-
-	for _, tube := range server.tubes {
-		stats.CurrentJobsBuried += tube.buried.Len()
-		stats.CurrentJobsDelayed += tube.delayed.Len()
-		stats.CurrentJobsReady += tube.ready.Len()
-		stats.CurrentJobsReserved += tube.reserved.Len()
+	stats.Draining = server.isDraining()
+	stats.Replica = server.isReplica()
+	if server.cluster != nil {
+		stats.ClusterRole, stats.ClusterLeader, stats.ClusterTerm = server.cluster.status()
+	}
+	stats.CurrentMemoryBytes = atomic.LoadInt64(&server.memory)
+
+	tubes := server.tubeList()
+	stats.CurrentTubes = len(tubes)
+
+	for _, tube := range tubes {
+		tubeStats := tube.statistics()
+		stats.CurrentJobsBuried += tubeStats.CurrentJobsBuried
+		stats.CurrentJobsDelayed += tubeStats.CurrentJobsDelayed
+		stats.CurrentJobsReady += tubeStats.CurrentJobsReady
+		stats.CurrentJobsReserved += tubeStats.CurrentJobsReserved
+		stats.CurrentJobsUrgent += tubeStats.CurrentUrgentJobs
 	}
 
-	var duration time.Duration
+	stats.GoCurrentGoroutines = runtime.NumGoroutine()
+
 	usage := new(syscall.Rusage)
 	err := syscall.Getrusage(syscall.RUSAGE_SELF, usage)
 	if err == nil {
-		s, ns := usage.Utime.Unix()
-		duration, err = time.ParseDuration(fmt.Sprintf("%d.%ds", s, ns))
-		stats.RusageStime = duration.Seconds()
-
-		s, ns = usage.Stime.Unix()
-		duration, err = time.ParseDuration(fmt.Sprintf("%d.%ds", s, ns))
-		stats.RusageUtime = duration.Seconds()
+		stats.RusageUtime = time.Duration(usage.Utime.Nano()).Seconds()
+		stats.RusageStime = time.Duration(usage.Stime.Nano()).Seconds()
 	} else {
 		pf("failed to get rusage : %v", err)
 	}
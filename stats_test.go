@@ -0,0 +1,163 @@
+package gostalk
+
+import (
+	"bufio"
+	"net"
+	"time"
+
+	. "github.com/manveru/gobdd"
+)
+
+type statsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialStats(addr string) *statsConn {
+	conn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+	Expect(err, ToBeNil)
+	return &statsConn{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *statsConn) do(command string) string {
+	sendCommand(c.conn, command)
+	return readResponseWithoutBody(c.reader)
+}
+
+func (c *statsConn) reserve(command string) jobResponse {
+	sendCommand(c.conn, command)
+	return readReserveResponse(c.reader)
+}
+
+func (c *statsConn) stats(command string) (stats map[string]interface{}) {
+	sendCommand(c.conn, command)
+	readResponseWithBody(c.reader, &stats)
+	return
+}
+
+// asks for stats until key reaches value, the counters of other connections
+// change once the server got to their commands.
+func (c *statsConn) awaitStat(command, key string, value int) map[string]interface{} {
+	for n := 0; n < 100; n += 1 {
+		stats := c.stats(command)
+		if stats[key] == value {
+			return stats
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c.stats(command)
+}
+
+func init() {
+	defer PrintSpecReport()
+
+	Describe("statistics", func() {
+		_, addr := startServer(DefaultConfig())
+		producer := dialStats(addr)
+		worker := dialStats(addr)
+		observer := dialStats(addr)
+		defer worker.conn.Close()
+		defer observer.conn.Close()
+
+		producer.do("use counted")
+		producer.do("put 0 0 60 6\r\nurgent")
+		producer.do("put 2000 0 60 4\r\nlazy")
+		producer.do("put 0 60 60 7\r\ndelayed")
+		worker.do("watch counted")
+		worker.do("ignore default")
+
+		It("counts jobs by state, urgent ones only while ready", func() {
+			stats := observer.stats("stats-tube counted")
+			Expect(stats["total-jobs"], ToEqual, 3)
+			Expect(stats["current-jobs-ready"], ToEqual, 2)
+			Expect(stats["current-jobs-delayed"], ToEqual, 1)
+			Expect(stats["current-jobs-urgent"], ToEqual, 1)
+
+			stats = observer.stats("stats")
+			Expect(stats["total-jobs"], ToEqual, 3)
+			Expect(stats["current-jobs-urgent"], ToEqual, 1)
+		})
+
+		It("counts the clients using and watching a tube", func() {
+			stats := observer.stats("stats-tube counted")
+			Expect(stats["current-using"], ToEqual, 1)
+			Expect(stats["current-watching"], ToEqual, 1)
+
+			stats = observer.stats("stats-tube default")
+			Expect(stats["current-using"], ToEqual, 2)
+			Expect(stats["current-watching"], ToEqual, 2)
+		})
+
+		It("counts producers and workers", func() {
+			stats := observer.stats("stats")
+			Expect(stats["current-producers"], ToEqual, 1)
+			Expect(stats["current-workers"], ToEqual, 0)
+
+			job := worker.reserve("reserve")
+			Expect(job.body, ToEqual, "urgent")
+
+			stats = observer.stats("stats")
+			Expect(stats["current-workers"], ToEqual, 1)
+			Expect(stats["current-jobs-urgent"], ToEqual, 0)
+			Expect(stats["current-jobs-reserved"], ToEqual, 1)
+
+			Expect(worker.do("delete 0"), ToEqual, "DELETED")
+			Expect(worker.do("delete 0"), ToEqual, "NOT_FOUND")
+		})
+
+		It("counts only deletes that succeed in stats-tube", func() {
+			stats := observer.stats("stats-tube counted")
+			Expect(stats["cmd-delete"], ToEqual, 1)
+			Expect(stats["total-jobs"], ToEqual, 3)
+
+			stats = observer.stats("stats")
+			Expect(stats["cmd-delete"], ToEqual, 2)
+		})
+
+		It("counts clients waiting for a job", func() {
+			job := worker.reserve("reserve")
+			Expect(job.body, ToEqual, "lazy")
+			Expect(worker.do("bury 1 0"), ToEqual, "BURIED")
+
+			sendCommand(worker.conn, "reserve-with-timeout 5")
+
+			stats := observer.awaitStat("stats-tube counted", "current-waiting", 1)
+			Expect(stats["current-waiting"], ToEqual, 1)
+			stats = observer.stats("stats-tube default")
+			Expect(stats["current-waiting"], ToEqual, 0)
+			stats = observer.stats("stats")
+			Expect(stats["current-waiting"], ToEqual, 1)
+
+			producer.do("put 0 0 60 4\r\nwake")
+			Expect(readReserveResponse(worker.reader).body, ToEqual, "wake")
+
+			stats = observer.stats("stats-tube counted")
+			Expect(stats["current-waiting"], ToEqual, 0)
+			Expect(stats["total-jobs"], ToEqual, 4)
+			stats = observer.stats("stats")
+			Expect(stats["current-waiting"], ToEqual, 0)
+		})
+
+		It("reports how long a tube is paused for", func() {
+			Expect(observer.do("pause-tube counted 30"), ToEqual, "PAUSED")
+			stats := observer.stats("stats-tube counted")
+			Expect(stats["pause"], ToEqual, 30)
+			Expect(stats["pause-time-left"], ToBeFloatBetween, 28.0, 30.0)
+
+			Expect(observer.do("pause-tube counted 0"), ToEqual, "PAUSED")
+			stats = observer.stats("stats-tube counted")
+			Expect(stats["pause"], ToEqual, 0)
+			Expect(stats["cmd-pause-tube"], ToEqual, 2)
+		})
+
+		It("stops counting producers once they disconnect", func() {
+			producer.conn.Close()
+			stats := observer.awaitStat("stats", "current-producers", 0)
+			Expect(stats["current-producers"], ToEqual, 0)
+			Expect(stats["current-workers"], ToEqual, 1)
+
+			stats = observer.stats("stats-tube counted")
+			Expect(stats["current-using"], ToEqual, 0)
+		})
+	})
+}
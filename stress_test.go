@@ -0,0 +1,165 @@
+package gostalk
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/manveru/gobdd"
+)
+
+const (
+	stressProducers    = 200
+	stressWorkers      = 200
+	stressJobsPerActor = 10
+	stressTubes        = 5
+)
+
+// runs one connection against addr, sending commands and reading a response
+// line plus body for each.
+type stressConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialStress(addr string) *stressConn {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	Expect(err, ToBeNil)
+	return &stressConn{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *stressConn) do(command string) (line string, body string) {
+	sendCommand(c.conn, command)
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", ""
+	}
+	line = strings.TrimSpace(line)
+
+	var size int
+	switch {
+	case strings.HasPrefix(line, "OK "):
+		fmt.Sscanf(line, "OK %d", &size)
+	case strings.HasPrefix(line, "RESERVED "), strings.HasPrefix(line, "FOUND "):
+		var id int
+		fmt.Sscanf(line[strings.Index(line, " ")+1:], "%d %d", &id, &size)
+	default:
+		return line, ""
+	}
+
+	buf := make([]byte, size+2)
+	_, err = io.ReadFull(c.reader, buf)
+	if err != nil {
+		return line, ""
+	}
+	return line, string(buf[:size])
+}
+
+func init() {
+	defer PrintSpecReport()
+
+	Describe("concurrent clients", func() {
+		server, err := New(DefaultConfig())
+		Expect(err, ToBeNil)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err, ToBeNil)
+		go server.Serve(listener)
+		addr := listener.Addr().String()
+
+		total := stressProducers * stressJobsPerActor
+		var deleted int64
+		var wg sync.WaitGroup
+
+		for n := 0; n < stressProducers; n += 1 {
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+				c := dialStress(addr)
+				defer c.conn.Close()
+
+				c.do(fmt.Sprintf("use stress-%d", n%stressTubes))
+				for i := 0; i < stressJobsPerActor; i += 1 {
+					body := fmt.Sprintf("%d-%d", n, i)
+					c.do(fmt.Sprintf("put %d 0 60 %d\r\n%s", i, len(body), body))
+					c.do("list-tubes")
+					c.do("stats")
+				}
+			}(n)
+		}
+
+		for n := 0; n < stressWorkers; n += 1 {
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+				c := dialStress(addr)
+				defer c.conn.Close()
+
+				for t := 0; t < stressTubes; t += 1 {
+					c.do(fmt.Sprintf("watch stress-%d", t))
+				}
+				c.do("ignore default")
+
+				for atomic.LoadInt64(&deleted) < int64(total) {
+					line, _ := c.do("reserve-with-timeout 1")
+					if !strings.HasPrefix(line, "RESERVED ") {
+						continue
+					}
+					var id, size int
+					fmt.Sscanf(line, "RESERVED %d %d", &id, &size)
+
+					_, stats := c.do(fmt.Sprintf("stats-job %d", id))
+					c.do(fmt.Sprintf("peek %d", id))
+					c.do(fmt.Sprintf("touch %d", id))
+
+					switch {
+					case id%4 == 0 && strings.Contains(stats, "releases: 0"):
+						c.do(fmt.Sprintf("release %d 0 0", id))
+						continue
+					case id%4 == 1:
+						// kicking lets other workers reserve the job while this
+						// one still deletes it, only one of them may succeed.
+						c.do(fmt.Sprintf("bury %d 0", id))
+						c.do(fmt.Sprintf("use stress-%d", n%stressTubes))
+						c.do(fmt.Sprintf("stats-tube stress-%d", n%stressTubes))
+						c.do("kick 1")
+					}
+
+					// a kicked job may be buried again by another worker
+					// between these, so either delete may be the one that wins.
+					for i := 0; i < 2; i += 1 {
+						if line, _ := c.do(fmt.Sprintf("delete %d", id)); line == "DELETED" {
+							atomic.AddInt64(&deleted, 1)
+						}
+					}
+				}
+			}(n)
+		}
+
+		done := make(chan bool)
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+
+		It("handles every job exactly once", func() {
+			select {
+			case <-done:
+			case <-time.After(60 * time.Second):
+			}
+			Expect(atomic.LoadInt64(&deleted), ToEqual, int64(total))
+			Expect(server.jobs.Len(), ToEqual, 0)
+		})
+
+		It("shuts down afterwards", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			Expect(server.Shutdown(ctx), ToBeNil)
+		})
+	})
+}
@@ -1,6 +1,7 @@
 package gostalk
 
 import (
+	"sync/atomic"
 	"time"
 )
 
@@ -10,169 +11,478 @@ type jobReserveRequest struct {
 	cancel  chan bool
 }
 
+// asks the tube to delete, bury or touch a job on behalf of client.
+type jobRequest struct {
+	client  *client
+	job     *job
+	success chan bool
+}
+
+// asks the tube for a copy of a job, nil once the job is deleted.
+type jobStatsRequest struct {
+	job     *job
+	success chan *job
+}
+
 type jobKickRequest struct {
 	bound   int
 	success chan int
 }
 
+type jobReleaseRequest struct {
+	client   *client
+	job      *job
+	priority uint32
+	delay    int64
+	success  chan string
+}
+
 type jobPeekRequest struct {
 	state   string
 	success chan *job
 }
 
+// asks the tube to pause, success receives once it did.
+type tubePauseRequest struct {
+	duration time.Duration
+	success  chan bool
+}
+
 type tube struct {
+	// bytes taken by jobs in this tube and clients waiting to reserve from
+	// it, first so they stay aligned for atomic access.
+	memory  int64
+	waiting int64
+
 	name     string
+	server   *Server
 	ready    *readyJobs
 	reserved *reservedJobs
 	buried   *buriedJobs
 	delayed  *delayedJobs
 
-	jobDemand chan *jobReserveRequest
-	jobSupply chan *job
-	jobDelete chan *job
-	jobTouch  chan *job
-	jobBury   chan *job
-	jobKick   chan *jobKickRequest
-	jobPeek   chan *jobPeekRequest
-	tubePause chan time.Duration
+	jobDemand  chan *jobReserveRequest
+	jobSupply  chan *job
+	jobDelete  chan *jobRequest
+	jobTouch   chan *jobRequest
+	jobBury    chan *jobRequest
+	jobKick    chan *jobKickRequest
+	jobRelease chan *jobReleaseRequest
+	jobPeek    chan *jobPeekRequest
+	jobStats   chan *jobStatsRequest
+	jobSync    chan *mutation
+	tubePause  chan *tubePauseRequest
+	tubeStats  chan chan tubeStats
+	tubePaused chan chan *mutation
+	tubeCheck  chan bool
+	stopped    chan bool
 
 	paused         bool
 	pauseStartedAt time.Time
 	pauseEndsAt    time.Time
 
+	// clients using or watching this tube, guarded by server.tubesLock.
+	using, watching int
+
 	stats *tubeStats
 }
 
-func newTube(name string) *tube {
+func newTube(name string, server *Server) *tube {
 	t := &tube{
-		name:      name,
-		paused:    false,
-		ready:     newReadyJobs(),
-		reserved:  newReservedJobs(),
-		buried:    newBuriedJobs(),
-		delayed:   newDelayedJobs(),
-		jobDemand: make(chan *jobReserveRequest),
-		jobSupply: make(chan *job),
-		jobDelete: make(chan *job),
-		jobTouch:  make(chan *job),
-		jobBury:   make(chan *job),
-		jobKick:   make(chan *jobKickRequest),
-		stats:     &tubeStats{Name: name},
+		name:       name,
+		server:     server,
+		paused:     false,
+		ready:      newReadyJobs(),
+		reserved:   newReservedJobs(),
+		buried:     newBuriedJobs(),
+		delayed:    newDelayedJobs(),
+		jobDemand:  make(chan *jobReserveRequest),
+		jobSupply:  make(chan *job),
+		jobDelete:  make(chan *jobRequest),
+		jobTouch:   make(chan *jobRequest),
+		jobBury:    make(chan *jobRequest),
+		jobKick:    make(chan *jobKickRequest),
+		jobPeek:    make(chan *jobPeekRequest),
+		jobRelease: make(chan *jobReleaseRequest),
+		jobStats:   make(chan *jobStatsRequest),
+		jobSync:    make(chan *mutation),
+		tubePause:  make(chan *tubePauseRequest),
+		tubeStats:  make(chan chan tubeStats),
+		tubePaused: make(chan chan *mutation),
+		tubeCheck:  make(chan bool, 1),
+		stopped:    make(chan bool),
+		stats:      &tubeStats{Name: name},
 	}
 
+	server.routines.Add(1)
 	go t.handleDemand()
 
 	return t
 }
 
 func (tube *tube) handleDemand() {
+	defer tube.server.routines.Done()
+
 	for {
-		if tube.ready.Len() > 0 {
-			select {
-			case duration := <-tube.tubePause:
-				tube.pause(duration)
-			case job := <-tube.jobBury:
-				tube.bury(job)
-			case job := <-tube.jobDelete:
-				tube.delete(job)
-			case job := <-tube.jobSupply:
-				tube.put(job)
-			case job := <-tube.jobTouch:
-				tube.touch(job)
-			case request := <-tube.jobKick:
-				request.success <- tube.kick(request.bound)
-			case request := <-tube.jobPeek:
-				tube.peek(request)
-			case request := <-tube.jobDemand:
-				select {
-				case request.success <- tube.reserve(request.client):
-				case <-request.cancel:
-					request.cancel <- true // propagate to the other tubes
-				}
+		// only take demand for jobs while we can satisfy it.
+		var jobDemand chan *jobReserveRequest
+		if tube.ready.Len() > 0 && !tube.paused {
+			jobDemand = tube.jobDemand
+		}
+
+		select {
+		case <-tube.server.halt:
+			return
+		case <-tube.tubeCheck:
+			if tube.collect() {
+				return
+			}
+		case request := <-tube.tubePause:
+			tube.pause(request.duration)
+			tube.publishPause()
+			request.success <- true
+		case <-tube.pauseExpiry():
+			tube.unpause()
+		case <-tube.reserved.expiry():
+			tube.expire()
+		case <-tube.delayed.expiry():
+			tube.undelay()
+		case request := <-tube.jobBury:
+			request.success <- tube.bury(request)
+		case request := <-tube.jobDelete:
+			request.success <- tube.delete(request)
+			if tube.collect() {
+				return
+			}
+		case job := <-tube.jobSupply:
+			tube.stats.TotalJobs += 1
+			tube.put(job)
+		case request := <-tube.jobTouch:
+			request.success <- tube.touch(request)
+		case request := <-tube.jobKick:
+			request.success <- tube.kick(request.bound)
+		case request := <-tube.jobRelease:
+			request.success <- tube.release(request)
+		case request := <-tube.jobPeek:
+			tube.peek(request)
+		case request := <-tube.jobStats:
+			request.success <- tube.jobCopy(request.job)
+		case m := <-tube.jobSync:
+			tube.sync(m)
+			if tube.collect() {
+				return
 			}
-		} else {
+		case success := <-tube.tubeStats:
+			success <- tube.currentStats()
+		case success := <-tube.tubePaused:
+			success <- tube.pauseMutation()
+		case request := <-jobDemand:
+			// published before the client has the job, so a cluster can
+			// commit the reservation before the client is told.
+			job := tube.reserve(request.client)
+			tube.publish(mutationReserve, job)
 			select {
-			case duration := <-tube.tubePause:
-				tube.pause(duration)
-			case job := <-tube.jobBury:
-				tube.bury(job)
-			case job := <-tube.jobDelete:
-				tube.delete(job)
-			case job := <-tube.jobTouch:
-				tube.touch(job)
-			case request := <-tube.jobPeek:
-				tube.peek(request)
-			case request := <-tube.jobKick:
-				request.success <- tube.kick(request.bound)
-			case job := <-tube.jobSupply:
-				tube.put(job)
+			case request.success <- job:
+				tube.server.waitTime.observe(job.reservedAt.Sub(job.readyAt))
+			case <-request.cancel:
+				request.cancel <- true // propagate to the other tubes
+				tube.unreserve(job)
+				tube.publish(mutationRelease, job)
 			}
 		}
 	}
 }
 
+// asks the tube goroutine to collect the tube if it's unused. Must be called
+// with server.tubesLock held.
+func (tube *tube) check() {
+	if tube.using > 0 || tube.watching > 0 {
+		return
+	}
+
+	select {
+	case tube.tubeCheck <- true:
+	default: // a check is already pending
+	}
+}
+
+// asks the tube goroutine for the next job to leave state, nil if there is
+// none or the tube is gone.
+func (tube *tube) peekFirst(state string) *job {
+	request := &jobPeekRequest{
+		state:   state,
+		success: make(chan *job),
+	}
+
+	select {
+	case tube.jobPeek <- request:
+		return <-request.success
+	case <-tube.stopped:
+		return nil
+	}
+}
+
+// asks the tube goroutine to kick at most bound jobs, returns how many it did.
+func (tube *tube) kickUpTo(bound int) int {
+	request := &jobKickRequest{
+		bound:   bound,
+		success: make(chan int),
+	}
+
+	select {
+	case tube.jobKick <- request:
+		return <-request.success
+	case <-tube.stopped:
+		return 0
+	}
+}
+
+// asks the tube goroutine to pause for duration, reports whether the tube was
+// still there to do so.
+func (tube *tube) pauseFor(duration time.Duration) bool {
+	request := &tubePauseRequest{
+		duration: duration,
+		success:  make(chan bool),
+	}
+
+	select {
+	case tube.tubePause <- request:
+		return <-request.success
+	case <-tube.stopped:
+		return false
+	}
+}
+
+// removes the tube from the server once it holds no jobs and nobody uses or
+// watches it.
+func (tube *tube) collect() bool {
+	if tube.ready.Len()+tube.reserved.Len()+tube.delayed.Len()+tube.buried.Len() > 0 {
+		return false
+	}
+
+	if !tube.server.removeTube(tube) {
+		return false
+	}
+
+	close(tube.stopped)
+	return true
+}
+
 func (tube *tube) reserve(client *client) (job *job) {
 	job = tube.ready.getJob()
 
-	tube.reserved.putJob(job)
-
 	job.client = client
-	job.state = jobReservedState
 	job.reserveCount += 1
-	job.reserveEndsAt = time.Now().Add(job.timeToReserve)
+	job.reservedAt = time.Now()
+
+	tube.reserved.putJob(job)
 
 	return
 }
 
+// undoes a reservation the client gave up on before receiving the job.
+func (tube *tube) unreserve(job *job) {
+	readyAt := job.readyAt
+	tube.reserved.deleteJob(job)
+	job.client = nil
+	job.reserveCount -= 1
+	tube.ready.putJob(job)
+	job.readyAt = readyAt
+}
+
+// puts every reserved job whose time to run has elapsed back into the ready
+// queue.
+func (tube *tube) expire() {
+	now := time.Now()
+
+	for tube.reserved.Len() > 0 {
+		job := tube.reserved.peek()
+		if job.reserveEndsAt.After(now) {
+			return
+		}
+
+		tube.reserved.getJob()
+		job.client = nil
+		job.timeoutCount += 1
+		atomic.AddInt64(&tube.server.stats.TotalJobTimeouts, 1)
+		tube.ready.putJob(job)
+		tube.publish(mutationTimeout, job)
+	}
+}
+
 func (tube *tube) put(job *job) {
-	job.tube = tube
-	if job.isUrgent() {
-		tube.stats.CurrentUrgentJobs += 1
+	switch job.state {
+	case jobWillHaveDelayedState:
+		tube.delayed.putJob(job)
+	case jobBuriedState:
+		tube.buried.putJob(job)
+	default:
+		tube.ready.putJob(job)
 	}
+}
 
-	if job.state == jobWillHaveDelayedState {
-		tube.delayed.putJob(job, func() {
-			job.state = ""
-			tube.jobSupply <- job
-		})
-	} else {
+// moves every delayed job whose delay has run out into the ready queue.
+func (tube *tube) undelay() {
+	now := time.Now()
+
+	for tube.delayed.Len() > 0 {
+		job := tube.delayed.peek()
+		if job.delayEndsAt.After(now) {
+			return
+		}
+
+		tube.delayed.getJob()
 		tube.ready.putJob(job)
 	}
 }
 
-func (tube *tube) delete(job *job) {
-	if job.isUrgent() {
-		tube.stats.CurrentUrgentJobs -= 1
+// reports whether the job is reserved by client, the only one who may bury,
+// touch or release it.
+func (tube *tube) isReservedBy(job *job, client *client) bool {
+	return job.jobHolder != nil && job.state == jobReservedState && job.client == client
+}
+
+// deletes a job unless another client holds it. Of several clients deleting
+// the same job only the first succeeds.
+func (tube *tube) delete(request *jobRequest) bool {
+	job := request.job
+	if job.jobHolder == nil || (job.state == jobReservedState && job.client != request.client) {
+		return false
+	}
+
+	if !tube.server.jobs.remove(job.id) {
+		return false
 	}
+
+	if job.state == jobReservedState {
+		tube.server.processingTime.observe(time.Since(job.reservedAt))
+	}
+
 	job.jobHolder.deleteJob(job)
+	tube.server.binlog.deleteJob(job)
+	tube.stats.CmdDelete += 1
+	tube.server.free(job)
+	tube.publish(mutationDelete, job)
+	return true
 }
 
-func (tube *tube) bury(job *job) {
+func (tube *tube) bury(request *jobRequest) bool {
+	job := request.job
+	if !tube.isReservedBy(job, request.client) {
+		return false
+	}
+
 	job.jobHolder.buryJob(job)
 	job.state = jobBuriedState
 	job.buryCount += 1
 	job.client = nil
+	tube.server.binlog.updateJob(job)
+	tube.publish(mutationBury, job)
+	return true
+}
+
+// moves a job reserved by request.client back into the ready queue, or into
+// the delayed jobs if request.delay is positive. Answers like release.
+func (tube *tube) release(request *jobReleaseRequest) string {
+	job := request.job
+	if !tube.isReservedBy(job, request.client) {
+		return MSG_NOT_FOUND
+	}
+
+	tube.reserved.deleteJob(job)
+
+	job.client = nil
+	job.priority = request.priority
+	job.releaseCount += 1
+
+	if request.delay > 0 {
+		job.state = jobWillHaveDelayedState
+		job.delayEndsAt = time.Now().Add(time.Duration(request.delay) * time.Second)
+	}
+
+	tube.put(job)
+
+	// like beanstalkd, a job that can't be queued durably is buried. The
+	// binlog still has it reserved, which a restart makes ready.
+	if tube.server.binlog.updateJob(job) != nil {
+		job.jobHolder.buryJob(job)
+		job.state = jobBuriedState
+		job.buryCount += 1
+		tube.publish(mutationBury, job)
+		return MSG_BURIED
+	}
+
+	tube.publish(mutationRelease, job)
+	return MSG_RELEASED
 }
 
-func (tube *tube) touch(job *job) {
+func (tube *tube) touch(request *jobRequest) bool {
+	job := request.job
+	if !tube.isReservedBy(job, request.client) {
+		return false
+	}
+
 	job.jobHolder.touchJob(job)
+	tube.publish(mutationTouch, job)
+	return true
+}
+
+// returns a copy of the job other goroutines may read, or nil if it's gone.
+func (tube *tube) jobCopy(job *job) *job {
+	if job.jobHolder == nil {
+		return nil
+	}
+
+	copy := *job
+	return &copy
 }
 
+// stops handing out jobs for the given duration, a duration of 0 resumes the
+// tube right away.
 func (tube *tube) pause(duration time.Duration) {
+	tube.stats.CmdPauseTube += 1
+
+	if duration <= 0 {
+		tube.unpause()
+		return
+	}
+
 	tube.paused = true
 	tube.pauseStartedAt = time.Now()
-	tube.pauseEndsAt = time.Now().Add(duration)
-	time.Sleep(duration)
+	tube.pauseEndsAt = tube.pauseStartedAt.Add(duration)
 }
 
-func (tube *tube) kick(bound int) (actual int) {
+func (tube *tube) unpause() {
+	tube.paused = false
+	tube.pauseStartedAt = time.Time{}
+	tube.pauseEndsAt = time.Time{}
+}
+
+// returns a channel that receives once the pause is over, or nil if the tube
+// isn't paused.
+func (tube *tube) pauseExpiry() <-chan time.Time {
+	if !tube.paused {
+		return nil
+	}
+
+	return time.After(tube.pauseEndsAt.Sub(time.Now()))
+}
+
+func (tube *tube) kick(bound int) int {
+	var kicked []*job
 	if tube.buried.Len() > 0 {
-		actual = tube.buried.kickJobs(bound)
+		kicked = tube.buried.kickJobs(bound)
 	} else {
-		actual = tube.delayed.kickJobs(bound)
+		kicked = tube.delayed.kickJobs(bound)
 	}
 
-	return
+	for _, job := range kicked {
+		job.kickCount += 1
+		tube.server.binlog.updateJob(job)
+		tube.publish(mutationKick, job)
+	}
+
+	return len(kicked)
 }
 
 func (tube *tube) peek(request *jobPeekRequest) {